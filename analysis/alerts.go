@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type (
+	// AlertRule is a declarative condition on a user's sentiment that is
+	// checked every time they are analysed. Metric is measured over the last
+	// WindowDays days and compared to Threshold using Comparison. If UserIDs
+	// is empty then the rule applies to every user. Owner is the account that
+	// created the rule on the webserver.
+	AlertRule struct {
+		ID         int64 `datastore:"-"`
+		Name       string
+		UserIDs    []int64
+		Metric     string
+		Comparison string
+		Threshold  float64
+		WindowDays int
+		Created    time.Time
+		Owner      string
+	}
+
+	// AlertState records whether a rule is currently firing for a user, so an
+	// alert is only raised when the rule starts firing and not every time the
+	// user is analysed after that.
+	AlertState struct {
+		Firing  bool
+		Updated time.Time
+	}
+
+	// Alert is the history entry made every time a rule starts firing for a
+	// user. Owner is copied from the rule.
+	Alert struct {
+		RuleID             int64
+		RuleName           string
+		UserID             int64
+		Username           string
+		Metric, Comparison string
+		Value, Threshold   float64
+		WindowDays         int
+		Message            string
+		Triggered          time.Time
+		Owner              string
+	}
+)
+
+const (
+	alertRuleKind  = "AlertRule"
+	alertStateKind = "AlertState"
+	alertKind      = "Alert"
+
+	// metricNegativeShare is the fraction of tweets in the window that were
+	// negative.
+	metricNegativeShare = "negative_share"
+	// metricPositiveShare is the fraction of tweets in the window that were
+	// positive.
+	metricPositiveShare = "positive_share"
+	// metricAverage is the average score of the tweets in the window.
+	metricAverage = "average"
+	// metricAverageChange is the average score of the tweets in the window
+	// minus the average score of the window before it.
+	metricAverageChange = "average_change"
+
+	comparisonAbove = "above"
+	comparisonBelow = "below"
+)
+
+// average returns the average score of a set of tweets and whether there were
+// any tweets to take the average of.
+func average(positive, negative int) (float64, bool) {
+	if positive+negative == 0 {
+		return 0, false
+	}
+	return float64(positive-negative) / float64(positive+negative), true
+}
+
+// Applies returns true if the rule should be checked for the user.
+func (rule *AlertRule) Applies(userID int64) bool {
+	if len(rule.UserIDs) == 0 {
+		return true
+	}
+	for _, id := range rule.UserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Measure calculates the rule's metric for doc as of now. It returns false if
+// there were no tweets to measure.
+func (rule *AlertRule) Measure(doc *AnalysedDocument, now time.Time) (float64, bool) {
+	end := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	start := end.AddDate(0, 0, -rule.WindowDays)
+	positive, negative := doc.Window(start, end)
+	switch rule.Metric {
+	case metricNegativeShare:
+		if positive+negative == 0 {
+			return 0, false
+		}
+		return float64(negative) / float64(positive+negative), true
+	case metricPositiveShare:
+		if positive+negative == 0 {
+			return 0, false
+		}
+		return float64(positive) / float64(positive+negative), true
+	case metricAverage:
+		return average(positive, negative)
+	case metricAverageChange:
+		current, ok := average(positive, negative)
+		if !ok {
+			return 0, false
+		}
+		previous, ok := average(doc.Window(start.AddDate(0, 0, -rule.WindowDays), start))
+		if !ok {
+			return 0, false
+		}
+		return current - previous, true
+	}
+	return 0, false
+}
+
+// Fires returns true if value breaks the rule's threshold.
+func (rule *AlertRule) Fires(value float64) bool {
+	switch rule.Comparison {
+	case comparisonAbove:
+		return value > rule.Threshold
+	case comparisonBelow:
+		return value < rule.Threshold
+	}
+	return false
+}
+
+// alertStateKey returns the key of the state of the rule for the user.
+func alertStateKey(ruleID, userID int64) *datastore.Key {
+	return datastore.NameKey(alertStateKind, fmt.Sprintf("%d-%d", ruleID, userID), nil)
+}
+
+// check evaluates a single rule for the user and records the result. The alert
+// is returned if the rule has just started firing, otherwise nil is returned.
+func check(ds *datastore.Client, rule *AlertRule, doc *AnalysedDocument, now time.Time) (*Alert, error) {
+	value, ok := rule.Measure(doc, now)
+	firing := ok && rule.Fires(value)
+	var alert *Alert
+	_, err := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		alert = nil
+		key := alertStateKey(rule.ID, doc.UserID)
+		state := &AlertState{}
+		if err := tx.Get(key, state); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if state.Firing == firing {
+			return nil
+		}
+		if firing {
+			alert = &Alert{
+				RuleID:     rule.ID,
+				RuleName:   rule.Name,
+				UserID:     doc.UserID,
+				Username:   doc.Username,
+				Metric:     rule.Metric,
+				Comparison: rule.Comparison,
+				Value:      value,
+				Threshold:  rule.Threshold,
+				WindowDays: rule.WindowDays,
+				Message: fmt.Sprintf("%s: %s over the last %d days is %.3f, %s the threshold of %.3f",
+					doc.Username, rule.Metric, rule.WindowDays, value, rule.Comparison, rule.Threshold),
+				Triggered: now,
+				Owner:     rule.Owner,
+			}
+			if _, err := tx.Put(datastore.IncompleteKey(alertKind, nil), alert); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Put(key, &AlertState{Firing: firing, Updated: now})
+		return err
+	})
+	return alert, err
+}
+
+// evaluateRules checks every alert rule that applies to the user, persisting an
+// alert and notifying webhooks for each rule that starts firing.
+func evaluateRules(ds *datastore.Client, doc *AnalysedDocument) {
+	rules := make([]AlertRule, 0)
+	keys, err := ds.GetAll(context.Background(), datastore.NewQuery(alertRuleKind), &rules)
+	if err != nil {
+		logEntry(levelError, "could not get the alert rules: "+err.Error(), logFields{"user_id": doc.UserID})
+		return
+	}
+	now := time.Now()
+	for i := range rules {
+		rule := &rules[i]
+		rule.ID = keys[i].ID
+		if !rule.Applies(doc.UserID) {
+			continue
+		}
+		alert, err := check(ds, rule, doc, now)
+		if err != nil {
+			logEntry(levelError, "could not check the alert rule: "+err.Error(), logFields{"rule_id": rule.ID, "user_id": doc.UserID})
+			continue
+		}
+		if alert != nil {
+			logEntry(levelInfo, alert.Message, logFields{"rule_id": rule.ID, "user_id": doc.UserID})
+			notifyAlert(ds, alert)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasure(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 3, d, 0, 0, 0, 0, time.UTC) }
+	now := day(10).Add(15 * time.Hour)
+	doc := &AnalysedDocument{Days: []DayBucket{
+		{Day: day(11), PositiveTweets: 5},
+		{Day: day(10), PositiveTweets: 3, NegativeTweets: 1},
+		{Day: day(4), PositiveTweets: 1, NegativeTweets: 3},
+		{Day: day(3), NegativeTweets: 4},
+		{Day: day(3).AddDate(0, 0, -7), PositiveTweets: 10},
+	}}
+	recent := &AnalysedDocument{Days: []DayBucket{{Day: day(10), PositiveTweets: 1}}}
+	tests := []struct {
+		name   string
+		metric string
+		doc    *AnalysedDocument
+		want   float64
+		ok     bool
+	}{
+		{"the negative share of the window", metricNegativeShare, doc, 0.5, true},
+		{"the positive share of the window", metricPositiveShare, doc, 0.5, true},
+		{"the average of the window", metricAverage, doc, 0, true},
+		{"the change from the window before", metricAverageChange, doc, 1, true},
+		{"no tweets in the window", metricAverage, &AnalysedDocument{}, 0, false},
+		{"no share without tweets", metricNegativeShare, &AnalysedDocument{}, 0, false},
+		{"no change without tweets in the window before", metricAverageChange, recent, 0, false},
+		{"an unknown metric", "followers", doc, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &AlertRule{Metric: test.metric, WindowDays: 7}
+			if got, ok := rule.Measure(test.doc, now); got != test.want || ok != test.ok {
+				t.Errorf("Measure() = %v, %v, want %v, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestFires(t *testing.T) {
+	tests := []struct {
+		comparison string
+		value      float64
+		want       bool
+	}{
+		{comparisonAbove, 0.7, true},
+		{comparisonAbove, 0.6, false},
+		{comparisonAbove, 0.5, false},
+		{comparisonBelow, 0.5, true},
+		{comparisonBelow, 0.6, false},
+		{comparisonBelow, 0.7, false},
+		{"equal", 0.6, false},
+	}
+	for _, test := range tests {
+		rule := &AlertRule{Comparison: test.comparison, Threshold: 0.6}
+		if got := rule.Fires(test.value); got != test.want {
+			t.Errorf("Fires(%v) %s 0.6 = %v, want %v", test.value, test.comparison, got, test.want)
+		}
+	}
+}
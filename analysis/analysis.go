@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
@@ -19,23 +23,62 @@ type (
 	}
 
 	// CleanDocument is a collection of tweets (just the text) and some metadata
-	// about the user and the collection itself.
+	// about the user and the collection itself. TweetTimes holds the unix time
+	// each tweet was created at, in the same order as Tweets. Full is true if
+	// the whole timeline was fetched rather than only the tweets since the
+	// last fetch.
 	CleanDocument struct {
 		DocumentMetaData
-		Tweets []string
+		Tweets     []string
+		TweetTimes []int64
+		Full       bool
+	}
+
+	// DayBucket holds the sentiment counts of the tweets a user made on Day.
+	DayBucket struct {
+		Day                            time.Time
+		PositiveTweets, NegativeTweets int
 	}
 
 	// AnalysedDocument is the actual entity that is stored in the datastore. It
 	// contains metadata about the user and metrics about their tweets sentiment.
+	// Days breaks the metrics down by the day the tweets were made on, it is
+	// sorted from the earliest day to the latest. SearchName is the lower case
+	// Username so that the webserver can search users without caring about case.
 	AnalysedDocument struct {
 		DocumentMetaData
 		PositiveTweets, NegativeTweets int
 		AverageScore                   float64
+		Days                           []DayBucket `datastore:",noindex"`
+		SearchName                     string
+		LastAnalysed                   time.Time
+	}
+
+	// Job is the entity in the datastore that records a fetch request for a
+	// user while it moves through the pipeline. It is created by the webserver
+	// and finished here once the user's tweets have been stored.
+	Job struct {
+		Username           string
+		UserID             int64
+		Status             string
+		Requested, Updated time.Time
 	}
 
-	// Changes is the flag in the database indicating whether new data has been
-	// added since the last time Changes was checked and toggled.
-	Changes struct{ ChangesMade bool }
+	// permanentError is a failure that analysing the file again would not
+	// fix, such as the file being gone or not holding a document. The message
+	// is acknowledged and the job failed rather than retrying it.
+	permanentError struct{ error }
+
+	// Change is the entity in the datastore that records that a user was added
+	// to, updated in or removed from the datastore, so that name-index can
+	// update its index without rebuilding it. PreviousUsername is set when the
+	// user's username changed.
+	Change struct {
+		UserID                     int64
+		Username, PreviousUsername string
+		Op                         string
+		Time                       time.Time
+	}
 )
 
 // CalculateAverage calculates the average sentiment of a document.
@@ -57,94 +100,302 @@ func (d *AnalysedDocument) Merge(o *AnalysedDocument) *AnalysedDocument {
 	}
 	d.NegativeTweets += o.NegativeTweets
 	d.PositiveTweets += o.PositiveTweets
+	d.Days = mergeDays(d.Days, o.Days)
 	return d.CalculateAverage()
 }
 
+// Covers reports whether every tweet in o is already counted in d, which is
+// the case when o's tweets were analysed before.
+func (d *AnalysedDocument) Covers(o *AnalysedDocument) bool {
+	return d.EarliestTweetID <= o.EarliestTweetID && d.LastTweetID >= o.LastTweetID
+}
+
+// combine returns the document to store for a user whose tweets in doc were
+// just analysed, oldDoc is the document that is stored for them or nil. A
+// full fetch replaces oldDoc, as merging the tweets it has in common with
+// oldDoc would count them twice, tweets too old for Twitter to return are lost
+// from it. Otherwise doc is merged into oldDoc, unless oldDoc already covers
+// it, then nil is returned as there is nothing new to store.
+func combine(doc, oldDoc *AnalysedDocument, full bool) *AnalysedDocument {
+	switch {
+	case oldDoc == nil || full:
+		return doc
+	case oldDoc.Covers(doc):
+		return nil
+	}
+	return doc.Merge(oldDoc)
+}
+
+// mergeDays combines two sorted lists of buckets into one sorted list, adding
+// together the counts of buckets for the same day.
+func mergeDays(a, b []DayBucket) []DayBucket {
+	merged := make([]DayBucket, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Day.Before(b[j].Day):
+			merged = append(merged, a[i])
+			i++
+		case b[j].Day.Before(a[i].Day):
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, DayBucket{
+				Day:            a[i].Day,
+				PositiveTweets: a[i].PositiveTweets + b[j].PositiveTweets,
+				NegativeTweets: a[i].NegativeTweets + b[j].NegativeTweets,
+			})
+			i++
+			j++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
+}
+
+// Window sums up the sentiment counts of the tweets made in [from, to).
+func (d *AnalysedDocument) Window(from, to time.Time) (positive, negative int) {
+	for _, day := range d.Days {
+		if !day.Day.Before(from) && day.Day.Before(to) {
+			positive += day.PositiveTweets
+			negative += day.NegativeTweets
+		}
+	}
+	return positive, negative
+}
+
 const (
-	changesKind = "Changes"
-	userKind    = "User"
-)
+	// requestIDAttribute is the attribute of the message from the fetcher that
+	// carries the id of the request that submitted the user.
+	requestIDAttribute = "request_id"
 
-// changesKey is the key to an entity that indicates whether any updates to the database have happened
-var changesKey = datastore.IDKey(changesKind, 1, nil)
+	changeKind = "Change"
+	userKind   = "User"
+	jobKind    = "Job"
+
+	jobStatusDone   = "done"
+	jobStatusFailed = "failed"
+	changeUpsert    = "upsert"
+)
 
 // analyse performs analysis on all of the tweets in an object in cloud storage
-// using the model, then returns all of the new data.
-func analyse(obj *storage.ObjectHandle, model sentiment.Models) *AnalysedDocument {
+// using the model, then returns all of the new data and whether the tweets
+// are the user's whole timeline. The object is left for the caller to delete
+// once the data has been stored.
+func analyse(obj *storage.ObjectHandle, model sentiment.Models) (*AnalysedDocument, bool, error) {
 	reader, err := obj.NewReader(context.Background())
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-	if err := obj.Delete(context.Background()); err != nil {
-		log.Println(err)
-		return nil
+	if err == storage.ErrObjectNotExist {
+		return nil, false, permanentError{err}
+	} else if err != nil {
+		return nil, false, err
 	}
+	defer reader.Close()
 	decoder := json.NewDecoder(reader)
 	doc := &CleanDocument{}
 	if err := decoder.Decode(doc); err != nil {
-		log.Println(err)
-		return nil
+		return nil, false, permanentError{err}
 	}
 	newDoc := &AnalysedDocument{
 		DocumentMetaData: doc.DocumentMetaData,
 	}
-	for _, tweet := range doc.Tweets {
+	days := make(map[time.Time]*DayBucket)
+	start := time.Now()
+	for i, tweet := range doc.Tweets {
 		analysis := model.SentimentAnalysis(tweet, sentiment.English)
 		if analysis.Score == 0 {
 			newDoc.NegativeTweets += 1
 		} else if analysis.Score == 1 {
 			newDoc.PositiveTweets += 1
 		}
+		// documents fetched before tweet times were recorded do not have them
+		if i >= len(doc.TweetTimes) || doc.TweetTimes[i] <= 0 {
+			continue
+		}
+		day := time.Unix(doc.TweetTimes[i], 0).UTC().Truncate(24 * time.Hour)
+		bucket, ok := days[day]
+		if !ok {
+			bucket = &DayBucket{Day: day}
+			days[day] = bucket
+		}
+		if analysis.Score == 0 {
+			bucket.NegativeTweets += 1
+		} else if analysis.Score == 1 {
+			bucket.PositiveTweets += 1
+		}
+	}
+	scoringDuration.Observe(time.Since(start).Seconds())
+	tweetsScored.WithLabelValues(sentimentPositive).Add(float64(newDoc.PositiveTweets))
+	tweetsScored.WithLabelValues(sentimentNegative).Add(float64(newDoc.NegativeTweets))
+	newDoc.Days = make([]DayBucket, 0, len(days))
+	for _, bucket := range days {
+		newDoc.Days = append(newDoc.Days, *bucket)
 	}
+	sort.Slice(newDoc.Days, func(i, j int) bool { return newDoc.Days[i].Day.Before(newDoc.Days[j].Day) })
 	newDoc.AverageScore = float64((-1*newDoc.NegativeTweets)+newDoc.PositiveTweets) / float64(newDoc.NegativeTweets+newDoc.PositiveTweets)
-	return newDoc
+	return newDoc, doc.Full, nil
+}
+
+// isPermanent reports whether err is a permanentError.
+func isPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// fileUserID returns the id of the user whose tweets are in the file, the
+// fetcher names files after the user's id and their last tweet's id.
+func fileUserID(fileName string) (int64, bool) {
+	i := strings.IndexByte(fileName, '-')
+	if i < 0 {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(fileName[:i], 10, 64)
+	return id, err == nil
+}
+
+// failJob marks the job for the user as failed, unless it has already
+// finished because an earlier delivery of the same file was analysed.
+func failJob(ds *datastore.Client, userID int64) error {
+	key := datastore.IDKey(jobKind, userID, nil)
+	_, err := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		job := &Job{}
+		if err := tx.Get(key, job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if job.Status == jobStatusDone || job.Status == jobStatusFailed {
+			return nil
+		}
+		job.UserID, job.Status, job.Updated = userID, jobStatusFailed, time.Now()
+		_, err := tx.Put(key, job)
+		return err
+	})
+	return err
+}
+
+// finishJob marks the job for the user as done as part of tx. Users that were
+// submitted before jobs were tracked do not have one, a new one is made.
+func finishJob(tx *datastore.Transaction, userID int64) error {
+	key := datastore.IDKey(jobKind, userID, nil)
+	job := &Job{}
+	if err := tx.Get(key, job); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	job.UserID, job.Status, job.Updated = userID, jobStatusDone, time.Now()
+	_, err := tx.Put(key, job)
+	return err
+}
+
+// recordChange records that the user in doc was added or updated, oldDoc is
+// the user's previous document or nil if there was none.
+func recordChange(tx *datastore.Transaction, doc, oldDoc *AnalysedDocument) error {
+	change := &Change{
+		UserID:   doc.UserID,
+		Username: doc.Username,
+		Op:       changeUpsert,
+		Time:     time.Now(),
+	}
+	if oldDoc != nil && oldDoc.Username != doc.Username {
+		change.PreviousUsername = oldDoc.Username
+	}
+	_, err := tx.Put(datastore.IncompleteKey(changeKind, nil), change)
+	return err
 }
 
 // store takes in an AnalysedDocument and updates the necessary entities in
-// the datastore.
-//TODO: this might need changed
-func store(doc *AnalysedDocument, ds *datastore.Client) error {
+// the datastore, combine decides what is stored. It returns the stored
+// document and the document that was there before it, which is nil if the
+// user had not been analysed yet. If the tweets had already been analysed then
+// nothing is stored and both are nil.
+func store(doc *AnalysedDocument, full bool, ds *datastore.Client) (*AnalysedDocument, *AnalysedDocument, error) {
 	key := datastore.IDKey(userKind, doc.UserID, nil)
 	tx, err := ds.NewTransaction(context.Background())
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	// get the old entity
 	oldDoc := &AnalysedDocument{}
 	// TODO: Verify that we are making objects correctly, look up Update instead of Get->Put
 	if err := tx.Get(key, oldDoc); err != nil {
 		// pass, I think this means object is not in db yet, should be consistent
-	} else if oldDoc.EarliestTweetID < doc.EarliestTweetID &&
-		oldDoc.LastTweetID > doc.LastTweetID {
-		// if all of the tweets in this batch have already been covered then do
-		// not add them to the database as they have already been analysed.
-		return tx.Rollback()
-	} else {
-		doc = doc.Merge(oldDoc)
+		oldDoc = nil
 	}
+	if doc = combine(doc, oldDoc, full); doc == nil {
+		// all of the tweets in this batch have already been analysed, so
+		// there is nothing to add to the database
+		if err := finishJob(tx, key.ID); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		_, err = tx.Commit()
+		return nil, nil, err
+	}
+	doc.SearchName = strings.ToLower(doc.Username)
+	doc.LastAnalysed = time.Now()
 	// put the entity in the db
 	if _, err := tx.Put(key, doc); err != nil {
-		return err
+		tx.Rollback()
+		return nil, nil, err
+	}
+	// let name-index know that the user needs to be indexed
+	if err := recordChange(tx, doc, oldDoc); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	// let the webserver know that the user's job has completed
+	if err := finishJob(tx, doc.UserID); err != nil {
+		tx.Rollback()
+		return nil, nil, err
 	}
 	// commit the updates
 	if _, err = tx.Commit(); err != nil {
-		return err
+		return nil, nil, err
 	}
-	// update the changes flag in the database
-	_, err = ds.Put(context.Background(), changesKey, &Changes{ChangesMade: true})
-	return err
+	return doc, oldDoc, nil
 }
 
 // Analyse reads roughly cleaned tweets from the bucket and then performs
 // sentiment analysis on them. After all of the analysis is complete, the new
-// data is pushed to the datastore.
-func Analyse(bucket *storage.BucketHandle, model sentiment.Models, ds *datastore.Client, fileName string) {
-	log.Printf("File to be analysed: %s\n", fileName)
-	if doc := analyse(bucket.Object(fileName), model); doc != nil {
-		if err := store(doc, ds); err != nil {
-			log.Println("error storing doc: ", err)
-			return
+// data is pushed to the datastore, the file is deleted and any webhooks
+// subscribed to it are notified. requestID is the id of the request that
+// submitted the user, it is only logged. A permanentError means the file can
+// never be analysed and the user's job has been failed, any other error should
+// be retried.
+func Analyse(bucket *storage.BucketHandle, model sentiment.Models, ds *datastore.Client, fileName, requestID string) error {
+	start := time.Now()
+	fields := logFields{"request_id": requestID, "file": fileName}
+	logEntry(levelInfo, "file to be analysed", fields)
+	defer func() { analysisDuration.Observe(time.Since(start).Seconds()) }()
+	obj := bucket.Object(fileName)
+	doc, full, err := analyse(obj, model)
+	if err != nil {
+		documentsAnalysed.WithLabelValues(analysisResultFailed).Inc()
+		if !isPermanent(err) {
+			return err
+		}
+		if userID, ok := fileUserID(fileName); ok {
+			if failErr := failJob(ds, userID); failErr != nil {
+				return failErr
+			}
 		}
+		return err
+	}
+	fields["user_id"], fields["username"], fields["tweets"] = doc.UserID, doc.Username, doc.PositiveTweets+doc.NegativeTweets
+	current, previous, err := store(doc, full, ds)
+	fields["latency_ms"] = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		documentsAnalysed.WithLabelValues(analysisResultFailed).Inc()
+		return err
+	}
+	logEntry(levelInfo, "analysed", fields)
+	// a redelivered message finds the file gone and its job already done
+	if err := obj.Delete(context.Background()); err != nil && err != storage.ErrObjectNotExist {
+		logEntry(levelError, "could not delete the analysed file: "+err.Error(), fields)
+	}
+	if current == nil {
+		documentsAnalysed.WithLabelValues(analysisResultCovered).Inc()
+		return nil
 	}
+	documentsAnalysed.WithLabelValues(analysisResultStored).Inc()
+	notify(ds, current, previous)
+	evaluateRules(ds, current)
+	return nil
 }
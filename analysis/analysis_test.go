@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// day returns the day that is n days after the first of January 2021.
+func day(n int) time.Time {
+	return time.Date(2021, time.January, 1+n, 0, 0, 0, 0, time.UTC)
+}
+
+// document returns an analysed document for user 1 with the tweets between
+// earliest and last and the day buckets.
+func document(earliest, last int64, days ...DayBucket) *AnalysedDocument {
+	doc := &AnalysedDocument{
+		DocumentMetaData: DocumentMetaData{Username: "someone", UserID: 1, EarliestTweetID: earliest, LastTweetID: last},
+		Days:             days,
+	}
+	for _, d := range days {
+		doc.PositiveTweets += d.PositiveTweets
+		doc.NegativeTweets += d.NegativeTweets
+	}
+	return doc.CalculateAverage()
+}
+
+func TestMergeDays(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []DayBucket
+		want []DayBucket
+	}{
+		{"both empty", nil, nil, []DayBucket{}},
+		{"one empty", []DayBucket{{day(0), 1, 2}}, nil, []DayBucket{{day(0), 1, 2}}},
+		{
+			"disjoint days are interleaved",
+			[]DayBucket{{day(0), 1, 0}, {day(2), 0, 1}},
+			[]DayBucket{{day(1), 2, 0}, {day(3), 0, 2}},
+			[]DayBucket{{day(0), 1, 0}, {day(1), 2, 0}, {day(2), 0, 1}, {day(3), 0, 2}},
+		},
+		{
+			"the same day is added together",
+			[]DayBucket{{day(0), 1, 1}, {day(1), 2, 0}},
+			[]DayBucket{{day(1), 3, 4}},
+			[]DayBucket{{day(0), 1, 1}, {day(1), 5, 4}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeDays(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeDays() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	old := document(10, 20, DayBucket{day(0), 3, 1}, DayBucket{day(1), 1, 1})
+	doc := document(21, 30, DayBucket{day(1), 2, 0}, DayBucket{day(2), 0, 2})
+	got := doc.Merge(old)
+	want := document(10, 30, DayBucket{day(0), 3, 1}, DayBucket{day(1), 3, 1}, DayBucket{day(2), 0, 2})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() = %+v, want %+v", got, want)
+	}
+	if got.AverageScore != 0.2 {
+		t.Errorf("AverageScore = %v, want 0.2", got.AverageScore)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	stored := func() *AnalysedDocument { return document(10, 20, DayBucket{day(0), 3, 1}) }
+	tests := []struct {
+		name   string
+		doc    *AnalysedDocument
+		oldDoc *AnalysedDocument
+		full   bool
+		want   *AnalysedDocument
+	}{
+		{
+			"a new user is stored as it is",
+			document(10, 20, DayBucket{day(0), 3, 1}), nil, true,
+			document(10, 20, DayBucket{day(0), 3, 1}),
+		},
+		{
+			"newer tweets are added",
+			document(21, 30, DayBucket{day(1), 1, 0}), stored(), false,
+			document(10, 30, DayBucket{day(0), 3, 1}, DayBucket{day(1), 1, 0}),
+		},
+		{
+			"a redelivered document is not counted twice",
+			document(21, 30, DayBucket{day(1), 1, 0}), document(10, 30, DayBucket{day(0), 3, 1}, DayBucket{day(1), 1, 0}), false,
+			nil,
+		},
+		{
+			"the same tweets are not counted twice",
+			document(10, 20, DayBucket{day(0), 3, 1}), stored(), false,
+			nil,
+		},
+		{
+			"a full fetch of the same tweets replaces them",
+			document(10, 20, DayBucket{day(0), 3, 1}), stored(), true,
+			document(10, 20, DayBucket{day(0), 3, 1}),
+		},
+		{
+			"a full fetch with newer tweets replaces them",
+			document(12, 25, DayBucket{day(0), 2, 1}, DayBucket{day(1), 1, 0}), stored(), true,
+			document(12, 25, DayBucket{day(0), 2, 1}, DayBucket{day(1), 1, 0}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := combine(test.doc, test.oldDoc, test.full); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("combine() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFileUserID(t *testing.T) {
+	tests := []struct {
+		fileName string
+		id       int64
+		ok       bool
+	}{
+		{"1234-5678.json", 1234, true},
+		{"1234-0.json", 1234, true},
+		{"1234.json", 0, false},
+		{"user-5678.json", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.fileName, func(t *testing.T) {
+			if id, ok := fileUserID(test.fileName); id != test.id || ok != test.ok {
+				t.Errorf("fileUserID() = %d, %v, want %d, %v", id, ok, test.id, test.ok)
+			}
+		})
+	}
+}
@@ -8,5 +8,6 @@ require (
 	cloud.google.com/go/storage v1.14.0
 	github.com/cdipaolo/goml v0.0.0-20190412180403-e1f51f713598 // indirect
 	github.com/cdipaolo/sentiment v0.0.0-20200617002423-c697f64e7f10
+	github.com/prometheus/client_golang v1.11.0
 	google.golang.org/genproto v0.0.0-20210421164718-3947dc264843 // indirect
 )
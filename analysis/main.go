@@ -11,6 +11,7 @@ import (
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
 	"github.com/cdipaolo/sentiment"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var envVarNames = []string{
@@ -108,22 +109,38 @@ func Health(w http.ResponseWriter, r *http.Request) {
 
 // main starts up the webserver.
 func main() {
+	InitLogging()
 	// Get clients
 	bucket, model, ds, psClient := InitLibs()
 	ctx := context.Background()
 	sub := ConfigurePubSub(psClient)
-	receiveErr := sub.Receive(ctx, func(ctx context.Context, message *pubsub.Message) {
-		//TODO: add some error handling
-		file := string(message.Data)
-		Analyse(bucket, model, ds, file)
-		message.Ack()
-	})
-	//TODO: make sure this is appropriate error handling
-	if receiveErr != nil {
-		log.Fatalf("Error receiving from publisher: #{err}]\n")
-	}
+	// Retry the webhook deliveries that failed or were left pending
+	go retryDeliveries(ds)
+	// Receive blocks while it receives documents, so the endpoints below are
+	// served alongside it
+	go func() {
+		receiveErr := sub.Receive(ctx, func(ctx context.Context, message *pubsub.Message) {
+			file := string(message.Data)
+			requestID := message.Attributes[requestIDAttribute]
+			if err := Analyse(bucket, model, ds, file, requestID); err != nil {
+				logEntry(levelError, err.Error(), logFields{"request_id": requestID, "file": file})
+				// the file can never be analysed, so it is not redelivered
+				if !isPermanent(err) {
+					message.Nack()
+					return
+				}
+			}
+			message.Ack()
+		})
+		//TODO: make sure this is appropriate error handling
+		if receiveErr != nil {
+			log.Fatalf("Error receiving from publisher: %v\n", receiveErr)
+		}
+	}()
 
 	// Handle calls to the health endpoint
 	http.HandleFunc("/api/health", Health)
+	// Handle scrapes of the analyser's metrics
+	http.Handle("/metrics", promhttp.Handler())
 	log.Fatal(http.ListenAndServe(os.Getenv(envVarNames[evAddress]), nil))
 }
@@ -0,0 +1,37 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	analysisResultStored  = "stored"
+	analysisResultCovered = "already_analysed"
+	analysisResultFailed  = "failed"
+	sentimentPositive     = "positive"
+	sentimentNegative     = "negative"
+)
+
+// The metrics of the analyser, they are served at /metrics.
+var (
+	documentsAnalysed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "analysis_documents_total",
+		Help: "How many documents of tweets were analysed, by whether they were stored, had already been analysed or failed.",
+	}, []string{"result"})
+	tweetsScored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "analysis_tweets_scored_total",
+		Help: "How many tweets were scored, by their sentiment.",
+	}, []string{"sentiment"})
+	scoringDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "analysis_scoring_duration_seconds",
+		Help:    "How long it took to score every tweet in a document.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	analysisDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "analysis_duration_seconds",
+		Help:    "How long it took to read, score and store a document.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(documentsAnalysed, tweetsScored, scoringDuration, analysisDuration)
+}
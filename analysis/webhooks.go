@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type (
+	// Webhook is a subscription to events about analysed users. Payloads are
+	// signed with Secret so the receiver can verify where they came from. If
+	// UserIDs is empty then events for every user are sent. Threshold is how
+	// far a user's AverageScore has to move for a sentiment shift event.
+	// Owner is the account that registered the webhook.
+	Webhook struct {
+		URL, Secret string
+		Events      []string
+		UserIDs     []int64
+		Threshold   float64
+		Created     time.Time
+		Owner       string
+	}
+
+	// WebhookPayload is the body that is sent to a webhook. PreviousScore is
+	// the user's AverageScore before this analysis, it is only set for users
+	// that had already been analysed. Alert is only set for alert events.
+	WebhookPayload struct {
+		Event         string
+		Time          time.Time
+		Document      *AnalysedDocument `json:",omitempty"`
+		PreviousScore *float64          `json:",omitempty"`
+		Alert         *Alert            `json:",omitempty"`
+	}
+
+	// WebhookDelivery is a payload that has not been delivered to Webhook
+	// yet. It is stored before the first attempt, so deliveries outlive the
+	// analyser, and deleted once it succeeds or Attempts runs out. Due is
+	// when the next attempt should be made, while an attempt is in flight it
+	// is pushed back by deliveryLease so that no other replica makes it too.
+	WebhookDelivery struct {
+		Webhook  *datastore.Key
+		Event    string
+		Body     []byte `datastore:",noindex"`
+		Attempts int
+		Due      time.Time
+		Created  time.Time
+	}
+)
+
+const (
+	webhookKind  = "Webhook"
+	deliveryKind = "WebhookDelivery"
+
+	eventAnalysisCompleted = "analysis.completed"
+	eventSentimentShifted  = "sentiment.shifted"
+	eventAlertTriggered    = "alert.triggered"
+
+	signatureHeader = "X-Signature-256"
+	eventHeader     = "X-Webhook-Event"
+
+	// deliveryAttempts is how many times a payload is sent before giving up.
+	deliveryAttempts = 5
+	// deliveryBackoff is the wait before the first retry, it doubles after
+	// each failed attempt.
+	deliveryBackoff = 2 * time.Second
+	deliveryTimeout = 10 * time.Second
+	// deliveryLease is how long an attempt holds a delivery, it is well over
+	// deliveryTimeout.
+	deliveryLease = 3 * deliveryTimeout
+	// deliveryPoll is how often the deliveries that are due are looked for.
+	deliveryPoll = 5 * time.Second
+	// deliveryBatch is the most deliveries that are attempted in one poll.
+	deliveryBatch = 100
+)
+
+// webhookClient delivers payloads. It refuses to connect to internal addresses,
+// the webserver checks them when a webhook is registered but the host could
+// resolve to somewhere else by the time a payload is sent.
+var webhookClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: deliveryTimeout, Control: refuseInternal}).DialContext,
+	},
+}
+
+// privateNetworks are the address ranges that are only reachable inside a
+// network.
+var privateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// parseNetworks parses the CIDR ranges, they are constants so it panics if
+// one cannot be parsed.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// internalIP reports whether ip is loopback, private, link-local or otherwise
+// not on the internet.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseInternal stops the dialer from connecting to an internal address.
+func refuseInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("webhook address %s is not on the internet", host)
+	}
+	return nil
+}
+
+// Wants returns true if the webhook is subscribed to event for the user.
+func (h *Webhook) Wants(event string, userID int64) bool {
+	subscribed := false
+	for _, e := range h.Events {
+		if e == event {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return false
+	}
+	if len(h.UserIDs) == 0 {
+		return true
+	}
+	for _, id := range h.UserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body using secret.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send makes a single attempt at delivering body to the webhook.
+func send(hook *Webhook, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, event)
+	req.Header.Set(signatureHeader, sign(hook.Secret, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// retryAfter is how long to wait before the next attempt at a delivery that
+// has failed attempts times, it doubles after each failed attempt.
+func retryAfter(attempts int) time.Duration {
+	return deliveryBackoff << uint(attempts-1)
+}
+
+// claim takes the delivery with the key if it is due, by pushing it back by
+// deliveryLease. It returns nil if the delivery is gone or not due, which is
+// the case when another attempt has already claimed it.
+func claim(ds *datastore.Client, key *datastore.Key, now time.Time) (*WebhookDelivery, error) {
+	var delivery *WebhookDelivery
+	_, err := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		delivery = nil
+		d := &WebhookDelivery{}
+		if err := tx.Get(key, d); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Due.After(now) {
+			return nil
+		}
+		d.Due = now.Add(deliveryLease)
+		if _, err := tx.Put(key, d); err != nil {
+			return err
+		}
+		delivery = d
+		return nil
+	})
+	return delivery, err
+}
+
+// attempt makes the next attempt at the delivery with the key. It is deleted
+// once it succeeds, runs out of attempts or its webhook has been deleted, and
+// is otherwise due again after the backoff.
+func attempt(ds *datastore.Client, key *datastore.Key) {
+	fields := logFields{"location": "webhooks", "delivery": key.ID}
+	delivery, err := claim(ds, key, time.Now())
+	if err != nil {
+		logEntry(levelError, "could not claim the webhook delivery: "+err.Error(), fields)
+		return
+	}
+	if delivery == nil {
+		return
+	}
+	hook := &Webhook{}
+	if err := ds.Get(context.Background(), delivery.Webhook, hook); err == datastore.ErrNoSuchEntity {
+		if err := ds.Delete(context.Background(), key); err != nil {
+			logEntry(levelError, "could not delete the webhook delivery: "+err.Error(), fields)
+		}
+		return
+	} else if err != nil {
+		logEntry(levelError, "could not get the webhook: "+err.Error(), fields)
+		return
+	}
+	fields["url"], fields["event"] = hook.URL, delivery.Event
+	delivery.Attempts++
+	err = send(hook, delivery.Event, delivery.Body)
+	if err == nil || delivery.Attempts >= deliveryAttempts {
+		if err != nil {
+			logEntry(levelError, fmt.Sprintf("giving up on the webhook delivery after %d attempts: %v", delivery.Attempts, err), fields)
+		}
+		if err := ds.Delete(context.Background(), key); err != nil {
+			logEntry(levelError, "could not delete the webhook delivery: "+err.Error(), fields)
+		}
+		return
+	}
+	logEntry(levelError, fmt.Sprintf("webhook delivery failed (attempt %d/%d): %v", delivery.Attempts, deliveryAttempts, err), fields)
+	delivery.Due = time.Now().Add(retryAfter(delivery.Attempts))
+	if _, err := ds.Put(context.Background(), key, delivery); err != nil {
+		logEntry(levelError, "could not reschedule the webhook delivery: "+err.Error(), fields)
+	}
+}
+
+// retryDeliveries attempts the deliveries that are due every deliveryPoll, so
+// that the ones that failed, or were pending when an analyser stopped, are
+// retried. It never returns.
+func retryDeliveries(ds *datastore.Client) {
+	for range time.Tick(deliveryPoll) {
+		query := datastore.NewQuery(deliveryKind).Filter("Due <=", time.Now()).KeysOnly().Limit(deliveryBatch)
+		keys, err := ds.GetAll(context.Background(), query, nil)
+		if err != nil {
+			logEntry(levelError, "could not get the webhook deliveries that are due: "+err.Error(), logFields{"location": "webhooks"})
+			continue
+		}
+		for _, key := range keys {
+			go attempt(ds, key)
+		}
+	}
+}
+
+// webhooks gets every webhook subscription and their keys.
+func webhooks(ds *datastore.Client) ([]*datastore.Key, []Webhook, error) {
+	hooks := make([]Webhook, 0)
+	keys, err := ds.GetAll(context.Background(), datastore.NewQuery(webhookKind), &hooks)
+	return keys, hooks, err
+}
+
+// enqueue stores a delivery of the payload to the webhook with the key and
+// makes the first attempt in the background, so it never holds up analysis.
+func enqueue(ds *datastore.Client, hook *datastore.Key, payload *WebhookPayload) {
+	fields := logFields{"location": "webhooks", "webhook": hook.ID, "event": payload.Event}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logEntry(levelError, "could not encode the webhook payload: "+err.Error(), fields)
+		return
+	}
+	now := time.Now()
+	delivery := &WebhookDelivery{Webhook: hook, Event: payload.Event, Body: body, Due: now, Created: now}
+	key, err := ds.Put(context.Background(), datastore.IncompleteKey(deliveryKind, nil), delivery)
+	if err != nil {
+		logEntry(levelError, "could not store the webhook delivery: "+err.Error(), fields)
+		return
+	}
+	go attempt(ds, key)
+}
+
+// notify sends the events caused by storing current to every webhook that is
+// subscribed to them. previous is the document that current replaced, or nil.
+func notify(ds *datastore.Client, current, previous *AnalysedDocument) {
+	keys, hooks, err := webhooks(ds)
+	if err != nil {
+		logEntry(levelError, "could not get the webhooks: "+err.Error(), logFields{"location": "webhooks", "user_id": current.UserID})
+		return
+	}
+	now := time.Now()
+	for i := range hooks {
+		hook := &hooks[i]
+		if hook.Wants(eventAnalysisCompleted, current.UserID) {
+			payload := &WebhookPayload{Event: eventAnalysisCompleted, Time: now, Document: current}
+			if previous != nil {
+				payload.PreviousScore = &previous.AverageScore
+			}
+			enqueue(ds, keys[i], payload)
+		}
+		if previous != nil && hook.Threshold > 0 && hook.Wants(eventSentimentShifted, current.UserID) &&
+			math.Abs(current.AverageScore-previous.AverageScore) >= hook.Threshold {
+			enqueue(ds, keys[i], &WebhookPayload{
+				Event:         eventSentimentShifted,
+				Time:          now,
+				Document:      current,
+				PreviousScore: &previous.AverageScore,
+			})
+		}
+	}
+}
+
+// notifyAlert sends the alert to every webhook that is subscribed to alerts for
+// the user it was raised for.
+func notifyAlert(ds *datastore.Client, alert *Alert) {
+	keys, hooks, err := webhooks(ds)
+	if err != nil {
+		logEntry(levelError, "could not get the webhooks: "+err.Error(), logFields{"location": "webhooks", "user_id": alert.UserID})
+		return
+	}
+	for i := range hooks {
+		if hooks[i].Wants(eventAlertTriggered, alert.UserID) {
+			enqueue(ds, keys[i], &WebhookPayload{Event: eventAlertTriggered, Time: alert.Triggered, Alert: alert})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+		{"0.0.0.0", true},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			if got := internalIP(net.ParseIP(test.ip)); got != test.want {
+				t.Errorf("internalIP(%s) = %v, want %v", test.ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRefuseInternal(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:443", true},
+		{"10.0.0.1:443", true},
+		{"8.8.8.8:443", false},
+		{"example.com:443", true},
+		{"8.8.8.8", true},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			if err := refuseInternal("tcp", test.address, nil); (err != nil) != test.refused {
+				t.Errorf("refuseInternal(%s) = %v, want refused %v", test.address, err, test.refused)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, deliveryBackoff},
+		{2, 2 * deliveryBackoff},
+		{4, 8 * deliveryBackoff},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.attempts); got != test.want {
+			t.Errorf("retryAfter(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// Change is the entity in the database that the analyser writes every
+	// time it adds or updates a user. PreviousUsername is set when the user's
+	// username changed.
+	Change struct {
+		UserID                     int64
+		Username, PreviousUsername string
+		Op                         string
+		Time                       time.Time
+	}
+)
+
+const (
+	changeKind   = "Change"
+	changeUpsert = "upsert"
+	changeRemove = "remove"
+
+	// changesPageSize is how many changes are applied to the index at a time.
+	changesPageSize = 5000
+	// maxDeleteMulti is the most entities the database deletes in one call.
+	maxDeleteMulti = 500
+	// changeLag is how far behind now the watermark is kept. A change's Time
+	// is set before the transaction it is written in commits, so a change can
+	// become visible after changes with later times have been read.
+	changeLag = 5 * time.Minute
+	// changeRetention is how long changes are kept after they are behind the
+	// watermark, they are deleted when the index is compacted.
+	changeRetention = 7 * 24 * time.Hour
+)
+
+// getWatermark gets the time that every change up to has been applied to the
+// index, the zero time if the index has never been written.
+func getWatermark(ds *datastore.Client) (time.Time, error) {
+	state := &IndexState{}
+	err := ds.Get(context.Background(), indexStateKey, state)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return time.Time{}, err
+	}
+	return state.Watermark, nil
+}
+
+// setWatermark records that every change up to watermark has been applied.
+func setWatermark(ds *datastore.Client, watermark time.Time) error {
+	_, err := ds.Put(context.Background(), indexStateKey, &IndexState{Watermark: watermark})
+	return err
+}
+
+// changesBetween gets the changes made after from and at or before to, in the
+// order they were made. It is read a page at a time.
+func changesBetween(ds *datastore.Client, from, to time.Time) ([]Change, error) {
+	changes := make([]Change, 0)
+	query := datastore.NewQuery(changeKind).Filter("Time >", from).Filter("Time <=", to).Order("Time")
+	for {
+		page := make([]Change, 0, changesPageSize)
+		it := ds.Run(context.Background(), query.Limit(changesPageSize))
+		for {
+			change := Change{}
+			if _, err := it.Next(&change); err == iterator.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			page = append(page, change)
+		}
+		changes = append(changes, page...)
+		if len(page) < changesPageSize {
+			return changes, nil
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		query = query.Start(cursor)
+	}
+}
+
+// deleteChangesBefore deletes the changes made at or before the time.
+func deleteChangesBefore(ds *datastore.Client, before time.Time) error {
+	keys, err := ds.GetAll(context.Background(), datastore.NewQuery(changeKind).Filter("Time <=", before).KeysOnly(), nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += maxDeleteMulti {
+		end := start + maxDeleteMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := ds.DeleteMulti(context.Background(), keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndex brings the index up to date with the changes made since the
+// watermark and ranks the users again. The index is compacted instead if it
+// has never been written or was last compacted more than compactInterval ago.
+// The watermark is only moved once the index has been written, so a failed run
+// is picked up by the next one, applying a change twice does not change the
+// index.
+func updateIndex(ds *datastore.Client, bucket *storage.BucketHandle) error {
+	manifest, err := readManifest(bucket)
+	if err != nil {
+		return err
+	}
+	watermark, err := getWatermark(ds)
+	if err != nil {
+		return err
+	}
+	upTo := time.Now().Add(-changeLag)
+	if manifest.Version == 0 || watermark.IsZero() || time.Since(manifest.Compacted) > compactInterval {
+		// every change made before upTo is covered by the users read after it
+		users, err := users(ds)
+		if err != nil {
+			return err
+		}
+		if err := compact(bucket, manifest, users); err != nil {
+			return err
+		}
+		if err := setWatermark(ds, upTo); err != nil {
+			return err
+		}
+		if err := storeLeaderboards(ds, bucket); err != nil {
+			return err
+		}
+		return deleteChangesBefore(ds, upTo.Add(-changeRetention))
+	}
+	changes, err := changesBetween(ds, watermark, upTo)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		logEntry(levelInfo, "no changes detected", nil)
+		return nil
+	}
+	if err := applyChanges(bucket, manifest, changes); err != nil {
+		return err
+	}
+	if err := setWatermark(ds, upTo); err != nil {
+		return err
+	}
+	// scores changed along with the index
+	return storeLeaderboards(ds, bucket)
+}
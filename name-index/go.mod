@@ -5,4 +5,6 @@ go 1.16
 require (
 	cloud.google.com/go/datastore v1.5.0
 	cloud.google.com/go/storage v1.15.0
+	github.com/prometheus/client_golang v1.11.0
+	google.golang.org/api v0.45.0
 )
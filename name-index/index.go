@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// IndexEntry is a single user in a segment of the prefix index.
+	IndexEntry struct {
+		Username string
+		UserID   int64
+	}
+
+	// SegmentInfo describes a single segment of the index. Version is the
+	// version of the index that the segment was last written in.
+	SegmentInfo struct {
+		Version int64
+		Users   int
+	}
+
+	// Manifest describes the prefix index. Segments maps the key of every
+	// segment to its info, and Version goes up by one every time the index is
+	// written. Compacted is when the index was last rebuilt from scratch.
+	Manifest struct {
+		Version   int64
+		Updated   time.Time
+		Compacted time.Time
+		Users     int
+		Segments  map[string]SegmentInfo
+	}
+)
+
+const (
+	manifestObject = "name-index/manifest.json"
+	segmentsPrefix = "name-index/segments/"
+
+	// segmentKeyLength is how many leading characters of a lower case username
+	// decide which segment the user is in.
+	segmentKeyLength = 2
+	// compactInterval is how often the index is rebuilt from scratch rather
+	// than updated from the changes.
+	compactInterval = 24 * time.Hour
+)
+
+// searchName is the form of a username that the index is sorted and searched
+// by, usernames are not case sensitive.
+func searchName(username string) string {
+	return strings.ToLower(username)
+}
+
+// segmentKey returns the key of the segment that a username belongs in.
+func segmentKey(username string) string {
+	name := []rune(searchName(username))
+	if len(name) > segmentKeyLength {
+		name = name[:segmentKeyLength]
+	}
+	return string(name)
+}
+
+// segmentObject returns the name of the object a version of a segment is
+// stored in. Every version of a segment is a new object, so the webserver
+// never reads a segment that does not match the manifest it has.
+func segmentObject(key string, version int64) string {
+	return segmentsPrefix + key + "/" + strconv.FormatInt(version, 10) + ".json"
+}
+
+// buildSegments splits the users into segments by the start of their
+// usernames, each segment is sorted by searchName.
+func buildSegments(users []User) map[string][]IndexEntry {
+	segments := make(map[string][]IndexEntry)
+	for _, user := range users {
+		if user.Username == "" {
+			continue
+		}
+		key := segmentKey(user.Username)
+		segments[key] = append(segments[key], IndexEntry{Username: user.Username, UserID: user.UserID})
+	}
+	for _, entries := range segments {
+		sortEntries(entries)
+	}
+	return segments
+}
+
+// sortEntries sorts the entries of a segment by searchName.
+func sortEntries(entries []IndexEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return searchName(entries[i].Username) < searchName(entries[j].Username)
+	})
+}
+
+// writeObject stores data as JSON in the object with the name.
+func writeObject(bucket *storage.BucketHandle, name string, data interface{}) error {
+	w := bucket.Object(name).NewWriter(context.Background())
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		w.Close()
+		return err
+	}
+	// the object is only written once the writer is closed
+	return w.Close()
+}
+
+// readObject decodes the JSON object with the name into dst.
+func readObject(bucket *storage.BucketHandle, name string, dst interface{}) error {
+	r, err := bucket.Object(name).NewReader(context.Background())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(dst)
+}
+
+// readManifest gets the manifest of the index, an empty manifest is returned
+// if the index has never been written.
+func readManifest(bucket *storage.BucketHandle) (*Manifest, error) {
+	manifest := &Manifest{Segments: make(map[string]SegmentInfo)}
+	err := readObject(bucket, manifestObject, manifest)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+	recordIndex(manifest)
+	return manifest, nil
+}
+
+// readSegment gets the entries of the segment with the key, or nothing if the
+// manifest has no such segment.
+func readSegment(bucket *storage.BucketHandle, manifest *Manifest, key string) ([]IndexEntry, error) {
+	info, ok := manifest.Segments[key]
+	if !ok {
+		return make([]IndexEntry, 0), nil
+	}
+	entries := make([]IndexEntry, 0, info.Users)
+	err := readObject(bucket, segmentObject(key, info.Version), &entries)
+	return entries, err
+}
+
+// writeIndex writes the segments as the next version of the index. Every
+// segment is written before the manifest, so the manifest never lists a
+// segment that does not exist yet. Empty segments are removed from the
+// manifest.
+func writeIndex(bucket *storage.BucketHandle, manifest *Manifest, segments map[string][]IndexEntry) error {
+	manifest.Version++
+	manifest.Updated = time.Now()
+	for key, entries := range segments {
+		if len(entries) == 0 {
+			delete(manifest.Segments, key)
+			continue
+		}
+		if err := writeObject(bucket, segmentObject(key, manifest.Version), entries); err != nil {
+			return err
+		}
+		manifest.Segments[key] = SegmentInfo{Version: manifest.Version, Users: len(entries)}
+	}
+	manifest.Users = 0
+	for _, info := range manifest.Segments {
+		manifest.Users += info.Users
+	}
+	if err := writeObject(bucket, manifestObject, manifest); err != nil {
+		return err
+	}
+	recordIndex(manifest)
+	return nil
+}
+
+// removeGarbage deletes every version of every segment that the manifest does
+// not point to.
+func removeGarbage(bucket *storage.BucketHandle, manifest *Manifest) error {
+	current := make(map[string]bool, len(manifest.Segments))
+	for key, info := range manifest.Segments {
+		current[segmentObject(key, info.Version)] = true
+	}
+	it := bucket.Objects(context.Background(), &storage.Query{Prefix: segmentsPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if current[attrs.Name] {
+			continue
+		}
+		err = bucket.Object(attrs.Name).Delete(context.Background())
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
+
+// compact rebuilds the index from every user in the database and removes the
+// segments of older versions. Every segment is rewritten, so segments that
+// have no users any more are dropped.
+func compact(bucket *storage.BucketHandle, manifest *Manifest, users []User) error {
+	segments := buildSegments(users)
+	for key := range manifest.Segments {
+		if _, ok := segments[key]; !ok {
+			segments[key] = nil
+		}
+	}
+	manifest.Compacted = time.Now()
+	if err := writeIndex(bucket, manifest, segments); err != nil {
+		return err
+	}
+	indexCompacted.Set(1)
+	logEntry(levelInfo, "compacted the index", logFields{"version": manifest.Version, "users": manifest.Users})
+	return removeGarbage(bucket, manifest)
+}
+
+// changeSegments returns the segments that the changes touch with the changes
+// applied, read reads a segment as it is before them. Changes are applied in
+// order, every change removes the user from the segments of its username and
+// previous username and then an upsert adds the user back under its username.
+func changeSegments(changes []Change, read func(key string) ([]IndexEntry, error)) (map[string][]IndexEntry, error) {
+	segments := make(map[string][]IndexEntry)
+	load := func(key string) error {
+		if _, ok := segments[key]; ok {
+			return nil
+		}
+		entries, err := read(key)
+		segments[key] = entries
+		return err
+	}
+	for _, change := range changes {
+		keys := []string{segmentKey(change.Username)}
+		if change.PreviousUsername != "" {
+			keys = append(keys, segmentKey(change.PreviousUsername))
+		}
+		for _, key := range keys {
+			if err := load(key); err != nil {
+				return nil, err
+			}
+			kept := segments[key][:0]
+			for _, entry := range segments[key] {
+				if entry.UserID != change.UserID {
+					kept = append(kept, entry)
+				}
+			}
+			segments[key] = kept
+		}
+		if change.Op == changeUpsert && change.Username != "" {
+			segments[keys[0]] = append(segments[keys[0]], IndexEntry{Username: change.Username, UserID: change.UserID})
+		}
+	}
+	for _, entries := range segments {
+		sortEntries(entries)
+	}
+	return segments, nil
+}
+
+// applyChanges updates only the segments that the changes touch and writes
+// them as the next version of the index.
+func applyChanges(bucket *storage.BucketHandle, manifest *Manifest, changes []Change) error {
+	segments, err := changeSegments(changes, func(key string) ([]IndexEntry, error) {
+		return readSegment(bucket, manifest, key)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeIndex(bucket, manifest, segments); err != nil {
+		return err
+	}
+	indexChanges.Set(float64(len(changes)))
+	logEntry(levelInfo, "applied changes to the index", logFields{"version": manifest.Version, "changes": len(changes), "segments": len(segments)})
+	return nil
+}
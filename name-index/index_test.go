@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuildSegments(t *testing.T) {
+	users := []User{
+		{Username: "bob", UserID: 1},
+		{Username: "Alice", UserID: 2},
+		{Username: "", UserID: 3},
+		{Username: "al", UserID: 4},
+		{Username: "ALBERT", UserID: 5},
+		{Username: "Ö", UserID: 6},
+		{Username: "Ölaf", UserID: 7},
+	}
+	want := map[string][]IndexEntry{
+		"al": {{"al", 4}, {"ALBERT", 5}, {"Alice", 2}},
+		"bo": {{"bob", 1}},
+		"ö":  {{"Ö", 6}},
+		"öl": {{"Ölaf", 7}},
+	}
+	if got := buildSegments(users); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildSegments() = %v, want %v", got, want)
+	}
+}
+
+func TestChangeSegments(t *testing.T) {
+	stored := map[string][]IndexEntry{
+		"al": {{"al", 4}, {"Alice", 2}},
+		"bo": {{"bob", 1}},
+	}
+	// read copies the stored segment, as reading it from the bucket would
+	read := func(key string) ([]IndexEntry, error) {
+		return append([]IndexEntry{}, stored[key]...), nil
+	}
+	tests := []struct {
+		name    string
+		changes []Change
+		want    map[string][]IndexEntry
+	}{
+		{"a new user", []Change{{UserID: 8, Username: "Alfred", Op: changeUpsert}},
+			map[string][]IndexEntry{"al": {{"al", 4}, {"Alfred", 8}, {"Alice", 2}}}},
+		{"an upsert of a user already in the index replaces them", []Change{{UserID: 2, Username: "ALICE", Op: changeUpsert}},
+			map[string][]IndexEntry{"al": {{"al", 4}, {"ALICE", 2}}}},
+		{"a renamed user moves segment", []Change{{UserID: 1, Username: "alex", PreviousUsername: "bob", Op: changeUpsert}},
+			map[string][]IndexEntry{"al": {{"al", 4}, {"alex", 1}, {"Alice", 2}}, "bo": {}}},
+		{"a removed user", []Change{{UserID: 1, Username: "bob", Op: changeRemove}},
+			map[string][]IndexEntry{"bo": {}}},
+		{"changes are applied in order", []Change{
+			{UserID: 9, Username: "boris", Op: changeUpsert},
+			{UserID: 9, Username: "boris", Op: changeRemove},
+			{UserID: 1, Username: "bobby", PreviousUsername: "bob", Op: changeUpsert},
+		}, map[string][]IndexEntry{"bo": {{"bobby", 1}}}},
+		{"a segment that does not exist yet", []Change{{UserID: 10, Username: "zed", Op: changeUpsert}},
+			map[string][]IndexEntry{"ze": {{"zed", 10}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := changeSegments(test.changes, read)
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("changeSegments() = %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+	failed := errors.New("the bucket cannot be reached")
+	_, err := changeSegments([]Change{{UserID: 1, Username: "bob", Op: changeRemove}}, func(string) ([]IndexEntry, error) { return nil, failed })
+	if err != failed {
+		t.Errorf("changeSegments() = %v, want %v", err, failed)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// LeaderboardEntry is a single user on a leaderboard. It is also what is
+	// projected out of every user in the database, so that the rest of the
+	// user's fields, like their Days, are never read.
+	LeaderboardEntry struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore                   float64
+	}
+
+	// Board is the users that rank highest, or lowest if Order is asc, on
+	// Metric out of every user with at least MinTweets tweets.
+	Board struct {
+		Metric, Order string
+		MinTweets     int
+		Users         []LeaderboardEntry
+	}
+
+	// Leaderboards is every board, it is stored as a single object alongside
+	// the name index.
+	Leaderboards struct {
+		Generated time.Time
+		Boards    []Board
+	}
+)
+
+const (
+	leaderboardsObject = "name-index/leaderboards.json"
+
+	positiveTweetsField = "PositiveTweets"
+	negativeTweetsField = "NegativeTweets"
+	averageScoreField   = "AverageScore"
+
+	metricAverage  = "average"
+	metricPositive = "positive"
+	metricNegative = "negative"
+
+	orderAsc  = "asc"
+	orderDesc = "desc"
+
+	// leaderboardDepth is how many users are kept on each board. The webserver
+	// filters boards down to higher minimums, so it is well over the number of
+	// users it returns.
+	leaderboardDepth = 1000
+)
+
+// minTweetTiers are the minimum sample sizes that boards are built for.
+var minTweetTiers = []int{1, 10, 50, 100, 500, 1000, 5000, 10000}
+
+// leaderboardMetrics maps every metric to the value that it ranks users by.
+var leaderboardMetrics = map[string]func(*LeaderboardEntry) float64{
+	metricAverage:  func(e *LeaderboardEntry) float64 { return e.AverageScore },
+	metricPositive: func(e *LeaderboardEntry) float64 { return float64(e.PositiveTweets) },
+	metricNegative: func(e *LeaderboardEntry) float64 { return float64(e.NegativeTweets) },
+}
+
+// tweets is how many tweets of the user have been analysed.
+func (e *LeaderboardEntry) tweets() int {
+	return e.PositiveTweets + e.NegativeTweets
+}
+
+// scores gets the scores of every user in the database, a page at a time. Only
+// the fields of a LeaderboardEntry are projected, which needs the composite
+// index in webserver/index.yaml.
+func scores(ds *datastore.Client) ([]LeaderboardEntry, error) {
+	entries := make([]LeaderboardEntry, 0)
+	query := datastore.NewQuery(userKind).Project(usernameField, userIDField, positiveTweetsField, negativeTweetsField, averageScoreField)
+	for {
+		read := 0
+		it := ds.Run(context.Background(), query.Limit(pageSize))
+		for {
+			entry := LeaderboardEntry{}
+			if _, err := it.Next(&entry); err == iterator.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			read++
+		}
+		if read < pageSize {
+			return entries, nil
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		query = query.Start(cursor)
+	}
+}
+
+// rank sorts the users by value, highest first if desc is true. Ties go to the
+// user with the bigger sample.
+func rank(entries []LeaderboardEntry, value func(*LeaderboardEntry) float64, desc bool) []LeaderboardEntry {
+	sorted := append([]LeaderboardEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := value(&sorted[i]), value(&sorted[j])
+		if a != b {
+			return (a > b) == desc
+		}
+		return sorted[i].tweets() > sorted[j].tweets()
+	})
+	return sorted
+}
+
+// buildBoards ranks the users on every metric, in both orders, for every tier.
+// The users are sorted once per metric and order, and each board takes the
+// first users that have enough tweets.
+func buildBoards(entries []LeaderboardEntry) []Board {
+	boards := make([]Board, 0, len(leaderboardMetrics)*2*len(minTweetTiers))
+	for metric, value := range leaderboardMetrics {
+		for _, order := range []string{orderDesc, orderAsc} {
+			sorted := rank(entries, value, order == orderDesc)
+			for _, minTweets := range minTweetTiers {
+				board := Board{Metric: metric, Order: order, MinTweets: minTweets, Users: make([]LeaderboardEntry, 0)}
+				for i := 0; i < len(sorted) && len(board.Users) < leaderboardDepth; i++ {
+					if sorted[i].tweets() >= minTweets {
+						board.Users = append(board.Users, sorted[i])
+					}
+				}
+				boards = append(boards, board)
+			}
+		}
+	}
+	return boards
+}
+
+// storeLeaderboards ranks every user in the database and stores the boards in
+// the bucket.
+func storeLeaderboards(ds *datastore.Client, bucket *storage.BucketHandle) error {
+	entries, err := scores(ds)
+	if err != nil {
+		return err
+	}
+	return writeObject(bucket, leaderboardsObject, &Leaderboards{
+		Generated: time.Now(),
+		Boards:    buildBoards(entries),
+	})
+}
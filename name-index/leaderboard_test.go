@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// names returns the usernames of the entries in order.
+func names(entries []LeaderboardEntry) []string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Username
+	}
+	return names
+}
+
+func TestRank(t *testing.T) {
+	entries := []LeaderboardEntry{
+		{Username: "small", PositiveTweets: 1, NegativeTweets: 1, AverageScore: 0.5},
+		{Username: "low", PositiveTweets: 2, NegativeTweets: 8, AverageScore: -0.6},
+		{Username: "big", PositiveTweets: 40, NegativeTweets: 10, AverageScore: 0.5},
+		{Username: "high", PositiveTweets: 9, NegativeTweets: 1, AverageScore: 0.8},
+	}
+	tests := []struct {
+		name   string
+		metric string
+		desc   bool
+		want   []string
+	}{
+		{"average, highest first, ties to the bigger sample", metricAverage, true, []string{"high", "big", "small", "low"}},
+		{"average, lowest first, ties to the bigger sample", metricAverage, false, []string{"low", "big", "small", "high"}},
+		{"positive tweets, most first", metricPositive, true, []string{"big", "high", "low", "small"}},
+		{"negative tweets, least first, ties to the bigger sample", metricNegative, false, []string{"high", "small", "low", "big"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := names(rank(entries, leaderboardMetrics[test.metric], test.desc))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("rank() = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if entries[0].Username != "small" {
+		t.Errorf("rank() reordered the entries it was given")
+	}
+}
+
+func TestBuildBoards(t *testing.T) {
+	entries := []LeaderboardEntry{
+		{Username: "five", PositiveTweets: 5, AverageScore: 1},
+		{Username: "twenty", PositiveTweets: 10, NegativeTweets: 10, AverageScore: 0},
+		{Username: "sixty", PositiveTweets: 20, NegativeTweets: 40, AverageScore: -0.3},
+	}
+	boards := buildBoards(entries)
+	if want := len(leaderboardMetrics) * 2 * len(minTweetTiers); len(boards) != want {
+		t.Fatalf("buildBoards() built %d boards, want %d", len(boards), want)
+	}
+	tests := []struct {
+		metric, order string
+		minTweets     int
+		want          []string
+	}{
+		{metricAverage, orderDesc, 1, []string{"five", "twenty", "sixty"}},
+		{metricAverage, orderDesc, 10, []string{"twenty", "sixty"}},
+		{metricAverage, orderAsc, 50, []string{"sixty"}},
+		{metricNegative, orderDesc, 1, []string{"sixty", "twenty", "five"}},
+		{metricPositive, orderAsc, 100, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.metric+" "+test.order, func(t *testing.T) {
+			for _, board := range boards {
+				if board.Metric == test.metric && board.Order == test.order && board.MinTweets == test.minTweets {
+					if got := names(board.Users); !reflect.DeepEqual(got, test.want) {
+						t.Errorf("the board with at least %d tweets = %v, want %v", test.minTweets, got, test.want)
+					}
+					return
+				}
+			}
+			t.Errorf("there is no board with at least %d tweets", test.minTweets)
+		})
+	}
+}
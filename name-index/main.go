@@ -2,31 +2,36 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
 var envVarNames = []string{
 	"GOOGLE_APPLICATION_CREDENTIALS",
 	"BUCKET",
 	"PROJECT_ID",
+	"PUSHGATEWAY_URL",
 }
 
 const (
 	evGoogleApplicationCredentials = iota
 	evBucket
 	evProjectID
+	evPushgatewayURL
 )
 
 type (
-	// Changes is the flag in the database indicating whether new data has been
-	// added since the last time Changes was checked and toggled.
-	Changes struct{ ChangesMade bool }
+	// IndexState is the entity in the database that records how far through
+	// the changes the index is. Every change made at or before Watermark has
+	// been applied to the index. The webserver clears it to have the index
+	// rebuilt.
+	IndexState struct{ Watermark time.Time }
 
 	// User is a username and user id of a user that has been analysed.
 	User struct {
@@ -36,22 +41,22 @@ type (
 )
 
 func (u User) String() string {
-	return fmt.Sprintf("%-d: %s", u.UserID, u.Username)
+	return fmt.Sprintf("%d: %s", u.UserID, u.Username)
 }
 
 const (
-	changesKind   = "Changes"
-	userKind      = "User"
-	usernameField = "Username"
-	userIDField   = "UserID"
-	objectKey     = "name-index.json"
-
-	changesKeyID = 1
-	limit        = 100000
+	indexStateKind = "IndexState"
+	userKind       = "User"
+	usernameField  = "Username"
+	userIDField    = "UserID"
+
+	indexStateKeyID = 1
+	// pageSize is how many users are read from the database at a time.
+	pageSize = 10000
 )
 
-// changesKey is the key to an entity that indicates whether any updates to the database have happened
-var changesKey = datastore.IDKey(changesKind, changesKeyID, nil)
+// indexStateKey is the key to the entity that holds the watermark of the index
+var indexStateKey = datastore.IDKey(indexStateKind, indexStateKeyID, nil)
 
 // InitDatastore intializes the database client
 func InitDatastore() *datastore.Client {
@@ -83,7 +88,7 @@ func InitStorage() *storage.BucketHandle {
 
 // VerifyEnvironment verifies that all expected environment variables exist
 func VerifyEnvironment() {
-	for _, envVarNames := range envVariables {
+	for _, envVar := range envVarNames {
 		if _, ok := os.LookupEnv(envVar); !ok {
 			log.Fatalf("Missing environment variable: %s\n", envVar)
 		}
@@ -96,72 +101,48 @@ func InitLibs() (*datastore.Client, *storage.BucketHandle) {
 	return InitDatastore(), InitStorage()
 }
 
-// shouldUpdate returns true if changes have occurred in the database since
-// the last time it was checked.
-func shouldUpdate(ds *datastore.Client) bool {
-	tx, err := ds.NewTransaction(context.Background())
-	if err != nil {
-		log.Println(err)
-		return false
-	}
-	dst := &Changes{}
-	if err := tx.Get(changesKey, dst); err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return false
-	}
-	if dst.ChangesMade {
-		dst.ChangesMade = false
-		if _, err := tx.Put(changesKey, dst); err != nil {
-			log.Println(err)
-		}
-		if _, err := tx.Commit(); err != nil {
-			log.Println(err)
-		}
-		return true
-	}
-	return false
-}
-
-// users gets the first 100,000 (username, id) pairs from the database.
+// users gets all of the (username, id) pairs from the database, a page at a
+// time so that there is no limit on how many there can be.
 func users(ds *datastore.Client) ([]User, error) {
 	dst := make([]User, 0)
-	_, err := ds.GetAll(context.Background(), datastore.NewQuery(userKind).Limit(limit).Project(usernameField, userIDField).Order(usernameField), &dst)
-	return dst, err
-}
-
-// store, stores the provided users in a json array in the given bucket.
-func store(bucket *storage.BucketHandle, users []User) error {
-	w := bucket.Object(objectKey).NewWriter(context.Background())
-	return json.NewEncoder(w).Encode(users)
-}
-
-// printUsers is a debug helper method that prints out an array of users.
-func printUsers(users []User) {
-	for _, user := range users {
-		log.Println(user)
+	query := datastore.NewQuery(userKind).Project(usernameField, userIDField).Order(usernameField)
+	for {
+		page := make([]User, 0, pageSize)
+		it := ds.Run(context.Background(), query.Limit(pageSize))
+		for {
+			user := User{}
+			if _, err := it.Next(&user); err == iterator.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			page = append(page, user)
+		}
+		dst = append(dst, page...)
+		if len(page) < pageSize {
+			return dst, nil
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		query = query.Start(cursor)
 	}
 }
 
-// main starts up the webserver.
+// main brings the name index up to date.
 func main() {
+	InitLogging()
 	// Get clients
 	ds, bucket := InitLibs()
-	_, err := ds.Put(context.Background(), changesKey, &Changes{ChangesMade: true})
+	start := time.Now()
+	err := updateIndex(ds, bucket)
 	if err != nil {
-		log.Println(err)
-		return
-	}
-	if shouldUpdate(ds) {
-		users, err := users(ds)
-		if err != nil {
-			log.Println(err)
-		}
-		printUsers(users)
-		if err := store(bucket, users); err != nil {
-			log.Println(err)
-		}
+		logEntry(levelError, err.Error(), logFields{"duration_ms": float64(time.Since(start).Microseconds()) / 1000})
 	} else {
-		log.Println("No changes detected...")
+		logEntry(levelInfo, "index is up to date", logFields{"duration_ms": float64(time.Since(start).Microseconds()) / 1000})
+	}
+	if err := pushMetrics(start, err); err != nil {
+		logEntry(levelError, "could not push metrics: "+err.Error(), nil)
 	}
 }
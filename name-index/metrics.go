@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsJob is the job the metrics are pushed to the Pushgateway under.
+const metricsJob = "name_index"
+
+// The indexer exits once the index is up to date, so instead of being scraped
+// its metrics are pushed to the Pushgateway at the end of every run.
+var (
+	metrics = prometheus.NewRegistry()
+
+	indexUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_users",
+		Help: "How many users are in the name index.",
+	})
+	indexSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_segments",
+		Help: "How many segments the name index is split into.",
+	})
+	indexVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_version",
+		Help: "The version of the name index that was last written.",
+	})
+	indexChanges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_changes_applied",
+		Help: "How many changes the last run applied to the name index.",
+	})
+	indexCompacted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_compacted",
+		Help: "1 if the last run rebuilt the whole name index, 0 if it only applied changes.",
+	})
+	indexBuildDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_build_duration_seconds",
+		Help: "How long the last run took to bring the name index up to date.",
+	})
+	indexLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_last_success_timestamp_seconds",
+		Help: "When the name index was last brought up to date, in seconds since the epoch.",
+	})
+	indexFailed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "name_index_last_run_failed",
+		Help: "1 if the last run failed to bring the name index up to date.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(indexUsers, indexSegments, indexVersion, indexChanges, indexCompacted,
+		indexBuildDuration, indexLastSuccess, indexFailed)
+}
+
+// recordIndex sets the size of the index from its manifest.
+func recordIndex(manifest *Manifest) {
+	indexUsers.Set(float64(manifest.Users))
+	indexSegments.Set(float64(len(manifest.Segments)))
+	indexVersion.Set(float64(manifest.Version))
+}
+
+// pushMetrics records how long a run that started at start took and whether
+// it failed, then pushes the metrics to the Pushgateway at PUSHGATEWAY_URL.
+// Nothing is pushed if it is empty. A failed run only pushes its duration and
+// that it failed, so the size of the index and the last success are kept.
+func pushMetrics(start time.Time, err error) error {
+	url := os.Getenv(envVarNames[evPushgatewayURL])
+	if url == "" {
+		return nil
+	}
+	indexBuildDuration.Set(time.Since(start).Seconds())
+	pusher := push.New(url, metricsJob)
+	if err != nil {
+		indexFailed.Set(1)
+		return pusher.Collector(indexBuildDuration).Collector(indexFailed).Add()
+	}
+	indexLastSuccess.SetToCurrentTime()
+	return pusher.Gatherer(metrics).Push()
+}
@@ -2,5 +2,6 @@
 $env:GOOGLE_APPLICATION_CREDENTIALS = "..\twitteranalytics-310723-f09ac30d22c2.json"
 $env:BUCKET = "twittertimelines"
 $env:PROJECT_ID = "twitteranalytics-310723"
+$env:PUSHGATEWAY_URL = ""
 go build -o ../build/nameindex.exe ..
 ../build/nameindex.exe
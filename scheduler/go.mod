@@ -0,0 +1,8 @@
+module scheduler
+
+go 1.16
+
+require (
+	cloud.google.com/go/datastore v1.5.0
+	cloud.google.com/go/pubsub v1.10.2
+)
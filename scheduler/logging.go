@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// logFields are the fields of a log entry besides its time, level, service
+	// and message.
+	logFields map[string]interface{}
+
+	// jsonLogWriter turns every line the standard logger writes into a JSON log
+	// entry, so that everything that is logged comes out structured. Entries
+	// are written with logEntry, so the standard logger is only left with
+	// fatal errors and the errors of libraries, which are logged as errors.
+	jsonLogWriter struct{}
+)
+
+const (
+	serviceName = "scheduler"
+
+	levelInfo  = "info"
+	levelError = "error"
+)
+
+// logMu stops log entries that are written at the same time from interleaving.
+var logMu sync.Mutex
+
+// InitLogging makes the standard logger write JSON log entries.
+func InitLogging() {
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+}
+
+// logEntry writes a JSON log entry with the level, message and fields to
+// stderr.
+func logEntry(level, message string, fields logFields) {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for name, value := range fields {
+		entry[name] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["service"] = serviceName
+	entry["message"] = message
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": levelError, "service": serviceName, "message": message, "error": err.Error()})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	logEntry(levelError, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// newRequestID returns a random id for a refresh, it plays the part of the id
+// of the request that submitted the user in the logs of the pipeline.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logEntry(levelError, "could not make a request id: "+err.Error(), nil)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+var envVarNames = []string{
+	"GOOGLE_APPLICATION_CREDENTIALS",
+	"PROJECT_ID",
+	"PUB_SUB_PUBLISH_ID",
+}
+
+const (
+	evGoogleApplicationCredentials = iota
+	evProjectID
+	evPubSubPublishID
+)
+
+// InitDatastore intializes the database client
+func InitDatastore() *datastore.Client {
+	store, err := datastore.NewClient(context.Background(), os.Getenv(envVarNames[evProjectID]))
+	if err != nil {
+		log.Fatalf("Could not get datastore client: %v\n", err)
+	}
+	return store
+}
+
+// InitPubSub initializes the pub sub client
+func InitPubSub() *pubsub.Client {
+	client, err := pubsub.NewClient(context.Background(), os.Getenv(envVarNames[evProjectID]))
+	if err != nil {
+		log.Fatalf("Could not set up pub sub client: %v\n", err)
+	}
+	return client
+}
+
+// ConfigurePubSub gets the fetch topic and makes sure that it exists.
+func ConfigurePubSub(psClient *pubsub.Client) *pubsub.Topic {
+	topicID := os.Getenv(envVarNames[evPubSubPublishID])
+	topic := psClient.Topic(topicID)
+	if ok, err := topic.Exists(context.Background()); !ok || err != nil {
+		log.Fatalf("Topic: %s does not exist. Error: %v\n", topicID, err)
+	}
+	return topic
+}
+
+// VerifyEnvironment verifies that all expected environment variables exist
+func VerifyEnvironment() {
+	for _, envVar := range envVarNames {
+		if _, ok := os.LookupEnv(envVar); !ok {
+			log.Fatalf("scheduler Missing environment variable: %s\n", envVar)
+		}
+	}
+}
+
+// InitLibs prepares external libraries with credentials to make API calls.
+func InitLibs() (*datastore.Client, *pubsub.Client) {
+	VerifyEnvironment()
+	return InitDatastore(), InitPubSub()
+}
+
+// main refreshes every tracked user that is due, then exits.
+func main() {
+	InitLogging()
+	// Get clients
+	ds, psClient := InitLibs()
+	topic := ConfigurePubSub(psClient)
+	defer topic.Stop()
+	tracked, err := dueUsers(ds)
+	if err != nil {
+		log.Fatalf("Could not get tracked users: %v\n", err)
+	}
+	logEntry(levelInfo, "tracked users are due to be refreshed", logFields{"due": len(tracked)})
+	for _, t := range tracked {
+		if err := refresh(ds, topic, t); err != nil {
+			logEntry(levelError, "could not refresh: "+err.Error(), logFields{"user_id": t.UserID, "username": t.Username})
+		}
+	}
+}
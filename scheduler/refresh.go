@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+type (
+	// Tracked is the entity in the datastore marking a user whose analysis is
+	// kept up to date. The user is refreshed every RefreshMinutes minutes.
+	// Owner is the account or key that tracked the user through the webserver.
+	Tracked struct {
+		Username       string
+		UserID         int64
+		RefreshMinutes int64
+		LastRefreshed  time.Time
+		Owner          string
+	}
+
+	// DocumentMetaData is all of the data aside form tweets describing an entity
+	// in the datastore.
+	DocumentMetaData struct {
+		Username                             string
+		UserID, LastTweetID, EarliestTweetID int64
+	}
+
+	// Job is the entity in the datastore that records a fetch request for a
+	// user while it moves through the pipeline.
+	Job struct {
+		Username           string
+		UserID             int64
+		Status             string
+		Requested, Updated time.Time
+	}
+
+	// FetchMessage contains the data necessary to run a fetch using the Twitter
+	// API to get tweets. Only tweets newer than SinceID are fetched. RequestID
+	// ties the logs of the fetch together.
+	FetchMessage struct {
+		Username        string
+		UserID, SinceID int64
+		RequestID       string
+	}
+)
+
+func (t Tracked) String() string {
+	return fmt.Sprintf("%d: %s", t.UserID, t.Username)
+}
+
+// Due returns true if the user has not been refreshed within their interval.
+func (t *Tracked) Due(now time.Time) bool {
+	return now.Sub(t.LastRefreshed) >= time.Duration(t.RefreshMinutes)*time.Minute
+}
+
+const (
+	trackedKind = "Tracked"
+	userKind    = "User"
+	jobKind     = "Job"
+
+	jobStatusQueued = "queued"
+	jobStatusDone   = "done"
+	jobStatusFailed = "failed"
+
+	// jobTimeout is how long a job can go without finishing before it is
+	// considered lost and can be submitted again.
+	jobTimeout = 30 * time.Minute
+)
+
+// dueUsers gets all of the tracked users that are due to be refreshed.
+func dueUsers(ds *datastore.Client) ([]Tracked, error) {
+	tracked := make([]Tracked, 0)
+	if _, err := ds.GetAll(context.Background(), datastore.NewQuery(trackedKind), &tracked); err != nil {
+		return nil, err
+	}
+	now, due := time.Now(), make([]Tracked, 0, len(tracked))
+	for _, t := range tracked {
+		if t.Due(now) {
+			due = append(due, t)
+		}
+	}
+	return due, nil
+}
+
+// refresh submits an incremental fetch for the tracked user, starting after
+// the last tweet that was analysed for them. Users that already have a job in
+// flight are skipped, the job in flight will bring them up to date.
+func refresh(ds *datastore.Client, topic *pubsub.Topic, t Tracked) error {
+	doc := &DocumentMetaData{}
+	if err := ds.Get(context.Background(), datastore.IDKey(userKind, t.UserID, nil), doc); err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	submitted := false
+	_, err := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		submitted = false
+		key := datastore.IDKey(jobKind, t.UserID, nil)
+		job := &Job{}
+		if err := tx.Get(key, job); err == nil &&
+			job.Status != jobStatusDone && job.Status != jobStatusFailed &&
+			time.Since(job.Requested) < jobTimeout {
+			return nil
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		t.LastRefreshed = now
+		if _, err := tx.Put(datastore.IDKey(trackedKind, t.UserID, nil), &t); err != nil {
+			return err
+		}
+		submitted = true
+		_, err := tx.Put(key, &Job{
+			Username:  t.Username,
+			UserID:    t.UserID,
+			Status:    jobStatusQueued,
+			Requested: now,
+			Updated:   now,
+		})
+		return err
+	})
+	if err != nil || !submitted {
+		return err
+	}
+	requestID := newRequestID()
+	message, err := json.Marshal(&FetchMessage{
+		Username:  t.Username,
+		UserID:    t.UserID,
+		SinceID:   doc.LastTweetID,
+		RequestID: requestID,
+	})
+	if err != nil {
+		return err
+	}
+	res := topic.Publish(context.Background(), &pubsub.Message{
+		Data: message,
+	})
+	if _, err := res.Get(context.Background()); err != nil {
+		// the job will never be picked up, so let the next run retry it
+		_, putErr := ds.Put(context.Background(), datastore.IDKey(jobKind, t.UserID, nil), &Job{
+			Username:  t.Username,
+			UserID:    t.UserID,
+			Status:    jobStatusFailed,
+			Requested: t.LastRefreshed,
+			Updated:   time.Now(),
+		})
+		if putErr != nil {
+			logEntry(levelError, "could not fail the job: "+putErr.Error(), logFields{"request_id": requestID, "user_id": t.UserID, "username": t.Username})
+		}
+		return err
+	}
+	logEntry(levelInfo, "refresh submitted", logFields{"request_id": requestID, "user_id": t.UserID, "username": t.Username, "since_id": doc.LastTweetID})
+	return nil
+}
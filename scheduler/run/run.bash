@@ -0,0 +1,4 @@
+# Builds the go application and runs it
+go build -o ../build/scheduler .
+echo "Running..."
+../build/scheduler
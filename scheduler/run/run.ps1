@@ -0,0 +1,6 @@
+# Builds the go application and runs it
+$env:GOOGLE_APPLICATION_CREDENTIALS = "..\twitteranalytics-310723-f09ac30d22c2.json"
+$env:PROJECT_ID = "twitteranalytics-310723"
+$env:PUB_SUB_PUBLISH_ID = "twitter-fetch"
+go build -o ../build/scheduler.exe ..
+../build/scheduler.exe
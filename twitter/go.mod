@@ -3,9 +3,11 @@ module twitter
 go 1.16
 
 require (
+	cloud.google.com/go/datastore v1.5.0
 	cloud.google.com/go/pubsub v1.10.2
 	cloud.google.com/go/storage v1.14.0
 	github.com/dghubble/go-twitter v0.0.0-20201011215211-4b180d0cc78d
 	github.com/dghubble/oauth1 v0.7.0
+	github.com/prometheus/client_golang v1.11.0
 	google.golang.org/genproto v0.0.0-20210421164718-3947dc264843 // indirect
 )
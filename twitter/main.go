@@ -9,8 +9,10 @@ import (
 
 	"cloud.google.com/go/pubsub"
 
+	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
 	"github.com/dghubble/go-twitter/twitter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var envVarNames = []string{
@@ -76,6 +78,15 @@ func InitStorage() *storage.BucketHandle {
 	return bucket
 }
 
+// InitDatastore intializes the database client
+func InitDatastore() *datastore.Client {
+	store, err := datastore.NewClient(context.Background(), os.Getenv(envVarNames[evProjectID]))
+	if err != nil {
+		log.Fatalf("Could not get datastore client: %v\n", err)
+	}
+	return store
+}
+
 // TODO: Make a pubsub for the tweets to be processed
 func InitPubSub() *pubsub.Client {
 	ctx := context.Background()
@@ -96,9 +107,9 @@ func VerifyEnvironment() {
 }
 
 // InitLibs prepares external libraries with credentials to make API calls.
-func InitLibs() (*twitter.Client, *pubsub.Client, *storage.BucketHandle) {
+func InitLibs() (*twitter.Client, *pubsub.Client, *storage.BucketHandle, *datastore.Client) {
 	VerifyEnvironment()
-	return InitTwitter(), InitPubSub(), InitStorage()
+	return InitTwitter(), InitPubSub(), InitStorage(), InitDatastore()
 }
 
 // ConfigurePubSub gets a subscription and topic and makes sure that both exist.
@@ -121,16 +132,22 @@ func Health(w http.ResponseWriter, r *http.Request) {
 
 // main starts up the webserver.
 func main() {
+	InitLogging()
 	// Get clients
-	tClient, psClient, bucket := InitLibs()
+	tClient, psClient, bucket, ds := InitLibs()
 	sub, topic := ConfigurePubSub(psClient)
 	quit := make(chan bool)
-	// Handle calls to the analysis endpoint
-	err := Subscribe(sub, MessageHandlerHO(tClient, topic, bucket), quit)
-	if err != nil {
-		log.Fatalf("Encountered an error when trying to susbcribe: %v\n", err)
-	}
+	// Handle fetch messages, Subscribe blocks while it receives them so the
+	// endpoints below are served alongside it
+	go func() {
+		err := Subscribe(sub, MessageHandlerHO(tClient, topic, bucket, ds), quit)
+		if err != nil {
+			log.Fatalf("Encountered an error when trying to susbcribe: %v\n", err)
+		}
+	}()
 	// Handle calls to the health endpoint
 	http.HandleFunc("/api/health", Health)
+	// Handle scrapes of the fetcher's metrics
+	http.Handle("/metrics", promhttp.Handler())
 	log.Fatal(http.ListenAndServe(os.Getenv(envVarNames[evAddress]), nil))
 }
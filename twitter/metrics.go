@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	fetchResultDone    = "done"
+	fetchResultNoTweet = "no_new_tweets"
+	fetchResultFailed  = "failed"
+)
+
+// The metrics of the fetcher, they are served at /metrics.
+var (
+	fetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitter_fetches_total",
+		Help: "How many fetch messages were handled, by whether they were done, had no new tweets or failed.",
+	}, []string{"result"})
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "twitter_fetch_duration_seconds",
+		Help:    "How long it took to fetch and store a user's tweets.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+	tweetsFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "twitter_tweets_fetched_total",
+		Help: "How many tweets were fetched from the Twitter API.",
+	})
+	twitterAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitter_api_errors_total",
+		Help: "How many requests to the Twitter API failed, by the HTTP status of the response or network if there was not one.",
+	}, []string{"status"})
+)
+
+func init() {
+	prometheus.MustRegister(fetches, fetchDuration, tweetsFetched, twitterAPIErrors)
+}
+
+// apiErrorStatus returns the label a Twitter API error with the response is
+// counted under.
+func apiErrorStatus(res *http.Response) string {
+	if res == nil {
+		return "network"
+	}
+	return strconv.Itoa(res.StatusCode)
+}
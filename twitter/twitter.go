@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math"
+	"net/http"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 
+	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
@@ -26,26 +28,66 @@ type (
 
 	// CleanDocument contains a list of tweets betweeen EarliestTweetID
 	// LastTweetID for user with UserID that is derived from Username.
+	// TweetTimes holds the unix time each tweet was created at, in the same
+	// order as Tweets. Full is true if the whole timeline was fetched, then the
+	// analyser replaces the user's analysis instead of adding to it.
 	CleanDocument struct {
 		Username                             string
 		UserID, LastTweetID, EarliestTweetID int64
 		Tweets                               []string
+		TweetTimes                           []int64
+		Full                                 bool
 	}
 
 	// FetchMessage contains the data necessary to run a fetch using the Twitter
-	// API to get tweets.
+	// API to get tweets. If SinceID is set then only tweets newer than it are
+	// fetched, this is used to refresh users that have already been analysed.
+	// RequestID is the id of the request that submitted the user, it is passed
+	// on to the analyser so that the logs of the fetch can be tied together.
 	FetchMessage struct {
-		Username string
-		UserID   int64
+		Username        string
+		UserID, SinceID int64
+		RequestID       string
+	}
+
+	// Job is the entity in the datastore that records a fetch request for a
+	// user while it moves through the pipeline. The fetcher reports its
+	// progress on the job so that the webserver can stream it to the browser.
+	Job struct {
+		Username           string
+		UserID             int64
+		Status             string
+		Requested, Updated time.Time
 	}
 
 	// MessageHandler handles messages incoming from a PubSub topic.
-	MessageHandler func(string, int64) error
+	MessageHandler func(FetchMessage) error
+
+	// permanentError is a failure that fetching the user again would not fix,
+	// such as the user having no tweets or Twitter refusing to show them. The
+	// message is acknowledged and the job failed rather than retrying it.
+	permanentError struct{ error }
 )
 
 // MaxResults is the maximum number of results that are retrieved in each request
 const MaxResults = 200
 
+// errNoNewTweets is returned when refreshing a user that has not tweeted since
+// they were last fetched.
+var errNoNewTweets = errors.New("no new tweets were found since the last fetch")
+
+const (
+	jobKind = "Job"
+	// requestIDAttribute is the attribute of the message to the analyser that
+	// carries the FetchMessage's RequestID.
+	requestIDAttribute = "request_id"
+
+	jobStatusFetching  = "fetching"
+	jobStatusAnalysing = "analysing"
+	jobStatusDone      = "done"
+	jobStatusFailed    = "failed"
+)
+
 // PTrue returns a pointer to a bool with value of true
 func PTrue() *bool {
 	ret := true
@@ -103,8 +145,9 @@ func createUserTimelineParamsBefore(userID int64, maxID int64) *twitter.UserTime
 }
 
 // getTweets performs calls the Twitter API to get tweets fitting parameters
-// specified in data. The tweets are passed into the tweets channels.
-func getTweets(client *twitter.Client, username string, userID int64) (*CleanDocument, error) {
+// specified in data. The tweets are passed into the tweets channels. Only
+// tweets newer than sinceID are fetched, unless it is 0.
+func getTweets(client *twitter.Client, username string, userID, sinceID int64) (*CleanDocument, error) {
 	var resp []twitter.Tweet
 	var err error
 	count, doc := 0, &CleanDocument{
@@ -113,14 +156,25 @@ func getTweets(client *twitter.Client, username string, userID int64) (*CleanDoc
 		LastTweetID:     0,
 		EarliestTweetID: math.MaxInt64,
 		Tweets:          make([]string, 0),
+		TweetTimes:      make([]int64, 0),
+		Full:            sinceID == 0,
 	}
 	maxID := int64(0)
 	for ok := true; ok; ok = len(resp) > 0 {
-		resp, _, err = client.Timelines.UserTimeline(createUserTimelineParamsBefore(userID, maxID))
+		params := createUserTimelineParamsBefore(userID, maxID)
+		params.SinceID = sinceID
+		var httpResp *http.Response
+		resp, httpResp, err = client.Timelines.UserTimeline(params)
 		count += len(resp)
+		tweetsFetched.Add(float64(len(resp)))
 		// Create better error reporting mechanism
 		if err != nil {
-			log.Printf("Encountered error when getting tweets for (%s): %v", username, err)
+			twitterAPIErrors.WithLabelValues(apiErrorStatus(httpResp)).Inc()
+			logEntry(levelError, err.Error(), logFields{"user_id": userID, "username": username})
+			// the user does not exist, is protected or suspended
+			if httpResp != nil && httpResp.StatusCode >= 400 && httpResp.StatusCode < 500 && httpResp.StatusCode != http.StatusTooManyRequests {
+				err = permanentError{err}
+			}
 			return doc, err
 		}
 
@@ -131,12 +185,20 @@ func getTweets(client *twitter.Client, username string, userID int64) (*CleanDoc
 			if tweet.ID < doc.EarliestTweetID {
 				doc.EarliestTweetID = tweet.ID
 			}
+			created, err := tweet.CreatedAtTime()
+			if err != nil {
+				logEntry(levelError, "could not parse the creation time of the tweet: "+err.Error(), logFields{"user_id": userID, "tweet_id": tweet.ID})
+			}
 			doc.Tweets = append(doc.Tweets, tweet.Text)
+			doc.TweetTimes = append(doc.TweetTimes, created.Unix())
 		}
 		maxID = doc.EarliestTweetID - 1
 	}
 	if doc.LastTweetID == 0 && doc.EarliestTweetID == math.MaxInt64 {
-		return doc, errors.New("no tweets were found, so no analysis can be done")
+		if sinceID > 0 {
+			return doc, errNoNewTweets
+		}
+		return doc, permanentError{errors.New("no tweets were found, so no analysis can be done")}
 	}
 	return doc, nil
 }
@@ -156,6 +218,40 @@ func storeTweets(bucket *storage.BucketHandle, doc *CleanDocument) (string, erro
 	return fileName, nil
 }
 
+// isPermanent reports whether err is a permanentError.
+func isPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// finished reports whether a job with the status has left the pipeline.
+func finished(status string) bool {
+	return status == jobStatusDone || status == jobStatusFailed
+}
+
+// updateJob sets the status of the job for the user with userID. A finished
+// job is never moved back to fetching or analysing, so a redelivered message
+// or a late update cannot hide that the analyser is done. Failing to update a
+// job is only logged, it should never stop a fetch from happening.
+func updateJob(ds *datastore.Client, userID int64, status string) {
+	key := datastore.IDKey(jobKind, userID, nil)
+	_, err := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		job := &Job{}
+		if err := tx.Get(key, job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if finished(job.Status) && !finished(status) {
+			return nil
+		}
+		job.UserID, job.Status, job.Updated = userID, status, time.Now()
+		_, err := tx.Put(key, job)
+		return err
+	})
+	if err != nil {
+		logEntry(levelError, "could not update the job: "+err.Error(), logFields{"user_id": userID, "status": status})
+	}
+}
+
 // Subscribe pulls requests from a subscription and handles them whenever they
 // are recieved.
 func Subscribe(sub *pubsub.Subscription, messageHandler MessageHandler, quit chan bool) error {
@@ -165,27 +261,36 @@ func Subscribe(sub *pubsub.Subscription, messageHandler MessageHandler, quit cha
 	// method for reporting.
 	if err := sub.Receive(ctx, func(c context.Context, m *pubsub.Message) {
 		fm := FetchMessage{}
-		//TODO: I think this will throw an error, replaced with the above code
-		log.Printf("DATA: %s\n", m.Data)
 		if err := json.Unmarshal(m.Data, &fm); err != nil {
-			log.Println(err)
+			logEntry(levelError, err.Error(), logFields{"message_id": m.ID})
 			m.Nack()
+			return
 		}
-		if err := messageHandler(fm.Username, fm.UserID); err != nil {
-			log.Println(err)
+		start := time.Now()
+		fields := logFields{"request_id": fm.RequestID, "user_id": fm.UserID, "username": fm.Username, "since_id": fm.SinceID}
+		logEntry(levelInfo, "fetch received", fields)
+		err := messageHandler(fm)
+		fetchDuration.Observe(time.Since(start).Seconds())
+		fields["latency_ms"] = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil && isPermanent(err) {
+			logEntry(levelError, err.Error(), fields)
+			m.Ack()
+		} else if err != nil {
+			logEntry(levelError, err.Error(), fields)
 			m.Nack()
 		} else {
+			logEntry(levelInfo, "fetch finished", fields)
 			m.Ack()
 		}
 	}); err != nil {
-		log.Println(err)
+		logEntry(levelError, "could not receive fetches: "+err.Error(), nil)
 		cancel()
 		return err
 	}
 	// If quit is called then stop getting messages from the subscription
 	go func() {
-		log.Println("quit")
 		<-quit
+		logEntry(levelInfo, "stopped receiving fetches", nil)
 		cancel()
 	}()
 	return nil
@@ -195,11 +300,27 @@ func Subscribe(sub *pubsub.Subscription, messageHandler MessageHandler, quit cha
 // userid, fetch messages, store the messages in the cloud, then publish
 // another pubsub message.
 //TODO: I removed the user id parameter because we get user id in webserver container. I made it pass the id instead so we never handle a username here
-func MessageHandlerHO(tClient *twitter.Client, topic *pubsub.Topic, bucket *storage.BucketHandle) MessageHandler {
-	return func(name string, id int64) error {
+func MessageHandlerHO(tClient *twitter.Client, topic *pubsub.Topic, bucket *storage.BucketHandle, ds *datastore.Client) MessageHandler {
+	return func(fm FetchMessage) (err error) {
+		id := fm.UserID
+		updateJob(ds, id, jobStatusFetching)
+		defer func() {
+			if err != nil {
+				fetches.WithLabelValues(fetchResultFailed).Inc()
+			}
+			// other failures are retried when the message is redelivered
+			if isPermanent(err) {
+				updateJob(ds, id, jobStatusFailed)
+			}
+		}()
 		// Get the list of tweets
-		tweets, err := getTweets(tClient, name, id)
-		if err != nil {
+		tweets, err := getTweets(tClient, fm.Username, id, fm.SinceID)
+		if err == errNoNewTweets {
+			// nothing to analyse, the user is already up to date
+			fetches.WithLabelValues(fetchResultNoTweet).Inc()
+			updateJob(ds, id, jobStatusDone)
+			return nil
+		} else if err != nil {
 			return err
 		}
 		message, err := storeTweets(bucket, tweets)
@@ -207,14 +328,19 @@ func MessageHandlerHO(tClient *twitter.Client, topic *pubsub.Topic, bucket *stor
 			return err
 		}
 
+		// the job is moved on before publishing, the analyser could finish it
+		// before the publish returns
+		updateJob(ds, id, jobStatusAnalysing)
 		res := topic.Publish(context.Background(), &pubsub.Message{
-			Data: []byte(message),
+			Data:       []byte(message),
+			Attributes: map[string]string{requestIDAttribute: fm.RequestID},
 		})
 
 		if _, err := res.Get(context.Background()); err != nil {
 			return err
 		}
-		fmt.Println("published to documents")
+		logEntry(levelInfo, "published to documents", logFields{"request_id": fm.RequestID, "user_id": id, "file": message, "tweets": len(tweets.Tweets)})
+		fetches.WithLabelValues(fetchResultDone).Inc()
 		return nil
 	}
 }
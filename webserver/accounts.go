@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// Account is the entity in the datastore for a person that signs in to the
+	// frontend. It is keyed by the lower case Username, and only the bcrypt
+	// hash of the password is kept. New accounts are viewers until an admin
+	// gives them another Role.
+	Account struct {
+		Username     string
+		PasswordHash []byte `json:"-" datastore:",noindex"`
+		Role         Role
+		Created      time.Time
+	}
+
+	// Session is the entity in the datastore for a signed in browser. It is
+	// keyed by the SHA-256 hash of the token in the session cookie. CSRFToken
+	// has to be sent back in the X-CSRF-Token header by every request that
+	// changes something, which a page on another site cannot do.
+	Session struct {
+		Username  string
+		CSRFToken string `datastore:",noindex"`
+		Created   time.Time
+		Expires   time.Time
+	}
+
+	// AccountRequest is the body of a request to register or sign in.
+	AccountRequest struct {
+		Username, Password string
+	}
+)
+
+const (
+	accountKind = "Account"
+	sessionKind = "Session"
+
+	sessionCookie = "session"
+	// csrfCookie holds the session's CSRF token where the frontend's scripts
+	// can read it, unlike the session cookie.
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+	// csrfParam carries the CSRF token of requests that cannot set headers.
+	csrfParam = "csrf_token"
+	// keyOwnerPrefix starts the owner of what is made with a key rather than
+	// an account, the key's prefix follows it.
+	keyOwnerPrefix = "key:"
+	// sessionTTL is how long a session lasts after signing in.
+	sessionTTL = 7 * 24 * time.Hour
+
+	minPasswordLength = 8
+	// maxPasswordLength is the most bcrypt uses, it ignores anything after it.
+	maxPasswordLength = 72
+)
+
+var (
+	// usernameRegex is what every username has to look like.
+	usernameRegex = regexp.MustCompile(`^[a-z0-9_]{3,32}$`)
+
+	// dummyPasswordHash is compared against when no account has the username,
+	// so that signing in takes as long whether or not the account exists.
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+	// errSignIn is returned for a wrong username or password alike.
+	errSignIn = &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Err: errors.New("the username or password is wrong")}
+)
+
+// accountKey returns the key of the Account entity for the username.
+func accountKey(username string) *datastore.Key {
+	return datastore.NameKey(accountKind, username, nil)
+}
+
+// sessionKey returns the key of the Session entity for the session token.
+func sessionKey(token string) *datastore.Key {
+	return datastore.NameKey(sessionKind, hashAPIKey(token), nil)
+}
+
+// Validate checks the username and password of a new account. The username is
+// made lower case.
+func (req *AccountRequest) Validate() error {
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if !usernameRegex.MatchString(req.Username) {
+		return invalid("username must be 3 to 32 letters, digits or underscores")
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		return invalid("password must be %d to %d bytes long", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+// unmarshalAccountRequest reads the JSON AccountRequest body. Only JSON is
+// accepted so that a form on another site cannot sign someone in.
+func unmarshalAccountRequest(r *http.Request) (*AccountRequest, error) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil, invalid("the body must be application/json")
+	}
+	req := &AccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// register creates the account, failing with a 409 if the username is taken.
+func register(req *AccountRequest, ds *datastore.Client) (*Account, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{Username: req.Username, PasswordHash: hash, Role: roleViewer, Created: time.Now()}
+	_, err = ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		if err := tx.Get(accountKey(account.Username), &Account{}); err == nil {
+			return &APIError{Status: http.StatusConflict, Code: codeConflict, Err: fmt.Errorf("the username %s is taken", account.Username)}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := tx.Put(accountKey(account.Username), account)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// signIn checks the username and password and returns their account.
+func signIn(req *AccountRequest, ds *datastore.Client) (*Account, error) {
+	account := &Account{}
+	err := ds.Get(context.Background(), accountKey(strings.ToLower(strings.TrimSpace(req.Username))), account)
+	if err == datastore.ErrNoSuchEntity {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		return nil, errSignIn
+	} else if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(req.Password)) != nil {
+		return nil, errSignIn
+	}
+	return account, nil
+}
+
+// secureRequest reports whether the request reached the load balancer over
+// HTTPS, cookies are only marked Secure if it did.
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setSessionCookies sets the session and CSRF cookies, they are removed if
+// maxAge is negative.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, token, csrfToken string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startSession stores a new session for the account and sets its cookies.
+func startSession(w http.ResponseWriter, r *http.Request, account *Account, ds *datastore.Client) error {
+	token, err := newAPIKey()
+	if err != nil {
+		return err
+	}
+	csrfToken, err := newAPIKey()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	session := &Session{Username: account.Username, CSRFToken: csrfToken, Created: now, Expires: now.Add(sessionTTL)}
+	if _, err := ds.Put(context.Background(), sessionKey(token), session); err != nil {
+		return err
+	}
+	setSessionCookies(w, r, token, csrfToken, int(sessionTTL/time.Second))
+	return nil
+}
+
+// sessionCaller returns the caller signed in with the session cookie, or an
+// anonymous caller if there is no session. Signing in ties what is created to
+// the account, gives the caller the account's role if it can do more than an
+// anonymous caller and counts what they submit against the account's own
+// quota. Requests that change something fail with a 403 unless they carry the
+// session's CSRF token in the X-CSRF-Token header. Other requests can also
+// carry it in the csrf_token parameter, because EventSource cannot set
+// headers, and are CrossSite if they do not.
+func (k *APIKeys) sessionCaller(r *http.Request) (*Caller, error) {
+	caller, err := k.Authenticate("")
+	if err != nil {
+		return nil, err
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return caller, nil
+	}
+	session := &Session{}
+	if err := k.ds.Get(context.Background(), sessionKey(cookie.Value), session); err == datastore.ErrNoSuchEntity {
+		return caller, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expires) {
+		k.ds.Delete(context.Background(), sessionKey(cookie.Value))
+		return caller, nil
+	}
+	sameSite := subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(session.CSRFToken)) == 1
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		sameSite = sameSite || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get(csrfParam)), []byte(session.CSRFToken)) == 1
+	default:
+		if !sameSite {
+			return nil, &APIError{Status: http.StatusForbidden, Code: codeForbidden, Err: errors.New("the " + csrfHeader + " header is missing or wrong")}
+		}
+	}
+	// the role is read every time so that taking it away works straight away
+	account := &Account{}
+	if err := k.ds.Get(context.Background(), accountKey(session.Username), account); err == datastore.ErrNoSuchEntity {
+		return caller, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return k.accountCaller(caller, account, sameSite), nil
+}
+
+// accountCaller returns the caller signed in to the account, from the anonymous
+// caller they would be otherwise. They have their own quota of the size in
+// ACCOUNT_DAILY_QUOTA rather than sharing the anonymous one.
+func (k *APIKeys) accountCaller(anonymous *Caller, account *Account, sameSite bool) *Caller {
+	return &Caller{
+		ID:         accountCallerPrefix + account.Username,
+		Name:       account.Username,
+		DailyQuota: k.accountQuota,
+		Role:       higherRole(anonymous.Role, account.Role),
+		Account:    account.Username,
+		CrossSite:  !sameSite,
+	}
+}
+
+// checkSameSite fails with a 403 if the caller in ctx is signed in but their
+// request did not carry the session's CSRF token, it is checked before
+// anything is submitted for them by a GET request.
+func checkSameSite(ctx context.Context) error {
+	if caller := callerFrom(ctx); caller != nil && caller.CrossSite {
+		return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Err: errors.New("the " + csrfHeader + " header or " + csrfParam + " parameter is missing or wrong")}
+	}
+	return nil
+}
+
+// accountFrom returns the username of the account that made the request, it
+// is empty if they have not signed in.
+func accountFrom(ctx context.Context) string {
+	if caller := callerFrom(ctx); caller != nil {
+		return caller.Account
+	}
+	return ""
+}
+
+// requireAccount returns the username of the account that made the request,
+// or a 401 if they have not signed in.
+func requireAccount(ctx context.Context) (string, error) {
+	if account := accountFrom(ctx); account != "" {
+		return account, nil
+	}
+	return "", &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Err: errors.New("you have to sign in first")}
+}
+
+// ownerFrom returns who owns what the request makes: the account that made it,
+// or the key if they have not signed in. It is empty for anonymous callers.
+func ownerFrom(ctx context.Context) string {
+	caller := callerFrom(ctx)
+	switch {
+	case caller == nil:
+		return ""
+	case caller.Account != "":
+		return caller.Account
+	case caller.Prefix != "":
+		return keyOwnerPrefix + caller.Prefix
+	}
+	return ""
+}
+
+// requireOwner returns ownerFrom the request, or a 401 if they are anonymous.
+func requireOwner(ctx context.Context) (string, error) {
+	if owner := ownerFrom(ctx); owner != "" {
+		return owner, nil
+	}
+	return "", &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Err: errors.New("sign in or use an API key first")}
+}
+
+// checkOwner fails with a 403 unless the request was made by whoever owns
+// something or by an admin. Things that nobody owns were made anonymously or
+// before there were owners, so only admins can change them.
+func checkOwner(ctx context.Context, owner string) error {
+	if (owner != "" && owner == ownerFrom(ctx)) || requireRole(ctx, roleAdmin) == nil {
+		return nil
+	}
+	if owner == "" {
+		return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Err: errors.New("this does not belong to anyone, only admins can change it")}
+	}
+	return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Err: fmt.Errorf("this belongs to %s", owner)}
+}
+
+// mineOnly reports whether the mine parameter asks for only what the caller
+// that made the request owns, it fails with a 401 if they are anonymous.
+func mineOnly(r *http.Request) (string, error) {
+	switch r.URL.Query().Get("mine") {
+	case "", "false":
+		return "", nil
+	case "true":
+		return requireOwner(r.Context())
+	}
+	return "", invalid("mine must be true or false")
+}
+
+// AccountsHO returns a handler that registers a new account from a JSON
+// AccountRequest body and signs it in.
+func AccountsHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			notAllowed(w, r, http.MethodPost)
+			return
+		}
+		req, err := unmarshalAccountRequest(r)
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		account, err := register(req, ds)
+		if err != nil {
+			writeError("Register", err, w)
+			return
+		}
+		if err := startSession(w, r, account, ds); err != nil {
+			writeError("Session", err, w)
+			return
+		}
+		writeJSON(account, w)
+	}
+}
+
+// SessionHO returns a handler for the session of the browser. GET returns the
+// account that is signed in, POST signs in with a JSON AccountRequest body and
+// DELETE signs out.
+func SessionHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			username, err := requireAccount(r.Context())
+			if err != nil {
+				writeError("Session", err, w)
+				return
+			}
+			account := &Account{}
+			if err := ds.Get(context.Background(), accountKey(username), account); err != nil {
+				writeError("Get", err, w)
+				return
+			}
+			data = account
+		case http.MethodPost:
+			req, err := unmarshalAccountRequest(r)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			account, err := signIn(req, ds)
+			if err != nil {
+				writeError("SignIn", err, w)
+				return
+			}
+			if err := startSession(w, r, account, ds); err != nil {
+				writeError("Session", err, w)
+				return
+			}
+			data = account
+		case http.MethodDelete:
+			if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+				if err := ds.Delete(context.Background(), sessionKey(cookie.Value)); err != nil {
+					writeError("SignOut", err, w)
+					return
+				}
+			}
+			setSessionCookies(w, r, "", "", -1)
+			data = struct{ Message string }{Message: "You have been signed out."}
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+			return
+		}
+		writeJSON(data, w)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckOwner(t *testing.T) {
+	account := &Caller{Role: roleAnalyst, Account: "alice"}
+	key := &Caller{ID: "hash", Prefix: "ta_12345678", Role: roleAnalyst}
+	tests := []struct {
+		name   string
+		caller *Caller
+		owner  string
+		status int
+	}{
+		{"the account that owns it", account, "alice", 0},
+		{"another account", account, "bob", http.StatusForbidden},
+		{"the key that owns it", key, "key:ta_12345678", 0},
+		{"another key", key, "key:ta_87654321", http.StatusForbidden},
+		{"a key that is not the account", key, "alice", http.StatusForbidden},
+		{"nobody owns it", account, "", http.StatusForbidden},
+		{"anonymous callers cannot change what nobody owns", &Caller{ID: anonymousCaller, Role: roleAnalyst}, "", http.StatusForbidden},
+		{"admins can change what nobody owns", &Caller{Role: roleAdmin}, "", 0},
+		{"admins can change what others own", &Caller{Role: roleAdmin, Account: "carol"}, "alice", 0},
+		{"no caller", nil, "alice", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.caller != nil {
+				ctx = withCaller(ctx, test.caller)
+			}
+			err := checkOwner(ctx, test.owner)
+			if test.status == 0 {
+				if err != nil {
+					t.Errorf("checkOwner() = %v, want nil", err)
+				}
+				return
+			}
+			if apiErr, ok := err.(*APIError); !ok || apiErr.Status != test.status {
+				t.Errorf("checkOwner() = %v, want a %d", err, test.status)
+			}
+		})
+	}
+}
+
+func TestCheckSameSite(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller *Caller
+		ok     bool
+	}{
+		{"no caller", nil, true},
+		{"a key", &Caller{ID: "hash", Prefix: "ta_12345678"}, true},
+		{"a session with the token", &Caller{Account: "alice"}, true},
+		{"a session without the token", &Caller{Account: "alice", CrossSite: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.caller != nil {
+				ctx = withCaller(ctx, test.caller)
+			}
+			if err := checkSameSite(ctx); (err == nil) != test.ok {
+				t.Errorf("checkSameSite() = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestAccountCallerQuota(t *testing.T) {
+	keys := &APIKeys{anonymousQuota: 100, anonymousRole: roleViewer, accountQuota: 50}
+	anonymous, err := keys.Authenticate("")
+	if err != nil {
+		t.Fatalf("Authenticate() = %v", err)
+	}
+	alice := keys.accountCaller(anonymous, &Account{Username: "alice", Role: roleViewer}, true)
+	bob := keys.accountCaller(anonymous, &Account{Username: "bob", Role: roleAnalyst}, true)
+	day := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	counted := make(map[string]string)
+	for _, caller := range []*Caller{anonymous, alice, bob} {
+		name := quotaKey(caller.ID, day).Name
+		if other, ok := counted[name]; ok {
+			t.Errorf("%s and %s share the quota %s", caller.Name, other, name)
+		}
+		counted[name] = caller.Name
+	}
+	for _, caller := range []*Caller{alice, bob} {
+		if caller.DailyQuota != 50 {
+			t.Errorf("%s has a quota of %d, want 50", caller.Name, caller.DailyQuota)
+		}
+	}
+	if alice.Role != roleViewer || bob.Role != roleAnalyst {
+		t.Errorf("roles are %s and %s, want %s and %s", alice.Role, bob.Role, roleViewer, roleAnalyst)
+	}
+}
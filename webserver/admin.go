@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// adminUsage describes the admin commands.
+const adminUsage = `usage:
+  twitteranalytics apikey create -name NAME [-quota N] [-role viewer|analyst|admin]
+  twitteranalytics apikey list
+  twitteranalytics apikey revoke -prefix PREFIX
+  twitteranalytics account list
+  twitteranalytics account role -username USERNAME -role viewer|analyst|admin
+  twitteranalytics users migrate`
+
+// defaultDailyQuota is the daily quota of a new key when none is given.
+const defaultDailyQuota = 1000
+
+// RunAdmin runs the admin command in args instead of the webserver. Only
+// PROJECT_ID and GOOGLE_APPLICATION_CREDENTIALS need to be set.
+func RunAdmin(args []string) {
+	if len(args) < 2 {
+		log.Fatalln(adminUsage)
+	}
+	ds := InitDatastore()
+	defer ds.Close()
+	var err error
+	switch args[0] + " " + args[1] {
+	case "apikey create":
+		err = createAPIKey(ds, args[2:])
+	case "apikey list":
+		err = listAPIKeys(ds)
+	case "apikey revoke":
+		err = revokeAPIKey(ds, args[2:])
+	case "account list":
+		err = printAccounts(ds)
+	case "account role":
+		err = setAccountRole(ds, args[2:])
+	case "users migrate":
+		err = migrateUsers(ds)
+	default:
+		log.Fatalln(adminUsage)
+	}
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// createAPIKey stores the hash of a new key and prints the key, it cannot be
+// shown again.
+func createAPIKey(ds *datastore.Client, args []string) error {
+	flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+	name := flags.String("name", "", "who the key is for")
+	quota := flags.Int("quota", defaultDailyQuota, "new analyses the key can submit a day, negative for no limit")
+	roleName := flags.String("role", string(roleAnalyst), "what the key is allowed to do")
+	flags.Parse(args)
+	if *name == "" {
+		return fmt.Errorf("a name must be given\n%s", adminUsage)
+	}
+	role, err := parseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		return err
+	}
+	apiKey := &APIKey{
+		Name:       *name,
+		Prefix:     key[:apiKeyPrefixLength],
+		DailyQuota: *quota,
+		Role:       role,
+		Created:    time.Now(),
+	}
+	if _, err := ds.Put(context.Background(), datastore.NameKey(apiKeyKind, hashAPIKey(key), nil), apiKey); err != nil {
+		return err
+	}
+	fmt.Printf("Created a key for %s with the %s role and a daily quota of %d, it will not be shown again:\n%s\n", apiKey.Name, apiKey.Role, apiKey.DailyQuota, key)
+	return nil
+}
+
+// listAPIKeys prints every key without the secret part.
+func listAPIKeys(ds *datastore.Client) error {
+	keys := make([]APIKey, 0)
+	if _, err := ds.GetAll(context.Background(), datastore.NewQuery(apiKeyKind).Order("Created"), &keys); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tNAME\tROLE\tDAILY QUOTA\tCREATED\tREVOKED")
+	for _, key := range keys {
+		role := key.Role
+		if role == "" {
+			role = roleAnalyst
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%t\n", key.Prefix, key.Name, role, key.DailyQuota, key.Created.Format(time.RFC3339), key.Revoked)
+	}
+	return w.Flush()
+}
+
+// revokeAPIKey revokes the keys that start with the prefix.
+func revokeAPIKey(ds *datastore.Client, args []string) error {
+	flags := flag.NewFlagSet("apikey revoke", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "the prefix of the key, as shown by list")
+	flags.Parse(args)
+	if *prefix == "" {
+		return fmt.Errorf("a prefix must be given\n%s", adminUsage)
+	}
+	keys := make([]APIKey, 0)
+	dsKeys, err := ds.GetAll(context.Background(), datastore.NewQuery(apiKeyKind).Filter("Prefix =", *prefix), &keys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no key starts with %s", *prefix)
+	}
+	for i := range keys {
+		keys[i].Revoked = true
+	}
+	if _, err := ds.PutMulti(context.Background(), dsKeys, keys); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d key(s), they stop working within %v.\n", len(keys), apiKeyTTL)
+	return nil
+}
+
+// printAccounts prints every account and its role.
+func printAccounts(ds *datastore.Client) error {
+	accounts, err := listAccounts(context.Background(), ds)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tROLE\tCREATED")
+	for _, account := range accounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", account.Username, account.Role, account.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// setAccountRole gives an account a role, which is how the first admin is
+// made.
+func setAccountRole(ds *datastore.Client, args []string) error {
+	flags := flag.NewFlagSet("account role", flag.ExitOnError)
+	username := flags.String("username", "", "the username of the account")
+	roleName := flags.String("role", "", "what the account is allowed to do")
+	flags.Parse(args)
+	if *username == "" {
+		return fmt.Errorf("a username must be given\n%s", adminUsage)
+	}
+	role, err := parseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	account, err := setRole(context.Background(), strings.ToLower(*username), role, ds)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s now has the %s role.\n", account.Username, account.Role)
+	return nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// Change is the entity in the datastore that tells name-index that a user
+	// was added, updated or removed. The webserver only writes removals.
+	Change struct {
+		UserID                     int64
+		Username, PreviousUsername string
+		Op                         string
+		Time                       time.Time
+	}
+
+	// IndexState is the entity in the datastore that records how far through
+	// the changes name-index is. Clearing Watermark makes name-index rebuild
+	// the whole index the next time it runs.
+	IndexState struct{ Watermark time.Time }
+
+	// DeletedUser is the response to deleting a user. Objects is how many of
+	// the user's tweet documents were deleted from CloudStorage.
+	DeletedUser struct {
+		Username string
+		UserID   int64
+		Objects  int
+	}
+
+	// Backfill is the response to a backfill. Submitted holds the jobs that
+	// were started and InFlight the ones that were already running. Cursor
+	// is passed back to submit the next page, it is empty on the last page.
+	Backfill struct {
+		Submitted, InFlight []Job
+		Cursor              string
+	}
+)
+
+const (
+	changeKind     = "Change"
+	changeRemove   = "remove"
+	indexStateKind = "IndexState"
+	// indexStateID is the id of the only IndexState entity.
+	indexStateID = 1
+
+	// defaultBackfillLimit is how many users a backfill submits when no limit
+	// is given, maxBackfillLimit is the most it can submit at once.
+	defaultBackfillLimit = 100
+	maxBackfillLimit     = 1000
+)
+
+// findAnalysedUser gets the analysed user with the id parameter, or with the
+// name parameter ignoring case. Twitter is not asked, so users that have since
+// been suspended or renamed can still be found.
+func findAnalysedUser(ctx context.Context, values url.Values, ds *datastore.Client) (*AnalysedDocument, error) {
+	if id := values.Get("id"); id != "" {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := getDocument(ctx, ds, userID)
+		if err == nil && doc == nil {
+			err = &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: fmt.Errorf("the user with the id %d has not been analysed", userID)}
+		}
+		return doc, err
+	}
+	name, err := unmarshal(values)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimPrefix(name, "@")
+	// users analysed before SearchName was stored only match their exact
+	// username
+	queries := []*datastore.Query{
+		datastore.NewQuery(userKind).Filter("SearchName =", strings.ToLower(name)).Limit(1),
+		datastore.NewQuery(userKind).Filter("Username =", name).Limit(1),
+	}
+	for _, query := range queries {
+		doc := &AnalysedDocument{}
+		if _, err := ds.Run(ctx, query).Next(doc); err == iterator.Done {
+			continue
+		} else if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
+			return nil, err
+		}
+		return doc, nil
+	}
+	return nil, &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: fmt.Errorf("%s has not been analysed", name)}
+}
+
+// deleteUser removes the user's analysis, job and tracking, and tells
+// name-index to take them out of the index, in one transaction. Their tweet
+// documents are deleted from the bucket afterwards. Their alert history is
+// kept.
+func deleteUser(ctx context.Context, doc *AnalysedDocument, ds *datastore.Client, bucket *storage.BucketHandle) (*DeletedUser, error) {
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		keys := []*datastore.Key{datastore.IDKey(userKind, doc.UserID, nil), jobKey(doc.UserID), trackedKey(doc.UserID)}
+		if err := tx.DeleteMulti(keys); err != nil {
+			return err
+		}
+		_, err := tx.Put(datastore.IncompleteKey(changeKind, nil), &Change{
+			UserID:   doc.UserID,
+			Username: doc.Username,
+			Op:       changeRemove,
+			Time:     time.Now(),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleted := &DeletedUser{Username: doc.Username, UserID: doc.UserID}
+	// the fetcher names the documents <user id>-<last tweet id>.json
+	it := bucket.Objects(ctx, &storage.Query{Prefix: fmt.Sprintf("%d-", doc.UserID)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return deleted, nil
+		} else if err != nil {
+			return deleted, err
+		}
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return deleted, err
+		}
+		deleted.Objects++
+	}
+}
+
+// unmarshalBackfill gets the time that users last analysed before are
+// submitted again, now if it is not given, and how many to submit.
+func unmarshalBackfill(values url.Values) (time.Time, int, error) {
+	before := time.Now()
+	if value := values.Get("before"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		before = t
+	}
+	limit, err := unmarshalLimit(values, defaultBackfillLimit)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if limit > maxBackfillLimit {
+		return time.Time{}, 0, invalid("limit must be at most %d", maxBackfillLimit)
+	}
+	return before, limit, nil
+}
+
+// backfill submits up to limit users that were last analysed before the time
+// to be fetched and analysed again from scratch, least recently analysed
+// first, starting from the cursor if it is not empty. The fresh analysis
+// replaces the stored one rather than being added to it. Users analysed before
+// LastAnalysed was stored are only found once they have been migrated.
+func backfill(ctx context.Context, before time.Time, limit int, cursor string, ds *datastore.Client, topic *pubsub.Topic) (*Backfill, error) {
+	query := datastore.NewQuery(userKind).Filter("LastAnalysed <", before).Order("LastAnalysed").Limit(limit)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, invalid("cursor is not valid")
+		}
+		query = query.Start(c)
+	}
+	result := &Backfill{Submitted: make([]Job, 0), InFlight: make([]Job, 0)}
+	it := ds.Run(ctx, query)
+	count := 0
+	for {
+		doc := AnalysedDocument{}
+		if _, err := it.Next(&doc); err == iterator.Done {
+			break
+		} else if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
+			return nil, err
+		}
+		count++
+		job, submitted, err := submitJob(ctx, doc.Username, doc.UserID, ds, topic)
+		if err != nil {
+			return nil, err
+		}
+		if submitted {
+			result.Submitted = append(result.Submitted, *job)
+		} else {
+			result.InFlight = append(result.InFlight, *job)
+		}
+	}
+	if count == limit {
+		next, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		result.Cursor = next.String()
+	}
+	return result, nil
+}
+
+// requestReindex clears the watermark of the name index, so that name-index
+// rebuilds the index and the leaderboards from every user the next time it
+// runs.
+func requestReindex(ctx context.Context, ds *datastore.Client) error {
+	_, err := ds.Put(ctx, datastore.IDKey(indexStateKind, indexStateID, nil), &IndexState{})
+	return err
+}
+
+// listAccounts gets every account ordered by username.
+func listAccounts(ctx context.Context, ds *datastore.Client) ([]Account, error) {
+	accounts := make([]Account, 0)
+	_, err := ds.GetAll(ctx, datastore.NewQuery(accountKind).Order("Username"), &accounts)
+	return accounts, err
+}
+
+// setRole gives the account with the username the role.
+func setRole(ctx context.Context, username string, role Role, ds *datastore.Client) (*Account, error) {
+	account := &Account{}
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(accountKey(username), account); err == datastore.ErrNoSuchEntity {
+			return &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: fmt.Errorf("there is no account called %s", username)}
+		} else if err != nil {
+			return err
+		}
+		account.Role = role
+		_, err := tx.Put(accountKey(username), account)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// AdminUsersHO returns a handler that deletes the analysed user with the name
+// or id parameter.
+func AdminUsersHO(ds *datastore.Client, bucket *storage.BucketHandle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			notAllowed(w, r, http.MethodDelete)
+			return
+		}
+		doc, err := findAnalysedUser(r.Context(), r.URL.Query(), ds)
+		if err != nil {
+			writeError("Find", err, w)
+			return
+		}
+		logUserID(r.Context(), doc.UserID)
+		deleted, err := deleteUser(r.Context(), doc, ds, bucket)
+		if err != nil {
+			writeError("Delete", err, w)
+			return
+		}
+		writeJSON(deleted, w)
+	}
+}
+
+// AdminBackfillHO returns a handler that submits the users last analysed
+// before the before parameter to be analysed again, limit at a time.
+func AdminBackfillHO(ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			notAllowed(w, r, http.MethodPost)
+			return
+		}
+		before, limit, err := unmarshalBackfill(r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		result, err := backfill(r.Context(), before, limit, r.URL.Query().Get("cursor"), ds, topic)
+		if err != nil {
+			writeError("Backfill", err, w)
+			return
+		}
+		writeJSON(result, w)
+	}
+}
+
+// AdminReindexHO returns a handler that has name-index rebuild the name index
+// the next time it runs.
+func AdminReindexHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			notAllowed(w, r, http.MethodPost)
+			return
+		}
+		if err := requestReindex(r.Context(), ds); err != nil {
+			writeError("Reindex", err, w)
+			return
+		}
+		writeJSON(struct{ Message string }{Message: "The name index will be rebuilt the next time the indexer runs."}, w)
+	}
+}
+
+// AdminAccountsHO returns a handler for accounts. GET lists every account and
+// PUT gives the account with the username parameter the role parameter.
+func AdminAccountsHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			accounts, err := listAccounts(r.Context(), ds)
+			if err != nil {
+				writeError("List", err, w)
+				return
+			}
+			data = accounts
+		case http.MethodPut:
+			role, err := parseRole(r.URL.Query().Get("role"))
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			account, err := setRole(r.Context(), strings.ToLower(r.URL.Query().Get("username")), role, ds)
+			if err != nil {
+				writeError("Role", err, w)
+				return
+			}
+			data = account
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPut)
+			return
+		}
+		writeJSON(data, w)
+	}
+}
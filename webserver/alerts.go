@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// AlertRule is a declarative condition on a user's sentiment that the
+	// analyser checks every time a user is analysed. Metric is measured over the
+	// last WindowDays days and compared to Threshold using Comparison. If
+	// UserIDs is empty then the rule applies to every user. Owner is the
+	// account or key that created the rule, it is empty if it was created
+	// anonymously.
+	AlertRule struct {
+		ID         int64 `datastore:"-"`
+		Name       string
+		UserIDs    []int64
+		Metric     string
+		Comparison string
+		Threshold  float64
+		WindowDays int
+		Created    time.Time
+		Owner      string
+	}
+
+	// Alert is the history entry made by the analyser every time a rule starts
+	// firing for a user. Owner is copied from the rule.
+	Alert struct {
+		ID                 int64 `datastore:"-"`
+		RuleID             int64
+		RuleName           string
+		UserID             int64
+		Username           string
+		Metric, Comparison string
+		Value, Threshold   float64
+		WindowDays         int
+		Message            string
+		Triggered          time.Time
+		Owner              string
+	}
+
+	// AlertsPage is a page of alerts, newest first. Cursor is passed back to
+	// get the next page, it is empty when there are no more alerts.
+	AlertsPage struct {
+		Alerts []Alert
+		Cursor string
+	}
+)
+
+const (
+	alertRuleKind = "AlertRule"
+	alertKind     = "Alert"
+
+	metricNegativeShare = "negative_share"
+	metricPositiveShare = "positive_share"
+	metricAverage       = "average"
+	metricAverageChange = "average_change"
+
+	comparisonAbove = "above"
+	comparisonBelow = "below"
+
+	// defaultAlertLimit is how many alerts are returned when no limit is given,
+	// maxAlertLimit is the most that can be asked for.
+	defaultAlertLimit = 100
+	maxAlertLimit     = 1000
+	// maxWindowDays is the longest window a rule can measure over.
+	maxWindowDays = 365
+)
+
+// alertMetrics are all of the metrics that a rule can measure.
+var alertMetrics = map[string]bool{
+	metricNegativeShare: true,
+	metricPositiveShare: true,
+	metricAverage:       true,
+	metricAverageChange: true,
+}
+
+// Validate returns an error if the rule could never be evaluated.
+func (rule *AlertRule) Validate() error {
+	if rule.Name == "" {
+		return invalid("rule name was empty, but should not have been")
+	}
+	if !alertMetrics[rule.Metric] {
+		return invalid("unknown rule metric: %s", rule.Metric)
+	}
+	if rule.Comparison != comparisonAbove && rule.Comparison != comparisonBelow {
+		return invalid("rule comparison must be %s or %s", comparisonAbove, comparisonBelow)
+	}
+	if rule.WindowDays < 1 || rule.WindowDays > maxWindowDays {
+		return invalid("rule window must be between 1 and %d days", maxWindowDays)
+	}
+	return nil
+}
+
+// unmarshalLimit gets the limit query parameter, or fallback if it was not
+// given.
+func unmarshalLimit(values url.Values, fallback int) (int, error) {
+	limit := values.Get("limit")
+	if limit == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, invalid("limit must be positive")
+	}
+	return n, nil
+}
+
+// listAlerts gets a page of at most limit alerts, newest first, starting from
+// the cursor if it is not empty. Only the alerts for the user with userID are
+// listed if it is not 0, and only those the owner owns if it is not empty,
+// which needs the composite indexes in index.yaml.
+func listAlerts(ds *datastore.Client, userID int64, owner string, limit int, cursor string) (*AlertsPage, error) {
+	query := datastore.NewQuery(alertKind)
+	if userID != 0 {
+		query = query.Filter("UserID =", userID)
+	}
+	if owner != "" {
+		query = query.Filter("Owner =", owner)
+	}
+	query = query.Order("-Triggered").Limit(limit)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, invalid("cursor is not valid")
+		}
+		query = query.Start(c)
+	}
+	page := &AlertsPage{Alerts: make([]Alert, 0, limit)}
+	it := ds.Run(context.Background(), query)
+	for {
+		alert := Alert{}
+		key, err := it.Next(&alert)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		alert.ID = key.ID
+		page.Alerts = append(page.Alerts, alert)
+	}
+	if len(page.Alerts) == limit {
+		next, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		page.Cursor = next.String()
+	}
+	return page, nil
+}
+
+// listAlertRules gets all of the alert rules, or only the ones created by owner
+// if it is not empty.
+func listAlertRules(ds *datastore.Client, owner string) ([]AlertRule, error) {
+	rules := make([]AlertRule, 0)
+	keys, err := ds.GetAll(context.Background(), datastore.NewQuery(alertRuleKind).Order("Created"), &rules)
+	if err != nil {
+		return nil, err
+	}
+	owned := make([]AlertRule, 0, len(rules))
+	for i, key := range keys {
+		rules[i].ID = key.ID
+		if owner == "" || rules[i].Owner == owner {
+			owned = append(owned, rules[i])
+		}
+	}
+	return owned, nil
+}
+
+// deleteAlertRule deletes the rule with the id, it fails with a 403 if another
+// account created it.
+func deleteAlertRule(ctx context.Context, id int64, ds *datastore.Client) error {
+	key := datastore.IDKey(alertRuleKind, id, nil)
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		rule := &AlertRule{}
+		if err := tx.Get(key, rule); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := checkOwner(ctx, rule.Owner); err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return err
+}
+
+// AlertsHO returns a handler that pages through the alert history, newest
+// first. The user parameter limits it to a single user id, mine=true limits it
+// to the caller's rules, and cursor continues from the end of a previous page
+// of at most limit alerts.
+func AlertsHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		userID := int64(0)
+		if user := r.URL.Query().Get("user"); user != "" {
+			id, err := strconv.ParseInt(user, 10, 64)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			userID = id
+		}
+		limit, err := unmarshalLimit(r.URL.Query(), defaultAlertLimit)
+		if err == nil && limit > maxAlertLimit {
+			err = invalid("limit can be at most %d", maxAlertLimit)
+		}
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		owner, err := mineOnly(r)
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		page, err := listAlerts(ds, userID, owner, limit, r.URL.Query().Get("cursor"))
+		if err != nil {
+			writeError("List", err, w)
+			return
+		}
+		writeJSON(page, w)
+	}
+}
+
+// AlertRulesHO returns a handler for alert rules. GET lists all of the rules,
+// or only the ones of the account that is signed in with mine=true, POST
+// creates one from a JSON AlertRule body, and DELETE removes the rule with the
+// id parameter.
+func AlertRulesHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			owner, err := mineOnly(r)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			rules, err := listAlertRules(ds, owner)
+			if err != nil {
+				writeError("List", err, w)
+				return
+			}
+			data = rules
+		case http.MethodPost:
+			rule := &AlertRule{}
+			if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			if err := rule.Validate(); err != nil {
+				writeError("Validate", err, w)
+				return
+			}
+			rule.Created = time.Now()
+			rule.Owner = ownerFrom(r.Context())
+			key, err := ds.Put(context.Background(), datastore.IncompleteKey(alertRuleKind, nil), rule)
+			if err != nil {
+				writeError("Create", err, w)
+				return
+			}
+			rule.ID = key.ID
+			data = rule
+		case http.MethodDelete:
+			id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			if err := deleteAlertRule(r.Context(), id, ds); err != nil {
+				writeError("Delete", err, w)
+				return
+			}
+			data = struct{ Message string }{Message: "The alert rule has been deleted."}
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+			return
+		}
+		writeJSON(data, w)
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/pubsub"
@@ -23,14 +24,25 @@ type (
 		UserID, LastTweetID, EarliestTweetID int64
 	}
 
+	// DayBucket holds the sentiment counts of the tweets a user made on Day.
+	DayBucket struct {
+		Day                            time.Time
+		PositiveTweets, NegativeTweets int
+	}
+
 	// AnalysedDocument is the actual entity that is stored in the datastore, all of
 	// the tweets have been converted to scores. There is no way to get the original
-	// tweet back from the score at this point.
+	// tweet back from the score at this point. Days breaks the scores down by the
+	// day the tweets were made on. SearchName is the lower case Username, which
+	// is what users are sorted and searched by.
 	AnalysedDocument struct {
 		DocumentMetaData
 		TweetScores                    []int
 		PositiveTweets, NegativeTweets int
 		AverageScore                   float64
+		Days                           []DayBucket `datastore:",noindex"`
+		SearchName                     string
+		LastAnalysed                   time.Time
 	}
 
 	// TwitterCredentials data structore for twitter api credentials
@@ -41,14 +53,45 @@ type (
 		AccessTokenSecret string
 	}
 
+	// Candidate is a user that might be the one that was searched for when no
+	// user had exactly the screen name that was given.
+	Candidate struct {
+		UserID           int64
+		ScreenName, Name string
+		FollowersCount   int
+		Verified         bool
+	}
+
+	// CandidatesError is returned when no user has exactly the screen name that
+	// was looked up, it holds the closest matches.
+	CandidatesError struct {
+		Candidates []Candidate
+	}
+
 	// FetchMessage contains the data necessary to run a fetch using the Twitter
 	// API to get tweets.
 	FetchMessage struct {
 		Username string
 		UserID   int64
+		// RequestID is the id of the request that submitted the user, it is
+		// passed along the pipeline so that its logs can be tied together.
+		RequestID string
 	}
 )
 
+const (
+	// twitterUserNotFound is the Twitter API error code for a missing user.
+	twitterUserNotFound = 50
+	// twitterNoMatches is the Twitter API error code for a bulk lookup where
+	// none of the users exist.
+	twitterNoMatches = 17
+	// maxLookup is the most users that can be looked up in one request.
+	maxLookup = 100
+	// maxCandidates is how many users are suggested when no user has exactly
+	// the screen name that was looked up.
+	maxCandidates = 5
+)
+
 // GetTwitterClient function to authorize twitter api and create a client
 func GetTwitterClient(credentials *TwitterCredentials) (*twitter.Client, error) {
 	config := oauth1.NewConfig(credentials.ConsumerKey, credentials.ConsumerSecret)
@@ -70,11 +113,17 @@ func GetTwitterClient(credentials *TwitterCredentials) (*twitter.Client, error)
 	return client, nil
 }
 
-// writeError returns a plaintext message to the caller including the location
-// where the error occurred, what the error was, and a BadRequest status.
-func writeError(location string, err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte(fmt.Sprintf("Location: %s, Error: %v", location, err.Error())))
+// writeJSON marshals data and returns it to the caller as JSON with an OK
+// status.
+func writeJSON(data interface{}, w http.ResponseWriter) {
+	ret, err := json.Marshal(data)
+	if err != nil {
+		writeError("Marshal", err, w)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
 }
 
 // unmarshal gets the query parameters from the get request and returns them if
@@ -82,87 +131,227 @@ func writeError(location string, err error, w http.ResponseWriter) {
 func unmarshal(values url.Values) (string, error) {
 	username := values.Get("name")
 	if username == "" {
-		return "", errors.New("username was empty, but should not have been")
+		return "", invalid("username was empty, but should not have been")
 	}
 	return username, nil
 }
 
-// getUser get user info based on the user input (screen name)
+// newCandidate gets the fields of user that identify them to a person.
+func newCandidate(user *twitter.User) Candidate {
+	return Candidate{
+		UserID:         user.ID,
+		ScreenName:     user.ScreenName,
+		Name:           user.Name,
+		FollowersCount: user.FollowersCount,
+		Verified:       user.Verified,
+	}
+}
+
+// candidates turns the users from a search into a CandidatesError.
+func candidates(users []twitter.User) *CandidatesError {
+	err := &CandidatesError{Candidates: make([]Candidate, 0, len(users))}
+	for i := range users {
+		err.Candidates = append(err.Candidates, newCandidate(&users[i]))
+	}
+	return err
+}
+
+// Error lists the screen names of the candidates.
+func (e *CandidatesError) Error() string {
+	names := make([]string, 0, len(e.Candidates))
+	for _, c := range e.Candidates {
+		names = append(names, "@"+c.ScreenName)
+	}
+	return "no user has that exact screen name, did you mean one of: " + strings.Join(names, ", ")
+}
+
+// hasErrorCode returns true if err is a Twitter API error with the code.
+func hasErrorCode(err error, code int) bool {
+	apiErr, ok := err.(twitter.APIError)
+	if !ok {
+		return false
+	}
+	for _, detail := range apiErr.Errors {
+		if detail.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound returns true if err is the Twitter API saying that the user does
+// not exist.
+func isNotFound(err error) bool {
+	return hasErrorCode(err, twitterUserNotFound)
+}
+
+// getUser get user info based on the user input (screen name). Only a user
+// with exactly that screen name is returned. If there is not one then the
+// closest matches from a search are returned in a CandidatesError.
 func getUser(client *twitter.Client, username string) (*twitter.User, error) {
 	includeEntities := true
+	screenName := strings.TrimPrefix(strings.TrimSpace(username), "@")
+	user, _, err := client.Users.Show(&twitter.UserShowParams{
+		ScreenName:      screenName,
+		IncludeEntities: &includeEntities,
+	})
+	if err == nil {
+		return user, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
 	searchParams := twitter.UserSearchParams{
-		Query:           username,
+		Query:           screenName,
 		Page:            1,
-		Count:           1,
+		Count:           maxCandidates,
 		IncludeEntities: &includeEntities,
 	}
-	users, _, err := client.Users.Search(username, &searchParams)
+	users, _, err := client.Users.Search(screenName, &searchParams)
 	if err != nil {
 		return nil, err
 	}
 	if len(users) < 1 {
-		return nil, errors.New("no users were found with that username")
+		return nil, &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: errors.New("no users were found with that username")}
 	}
-	return &users[0], nil
+	return nil, candidates(users)
 }
 
-func getData(username string, userID int64, ds *datastore.Client, topic *pubsub.Topic) (interface{}, error) {
-	doc := &AnalysedDocument{}
-	if err := ds.Get(context.Background(), datastore.IDKey("User", userID, nil), doc); err != nil {
-		log.Println(err)
-		fm := &FetchMessage{
-			Username: username,
-			UserID:   userID,
-		}
-		message, err := json.Marshal(fm)
+// getUserByID gets user info for the user with the numeric id.
+func getUserByID(client *twitter.Client, id int64) (*twitter.User, error) {
+	includeEntities := true
+	user, _, err := client.Users.Show(&twitter.UserShowParams{
+		UserID:          id,
+		IncludeEntities: &includeEntities,
+	})
+	if isNotFound(err) {
+		return nil, &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: errors.New("no user was found with that id")}
+	}
+	return user, err
+}
+
+// lookupUsers gets the users with exactly the screen names in a single
+// request, there can be at most maxLookup of them. Screen names that do not
+// belong to a user are left out of the result.
+func lookupUsers(client *twitter.Client, screenNames []string) ([]twitter.User, error) {
+	includeEntities := false
+	users, _, err := client.Users.Lookup(&twitter.UserLookupParams{
+		ScreenName:      screenNames,
+		IncludeEntities: &includeEntities,
+	})
+	if hasErrorCode(err, twitterNoMatches) {
+		return []twitter.User{}, nil
+	}
+	return users, err
+}
+
+// lookupUser gets the user described by the query parameters, by their
+// numeric id if the id parameter is set, otherwise by their exact screen name.
+func lookupUser(users *UserCache, values url.Values) (*twitter.User, error) {
+	if id := values.Get("id"); id != "" {
+		userID, err := strconv.ParseInt(id, 10, 64)
 		if err != nil {
 			return nil, err
 		}
-		res := topic.Publish(context.Background(), &pubsub.Message{
-			Data: message,
-		})
+		return findUser(users, "", userID)
+	}
+	name, err := unmarshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return findUser(users, name, 0)
+}
+
+// findUser gets the user with the numeric id if it is not zero, otherwise the
+// user with exactly the screen name.
+func findUser(users *UserCache, name string, id int64) (*twitter.User, error) {
+	if id != 0 {
+		return users.GetByID(id)
+	}
+	if name == "" {
+		return nil, invalid("username was empty, but should not have been")
+	}
+	return users.Get(name)
+}
+
+// writeUserError reports a failed lookup. If there were candidates for the
+// name then they are returned so the caller can pick the one they meant.
+func writeUserError(err error, w http.ResponseWriter) {
+	if c, ok := err.(*CandidatesError); ok {
+		writeErrorResponse(&ErrorResponse{
+			Code:       codeNotFound,
+			Message:    c.Error(),
+			Candidates: c.Candidates,
+		}, http.StatusNotFound, w)
+		return
+	}
+	writeError("User", err, w)
+}
+
+// LookupHO returns a handler that resolves the name or id parameter to a
+// single Twitter user without submitting them to be analysed. If no user has
+// exactly that screen name then the candidates are returned instead.
+func LookupHO(users *UserCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		user, err := lookupUser(users, r.URL.Query())
+		if err != nil {
+			writeUserError(err, w)
+			return
+		}
+		logUserID(r.Context(), user.ID)
+		writeJSON(newCandidate(user), w)
+	}
+}
 
-		if _, err := res.Get(context.Background()); err != nil {
+// getData returns the analysed document for the user if there is one. If there
+// is not then the user is submitted to be analysed, unless a job for them is
+// already in flight, and a message describing the job is returned instead.
+func getData(ctx context.Context, username string, userID int64, ds *datastore.Client, topic *pubsub.Topic) (interface{}, error) {
+	logUserID(ctx, userID)
+	doc := &AnalysedDocument{}
+	if err := ds.Get(context.Background(), datastore.IDKey(userKind, userID, nil), doc); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			logEntry(levelError, err.Error(), logFields{"location": "GetData", "request_id": requestIDFrom(ctx), "user_id": userID})
+		}
+		job, submitted, err := submitJob(ctx, username, userID, ds, topic)
+		if err != nil {
 			return nil, err
 		}
-		return struct{ Message string }{Message: "This user has not been analysed yet, they have been submitted to be analysed. Check back later to see more about them."}, nil
+		if !submitted {
+			return JobMessage{Message: "This user has already been submitted to be analysed. Check back later to see more about them.", Job: job}, nil
+		}
+		return JobMessage{Message: "This user has not been analysed yet, they have been submitted to be analysed. Check back later to see more about them.", Job: job}, nil
 	}
 	return *doc, nil
 }
 
 // GetAnalysisHO...
-func GetAnalysisHO(tClient *twitter.Client, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+func GetAnalysisHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
 	// GetAnalysis either gets the analysis data for a twitter user who has
 	// already been processed, or it sends a request to start analysing them.
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check request method
 		if r.Method != http.MethodGet {
 			// Must be a GET request
-			writeError("Method", errors.New("/api/analysis only accepts GET requests"), w)
+			notAllowed(w, r, http.MethodGet)
 			return
 		}
 		// Unmarshal the request into name variable
-		name, err := unmarshal(r.URL.Query())
+		user, err := lookupUser(users, r.URL.Query())
 		if err != nil {
-			writeError("Unmarshal", err, w)
-		}
-		user, err := getUser(tClient, name)
-		if err != nil {
-			writeError("User", err, w)
+			writeUserError(err, w)
+			return
 		}
-		data, err := getData(user.Name, user.ID, ds, topic)
+		data, err := getData(r.Context(), user.ScreenName, user.ID, ds, topic)
 		if err != nil {
 			writeError("Data", err, w)
-		}
-		// Marshal the analysis data into JSON format for transport
-		ret, err := json.Marshal(data)
-		if err != nil {
-			writeError("Marshal", err, w)
 			return
 		}
-		// Send the json data to the requester
-		w.WriteHeader(http.StatusOK)
-		w.Header().Add("Content-Type", "application/json")
-		w.Write(ret)
+		// Send the analysis data to the requester as json
+		writeJSON(data, w)
 	}
 }
@@ -0,0 +1,253 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package analyticspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// AnalyticsClient is the client API for Analytics service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AnalyticsClient interface {
+	// Analyse submits the user to be analysed, even if they have been analysed
+	// before, so that their newest tweets are picked up.
+	Analyse(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*AnalyseReply, error)
+	// GetAnalysis works like /api/v1/analyse, it gets the user's analysis or
+	// submits them to be analysed if they have not been yet.
+	GetAnalysis(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*AnalysisReply, error)
+	// ListUsers works like /api/v1/users, it gets a page of the analysed users.
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*UsersPage, error)
+	// WatchJob works like /api/v1/analyse/stream, it sends an event every time
+	// the job analysing the user changes and finishes with the analysed
+	// document.
+	WatchJob(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (Analytics_WatchJobClient, error)
+}
+
+type analyticsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAnalyticsClient(cc grpc.ClientConnInterface) AnalyticsClient {
+	return &analyticsClient{cc}
+}
+
+func (c *analyticsClient) Analyse(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*AnalyseReply, error) {
+	out := new(AnalyseReply)
+	err := c.cc.Invoke(ctx, "/twitteranalytics.v1.Analytics/Analyse", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) GetAnalysis(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*AnalysisReply, error) {
+	out := new(AnalysisReply)
+	err := c.cc.Invoke(ctx, "/twitteranalytics.v1.Analytics/GetAnalysis", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*UsersPage, error) {
+	out := new(UsersPage)
+	err := c.cc.Invoke(ctx, "/twitteranalytics.v1.Analytics/ListUsers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsClient) WatchJob(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (Analytics_WatchJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Analytics_ServiceDesc.Streams[0], "/twitteranalytics.v1.Analytics/WatchJob", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &analyticsWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Analytics_WatchJobClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type analyticsWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *analyticsWatchJobClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AnalyticsServer is the server API for Analytics service.
+// All implementations must embed UnimplementedAnalyticsServer
+// for forward compatibility
+type AnalyticsServer interface {
+	// Analyse submits the user to be analysed, even if they have been analysed
+	// before, so that their newest tweets are picked up.
+	Analyse(context.Context, *UserRequest) (*AnalyseReply, error)
+	// GetAnalysis works like /api/v1/analyse, it gets the user's analysis or
+	// submits them to be analysed if they have not been yet.
+	GetAnalysis(context.Context, *UserRequest) (*AnalysisReply, error)
+	// ListUsers works like /api/v1/users, it gets a page of the analysed users.
+	ListUsers(context.Context, *ListUsersRequest) (*UsersPage, error)
+	// WatchJob works like /api/v1/analyse/stream, it sends an event every time
+	// the job analysing the user changes and finishes with the analysed
+	// document.
+	WatchJob(*UserRequest, Analytics_WatchJobServer) error
+	mustEmbedUnimplementedAnalyticsServer()
+}
+
+// UnimplementedAnalyticsServer must be embedded to have forward compatible implementations.
+type UnimplementedAnalyticsServer struct {
+}
+
+func (UnimplementedAnalyticsServer) Analyse(context.Context, *UserRequest) (*AnalyseReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Analyse not implemented")
+}
+func (UnimplementedAnalyticsServer) GetAnalysis(context.Context, *UserRequest) (*AnalysisReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAnalysis not implemented")
+}
+func (UnimplementedAnalyticsServer) ListUsers(context.Context, *ListUsersRequest) (*UsersPage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedAnalyticsServer) WatchJob(*UserRequest, Analytics_WatchJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedAnalyticsServer) mustEmbedUnimplementedAnalyticsServer() {}
+
+// UnsafeAnalyticsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AnalyticsServer will
+// result in compilation errors.
+type UnsafeAnalyticsServer interface {
+	mustEmbedUnimplementedAnalyticsServer()
+}
+
+func RegisterAnalyticsServer(s grpc.ServiceRegistrar, srv AnalyticsServer) {
+	s.RegisterService(&Analytics_ServiceDesc, srv)
+}
+
+func _Analytics_Analyse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).Analyse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/twitteranalytics.v1.Analytics/Analyse",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).Analyse(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_GetAnalysis_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).GetAnalysis(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/twitteranalytics.v1.Analytics/GetAnalysis",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).GetAnalysis(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/twitteranalytics.v1.Analytics/ListUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analytics_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(UserRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnalyticsServer).WatchJob(m, &analyticsWatchJobServer{stream})
+}
+
+type Analytics_WatchJobServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type analyticsWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *analyticsWatchJobServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Analytics_ServiceDesc is the grpc.ServiceDesc for Analytics service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Analytics_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "twitteranalytics.v1.Analytics",
+	HandlerType: (*AnalyticsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Analyse",
+			Handler:    _Analytics_Analyse_Handler,
+		},
+		{
+			MethodName: "GetAnalysis",
+			Handler:    _Analytics_GetAnalysis_Handler,
+		},
+		{
+			MethodName: "ListUsers",
+			Handler:    _Analytics_ListUsers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchJob",
+			Handler:       _Analytics_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "analytics.proto",
+}
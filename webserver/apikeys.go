@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type (
+	// APIKey is the entity in the datastore for a key that callers
+	// authenticate with. It is keyed by the SHA-256 hash of the key, the key
+	// itself is only shown once when it is created. Prefix is the start of the
+	// key, which is enough to tell keys apart. DailyQuota is how many new
+	// analyses the key can submit a day, a negative quota has no limit. Keys
+	// made before there were roles have no Role and are analysts.
+	APIKey struct {
+		Name       string
+		Prefix     string
+		DailyQuota int
+		Role       Role
+		Created    time.Time
+		Revoked    bool
+	}
+
+	// QuotaUsage is the entity in the datastore that counts the new analyses a
+	// caller submitted on Day.
+	QuotaUsage struct {
+		Caller string
+		Day    time.Time
+		Count  int
+	}
+
+	// Caller is who a request was made by. ID is the hash of their key, the
+	// account they signed in with after accountCallerPrefix, or anonymousCaller
+	// otherwise, their quota is counted under it. Prefix is the prefix of their
+	// key. Account is the username of the account they signed in to the
+	// frontend with, if they did. CrossSite is true if they are signed in but
+	// the request did not carry the session's CSRF token, so another site could
+	// have made it, they can read but not submit users.
+	Caller struct {
+		ID, Name   string
+		Prefix     string
+		DailyQuota int
+		Role       Role
+		Account    string
+		CrossSite  bool
+	}
+
+	// APIKeys authenticates requests with the keys in the datastore. Keys are
+	// cached for apiKeyTTL, so revoking one takes at most that long.
+	APIKeys struct {
+		ds             *datastore.Client
+		anonymousQuota int
+		anonymousRole  Role
+		accountQuota   int
+
+		mu    sync.Mutex
+		cache map[string]cachedKey
+	}
+
+	// cachedKey is a key that was looked up at checked, key is nil if there
+	// is no such key.
+	cachedKey struct {
+		key     *APIKey
+		checked time.Time
+	}
+
+	// callerContextKey is the key the Caller is stored under in a request's
+	// context.
+	callerContextKey struct{}
+)
+
+const (
+	apiKeyKind     = "APIKey"
+	quotaUsageKind = "QuotaUsage"
+
+	apiKeyHeader = "X-API-Key"
+	// apiKeyPrefix starts every key so that they are easy to spot.
+	apiKeyPrefix = "ta_"
+	// apiKeyBytes is how many random bytes are in a key.
+	apiKeyBytes = 24
+	// apiKeyPrefixLength is how much of a key is kept to tell it apart.
+	apiKeyPrefixLength = len(apiKeyPrefix) + 8
+	// apiKeyTTL is how long a key is trusted before it is looked up again.
+	apiKeyTTL = time.Minute
+
+	// anonymousCaller is the caller of every request without a key or a
+	// session, they share a single quota.
+	anonymousCaller = "anonymous"
+	// accountCallerPrefix starts the ID of callers signed in to an account,
+	// the username follows it.
+	accountCallerPrefix = "account:"
+)
+
+// hashAPIKey returns the hex SHA-256 hash of the key, which is what it is
+// stored under. The keys are random so they do not need a slow hash.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a new random key.
+func newAPIKey() (string, error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// InitAPIKeys creates the authenticator, anonymous callers get the daily quota
+// in ANONYMOUS_DAILY_QUOTA and the role in ANONYMOUS_ROLE, and each account gets
+// the daily quota in ACCOUNT_DAILY_QUOTA.
+func InitAPIKeys(ds *datastore.Client) *APIKeys {
+	quota, err := strconv.Atoi(os.Getenv(envVarNames[evAnonymousDailyQuota]))
+	if err != nil {
+		log.Fatalf("Could not read the anonymous daily quota: %v\n", err)
+	}
+	accountQuota, err := strconv.Atoi(os.Getenv(envVarNames[evAccountDailyQuota]))
+	if err != nil {
+		log.Fatalf("Could not read the account daily quota: %v\n", err)
+	}
+	role := Role(os.Getenv(envVarNames[evAnonymousRole]))
+	if role != roleNone {
+		if role, err = parseRole(string(role)); err != nil {
+			log.Fatalf("Could not read the anonymous role: %v\n", err)
+		}
+	}
+	return &APIKeys{ds: ds, anonymousQuota: quota, anonymousRole: role, accountQuota: accountQuota, cache: make(map[string]cachedKey)}
+}
+
+// lookup gets the key with the hash, it is nil if there is no such key.
+func (k *APIKeys) lookup(hash string) (*APIKey, error) {
+	k.mu.Lock()
+	cached, ok := k.cache[hash]
+	k.mu.Unlock()
+	if ok && time.Since(cached.checked) < apiKeyTTL {
+		return cached.key, nil
+	}
+	key := &APIKey{}
+	if err := k.ds.Get(context.Background(), datastore.NameKey(apiKeyKind, hash, nil), key); err == datastore.ErrNoSuchEntity {
+		key = nil
+	} else if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.cache[hash] = cachedKey{key: key, checked: time.Now()}
+	k.mu.Unlock()
+	return key, nil
+}
+
+// Authenticate returns the caller with the key, or an anonymous caller if key
+// is empty.
+func (k *APIKeys) Authenticate(key string) (*Caller, error) {
+	if key == "" {
+		return &Caller{ID: anonymousCaller, Name: anonymousCaller, DailyQuota: k.anonymousQuota, Role: k.anonymousRole}, nil
+	}
+	hash := hashAPIKey(key)
+	apiKey, err := k.lookup(hash)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil || apiKey.Revoked {
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Err: errors.New("the API key is not valid")}
+	}
+	role := apiKey.Role
+	if role == "" {
+		role = roleAnalyst
+	}
+	return &Caller{ID: hash, Name: apiKey.Name, Prefix: apiKey.Prefix, DailyQuota: apiKey.DailyQuota, Role: role}, nil
+}
+
+// requestAPIKey gets the key from the X-API-Key header, or from a bearer token
+// in the Authorization header.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// AuthHO wraps fun so that it is only called for requests with a valid key, or
+// without a key but with a valid session if they have a session cookie. The
+// caller is put in the request's context.
+func (k *APIKeys) AuthHO(fun http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var caller *Caller
+		var err error
+		if key := requestAPIKey(r); key != "" {
+			caller, err = k.Authenticate(key)
+		} else {
+			caller, err = k.sessionCaller(r)
+		}
+		if err != nil {
+			writeError("Auth", err, w)
+			return
+		}
+		logCaller(r.Context(), caller)
+		fun(w, r.WithContext(withCaller(r.Context(), caller)))
+	}
+}
+
+// withCaller returns a copy of ctx that carries the caller.
+func withCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// callerFrom returns the caller in ctx, it is nil if there is not one.
+func callerFrom(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerContextKey{}).(*Caller)
+	return caller
+}
+
+// quotaKey returns the key of the QuotaUsage entity for the caller with the ID
+// on the day.
+func quotaKey(callerID string, day time.Time) *datastore.Key {
+	return datastore.NameKey(quotaUsageKind, callerID+"/"+day.Format("2006-01-02"), nil)
+}
+
+// quotaDay returns the day that t counts against a quota on.
+func quotaDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// quotaLimited reports whether the caller is held to a quota, callers that are
+// nil, admins or have a negative quota are not.
+func quotaLimited(caller *Caller) bool {
+	return caller != nil && caller.DailyQuota >= 0 && !caller.Role.AtLeast(roleAdmin)
+}
+
+// quotaExceeded is the 429 for a caller that has used up its quota.
+func quotaExceeded(caller *Caller) error {
+	return &APIError{
+		Status: http.StatusTooManyRequests,
+		Code:   codeQuotaExceeded,
+		Err:    fmt.Errorf("%s has used all %d of its new analyses for today, users that have already been analysed can still be read", caller.Name, caller.DailyQuota),
+	}
+}
+
+// useQuota counts a new analysis made at now against the caller's quota for
+// that day in the transaction. It fails with a 429 if the quota has been used
+// up.
+func useQuota(tx *datastore.Transaction, caller *Caller, now time.Time) error {
+	if !quotaLimited(caller) {
+		return nil
+	}
+	day := quotaDay(now)
+	key := quotaKey(caller.ID, day)
+	usage := &QuotaUsage{Caller: caller.ID, Day: day}
+	if err := tx.Get(key, usage); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if usage.Count >= caller.DailyQuota {
+		return quotaExceeded(caller)
+	}
+	usage.Count++
+	_, err := tx.Put(key, usage)
+	return err
+}
+
+// refundQuota gives back the new analysis that useQuota counted at now, in the
+// transaction, for when it was never submitted.
+func refundQuota(tx *datastore.Transaction, caller *Caller, now time.Time) error {
+	if !quotaLimited(caller) {
+		return nil
+	}
+	key := quotaKey(caller.ID, quotaDay(now))
+	usage := &QuotaUsage{}
+	if err := tx.Get(key, usage); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if usage.Count == 0 {
+		return nil
+	}
+	usage.Count--
+	_, err := tx.Put(key, usage)
+	return err
+}
+
+// checkQuota fails with a 429 if the caller has fewer than n new analyses left
+// of its quota for today, without counting any.
+func checkQuota(ds *datastore.Client, caller *Caller, n int) error {
+	if !quotaLimited(caller) || n == 0 {
+		return nil
+	}
+	usage := &QuotaUsage{}
+	err := ds.Get(context.Background(), quotaKey(caller.ID, quotaDay(time.Now())), usage)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if left := caller.DailyQuota - usage.Count; left < n {
+		return &APIError{
+			Status: http.StatusTooManyRequests,
+			Code:   codeQuotaExceeded,
+			Err:    fmt.Errorf("%s has %d of its %d new analyses for today left, %d users need analysing", caller.Name, left, caller.DailyQuota, n),
+		}
+	}
+	return nil
+}
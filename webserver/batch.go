@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+type (
+	// Batch is the entity in the datastore that remembers which users were
+	// submitted together, so the caller can poll for all of them at once.
+	// Failed holds the users that could not be submitted, they are not in
+	// UserIDs. Owner is who submitted it, as for groups.
+	Batch struct {
+		Names    []string        `datastore:",noindex"`
+		UserIDs  []int64         `datastore:",noindex"`
+		NotFound []string        `datastore:",noindex"`
+		Failed   []SubmitFailure `datastore:",noindex"`
+		Owner    string
+		Created  time.Time
+	}
+
+	// BatchStatus is returned for a batch. Documents holds the users that have
+	// been analysed, Pending holds the jobs of the users that have not,
+	// NotFound holds the names that no Twitter user has and Failed holds the
+	// users that could not be submitted.
+	BatchStatus struct {
+		ID        int64
+		Owner     string
+		Done      bool
+		Documents []AnalysedDocument
+		Pending   []Job
+		NotFound  []string
+		Failed    []SubmitFailure
+	}
+)
+
+const (
+	batchKind = "Batch"
+
+	// maxBatchSize is the most names that can be submitted in one batch.
+	maxBatchSize = 500
+	// maxBatchBody is the largest request body that is read for a batch.
+	maxBatchBody = 1 << 20
+)
+
+// parseCSVNames gets the names out of a CSV body. Every non-empty field is a
+// name, so names can be given one per line or comma separated, and a header
+// line of "name" or "screen_name" is skipped.
+func parseCSVNames(body []byte) ([]string, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	names := make([]string, 0)
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &ValidationError{Err: err}
+		}
+		for _, field := range record {
+			field = strings.TrimSpace(field)
+			header := strings.ToLower(field)
+			if field == "" || (line == 0 && (header == "name" || header == "screen_name")) {
+				continue
+			}
+			names = append(names, field)
+		}
+	}
+	return names, nil
+}
+
+// parseJSONNames gets the names out of a JSON body that is either an array of
+// names or an object with a Names array.
+func parseJSONNames(body []byte) ([]string, error) {
+	names := make([]string, 0)
+	if err := json.Unmarshal(body, &names); err == nil {
+		return names, nil
+	}
+	wrapped := struct{ Names []string }{}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Names, nil
+}
+
+// unmarshalNames reads the names of a batch from the request body, as CSV if
+// the Content-Type says so and as JSON otherwise. Duplicate names are removed.
+func unmarshalNames(r *http.Request) ([]string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBatchBody))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		names, err = parseCSVNames(body)
+	} else {
+		names, err = parseJSONNames(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen, unique := make(map[string]bool, len(names)), make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		unique = append(unique, name)
+	}
+	if len(unique) == 0 {
+		return nil, invalid("batch did not contain any names")
+	}
+	if len(unique) > maxBatchSize {
+		return nil, invalid("batch can contain at most %d names", maxBatchSize)
+	}
+	return unique, nil
+}
+
+// userKeys gets the keys of the analysed documents of the users.
+func userKeys(userIDs []int64) []*datastore.Key {
+	keys := make([]*datastore.Key, 0, len(userIDs))
+	for _, id := range userIDs {
+		keys = append(keys, datastore.IDKey(userKind, id, nil))
+	}
+	return keys
+}
+
+// getDocuments gets the analysed documents of the users. The returned bool is
+// false for users that have not been analysed yet.
+func getDocuments(ds *datastore.Client, userIDs []int64) ([]AnalysedDocument, []bool, error) {
+	docs, found := make([]AnalysedDocument, len(userIDs)), make([]bool, len(userIDs))
+	err := ds.GetMulti(context.Background(), userKeys(userIDs), docs)
+	multiErr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, nil, err
+	}
+	for i := range userIDs {
+		if !isMulti || multiErr[i] == nil {
+			found[i] = true
+		} else if _, mismatch := multiErr[i].(*datastore.ErrFieldMismatch); mismatch {
+			// the document was loaded, it just has fields this server does not
+			found[i] = true
+		} else if multiErr[i] != datastore.ErrNoSuchEntity {
+			return nil, nil, multiErr[i]
+		}
+	}
+	return docs, found, nil
+}
+
+// batchStatus gets the documents of the users in the batch that have been
+// analysed and the jobs of the ones that have not.
+func batchStatus(ds *datastore.Client, id int64, batch *Batch) (*BatchStatus, error) {
+	status := &BatchStatus{
+		ID:        id,
+		Owner:     batch.Owner,
+		Documents: make([]AnalysedDocument, 0, len(batch.UserIDs)),
+		NotFound:  batch.NotFound,
+		Failed:    batch.Failed,
+	}
+	if status.NotFound == nil {
+		status.NotFound = make([]string, 0)
+	}
+	if status.Failed == nil {
+		status.Failed = make([]SubmitFailure, 0)
+	}
+	docs, found, err := getDocuments(ds, batch.UserIDs)
+	if err != nil {
+		return nil, err
+	}
+	pendingKeys := make([]*datastore.Key, 0)
+	for i, userID := range batch.UserIDs {
+		if found[i] {
+			status.Documents = append(status.Documents, docs[i])
+		} else {
+			pendingKeys = append(pendingKeys, jobKey(userID))
+		}
+	}
+	status.Pending = make([]Job, len(pendingKeys))
+	if err := ds.GetMulti(context.Background(), pendingKeys, status.Pending); err != nil {
+		multiErr, ok := err.(datastore.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for i, err := range multiErr {
+			if err == datastore.ErrNoSuchEntity {
+				// the job has not been recorded yet, report it as queued
+				status.Pending[i] = Job{UserID: pendingKeys[i].ID, Status: jobStatusQueued}
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	status.Done = len(status.Pending) == 0
+	return status, nil
+}
+
+// submitBatch resolves the names, submits the users that have not been
+// analysed yet and stores the batch so that it can be polled. It fails before
+// submitting anything if the caller cannot submit every user that needs it,
+// after that the users that cannot be submitted are recorded as Failed and the
+// batch is stored anyway.
+func submitBatch(ctx context.Context, names []string, users *UserCache, ds *datastore.Client, topic *pubsub.Topic) (*BatchStatus, error) {
+	found, missing, err := users.GetMany(names)
+	if err != nil {
+		return nil, err
+	}
+	batch := &Batch{
+		Names:    names,
+		UserIDs:  make([]int64, 0, len(found)),
+		NotFound: missing,
+		Failed:   make([]SubmitFailure, 0),
+		Owner:    ownerFrom(ctx),
+		Created:  time.Now(),
+	}
+	ids := make([]int64, 0, len(found))
+	for _, user := range found {
+		ids = append(ids, user.ID)
+	}
+	_, analysed, err := getDocuments(ds, ids)
+	if err != nil {
+		return nil, err
+	}
+	unanalysed := 0
+	for i := range found {
+		if !analysed[i] {
+			unanalysed++
+		}
+	}
+	if err := checkSubmit(ctx, unanalysed, ds); err != nil {
+		return nil, err
+	}
+	for i, user := range found {
+		if !analysed[i] {
+			if _, _, err := submitJob(ctx, user.ScreenName, user.ID, ds, topic); err != nil {
+				batch.Failed = append(batch.Failed, submitFailure(ctx, user.ScreenName, err))
+				continue
+			}
+		}
+		batch.UserIDs = append(batch.UserIDs, user.ID)
+	}
+	key, err := ds.Put(context.Background(), datastore.IncompleteKey(batchKind, nil), batch)
+	if err != nil {
+		return nil, err
+	}
+	return batchStatus(ds, key.ID, batch)
+}
+
+// BatchHO returns a handler for batches of users. POST submits a JSON or CSV
+// list of names, the users that have been analysed are returned right away and
+// the rest are submitted to be analysed, with the ones that could not be listed
+// in Failed. GET polls the batch with the id
+// parameter.
+func BatchHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			batch := &Batch{}
+			if err := ds.Get(context.Background(), datastore.IDKey(batchKind, id, nil), batch); err != nil {
+				writeError("Batch", err, w)
+				return
+			}
+			status, err := batchStatus(ds, id, batch)
+			if err != nil {
+				writeError("Status", err, w)
+				return
+			}
+			writeJSON(status, w)
+		case http.MethodPost:
+			names, err := unmarshalNames(r)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			status, err := submitBatch(r.Context(), names, users, ds, topic)
+			if err != nil {
+				writeError("Submit", err, w)
+				return
+			}
+			writeJSON(status, w)
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSVNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		invalid bool
+	}{
+		{"one name per line", "alice\nbob\n", []string{"alice", "bob"}, false},
+		{"comma separated", "alice, bob,carol", []string{"alice", "bob", "carol"}, false},
+		{"a name header is skipped", "name\nalice\nbob", []string{"alice", "bob"}, false},
+		{"a screen_name header is skipped whatever its case", "Screen_Name\nalice", []string{"alice"}, false},
+		{"a header name later on is a name", "alice\nname", []string{"alice", "name"}, false},
+		{"empty fields and lines are skipped", "alice,,\n\n , bob\n", []string{"alice", "bob"}, false},
+		{"rows of different lengths", "alice\nbob,carol\n", []string{"alice", "bob", "carol"}, false},
+		{"an empty body", "", []string{}, false},
+		{"a quote that is never closed", "\"alice\nbob", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := parseCSVNames([]byte(test.body))
+			if test.invalid {
+				if _, ok := err.(*ValidationError); !ok {
+					t.Errorf("parseCSVNames(%q) = %v, want a ValidationError", test.body, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(names, test.want) {
+				t.Errorf("parseCSVNames(%q) = %q, %v, want %q", test.body, names, err, test.want)
+			}
+		})
+	}
+}
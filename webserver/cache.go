@@ -0,0 +1,276 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+type (
+	// CachedUser is the entity in the datastore that backs the user cache. It
+	// is keyed by the lower case screen name of the user.
+	CachedUser struct {
+		UserID         int64
+		ScreenName     string
+		Name           string
+		FollowersCount int
+		Verified       bool
+		Cached         time.Time
+	}
+
+	// cacheEntry is an element of the LRU list in a UserCache.
+	cacheEntry struct {
+		key     string
+		user    *twitter.User
+		expires time.Time
+	}
+
+	// UserCache is an in-memory LRU cache of Twitter users in front of the
+	// Twitter API, entries expire after ttl. Users are cached by both screen
+	// name and id. If ds is not nil then users that are not in memory are
+	// looked for in the datastore before the Twitter API is called.
+	UserCache struct {
+		client   *twitter.Client
+		ds       *datastore.Client
+		ttl      time.Duration
+		capacity int
+
+		mu      sync.Mutex
+		order   *list.List
+		entries map[string]*list.Element
+	}
+)
+
+const (
+	cachedUserKind = "CachedUser"
+
+	// userCacheSize is how many users are kept in memory.
+	userCacheSize = 10000
+	// userCacheTTL is how long a user is trusted before Twitter is asked
+	// again, screen names can change.
+	userCacheTTL = 24 * time.Hour
+)
+
+// NewUserCache creates a cache of users fetched with client. ds may be nil to
+// only cache in memory.
+func NewUserCache(client *twitter.Client, ds *datastore.Client, capacity int, ttl time.Duration) *UserCache {
+	return &UserCache{
+		client:   client,
+		ds:       ds,
+		ttl:      ttl,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// nameKey is the cache key for a screen name, screen names are not case
+// sensitive.
+func nameKey(screenName string) string {
+	return "name:" + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(screenName), "@"))
+}
+
+// idKey is the cache key for a user id.
+func idKey(id int64) string {
+	return "id:" + strconv.FormatInt(id, 10)
+}
+
+// get returns the user cached under key if there is one that has not expired.
+func (c *UserCache) get(key string) *twitter.User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.user
+}
+
+// put caches the user under key, evicting the least recently used entries if
+// the cache is full.
+func (c *UserCache) put(key string, user *twitter.User, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cacheEntry{key: key, user: user, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, user: user, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// remember caches the user in memory under both their screen name and id.
+func (c *UserCache) remember(user *twitter.User, cached time.Time) {
+	expires := cached.Add(c.ttl)
+	c.put(nameKey(user.ScreenName), user, expires)
+	c.put(idKey(user.ID), user, expires)
+}
+
+// load looks for a user with the screen name in the datastore.
+func (c *UserCache) load(screenName string) *twitter.User {
+	if c.ds == nil {
+		return nil
+	}
+	cached := &CachedUser{}
+	key := datastore.NameKey(cachedUserKind, strings.ToLower(screenName), nil)
+	if err := c.ds.Get(context.Background(), key, cached); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			logEntry(levelError, err.Error(), logFields{"location": "UserCache", "username": screenName})
+		}
+		return nil
+	}
+	if time.Since(cached.Cached) > c.ttl {
+		return nil
+	}
+	user := &twitter.User{
+		ID:             cached.UserID,
+		IDStr:          strconv.FormatInt(cached.UserID, 10),
+		ScreenName:     cached.ScreenName,
+		Name:           cached.Name,
+		FollowersCount: cached.FollowersCount,
+		Verified:       cached.Verified,
+	}
+	c.remember(user, cached.Cached)
+	return user
+}
+
+// save writes the user to the datastore if the cache is backed by it. Failing
+// to save is only logged, the user is still cached in memory.
+func (c *UserCache) save(user *twitter.User, cached time.Time) {
+	if c.ds == nil {
+		return
+	}
+	key := datastore.NameKey(cachedUserKind, strings.ToLower(user.ScreenName), nil)
+	_, err := c.ds.Put(context.Background(), key, &CachedUser{
+		UserID:         user.ID,
+		ScreenName:     user.ScreenName,
+		Name:           user.Name,
+		FollowersCount: user.FollowersCount,
+		Verified:       user.Verified,
+		Cached:         cached,
+	})
+	if err != nil {
+		logEntry(levelError, err.Error(), logFields{"location": "UserCache"})
+	}
+}
+
+// fetched caches a user that was just fetched from Twitter.
+func (c *UserCache) fetched(user *twitter.User) {
+	now := time.Now()
+	c.remember(user, now)
+	c.save(user, now)
+}
+
+// saveMany writes all of the users to the datastore in a single call if the
+// cache is backed by it.
+func (c *UserCache) saveMany(users []twitter.User, cached time.Time) {
+	if c.ds == nil || len(users) == 0 {
+		return
+	}
+	keys, entities := make([]*datastore.Key, 0, len(users)), make([]*CachedUser, 0, len(users))
+	for _, user := range users {
+		keys = append(keys, datastore.NameKey(cachedUserKind, strings.ToLower(user.ScreenName), nil))
+		entities = append(entities, &CachedUser{
+			UserID:         user.ID,
+			ScreenName:     user.ScreenName,
+			Name:           user.Name,
+			FollowersCount: user.FollowersCount,
+			Verified:       user.Verified,
+			Cached:         cached,
+		})
+	}
+	if _, err := c.ds.PutMulti(context.Background(), keys, entities); err != nil {
+		logEntry(levelError, err.Error(), logFields{"location": "UserCache"})
+	}
+}
+
+// GetMany gets the users with exactly the screen names. Users that are not in
+// memory are fetched from Twitter in bulk rather than looked for in the
+// datastore one at a time. The screen names that no user has are returned
+// separately.
+func (c *UserCache) GetMany(screenNames []string) ([]*twitter.User, []string, error) {
+	found := make(map[string]*twitter.User, len(screenNames))
+	misses := make([]string, 0)
+	for _, name := range screenNames {
+		if user := c.get(nameKey(name)); user != nil {
+			found[nameKey(name)] = user
+		} else {
+			misses = append(misses, strings.TrimPrefix(strings.TrimSpace(name), "@"))
+		}
+	}
+	for start := 0; start < len(misses); start += maxLookup {
+		end := start + maxLookup
+		if end > len(misses) {
+			end = len(misses)
+		}
+		users, err := lookupUsers(c.client, misses[start:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		now := time.Now()
+		for i := range users {
+			user := &users[i]
+			c.remember(user, now)
+			found[nameKey(user.ScreenName)] = user
+		}
+		c.saveMany(users, now)
+	}
+	users, missing := make([]*twitter.User, 0, len(found)), make([]string, 0)
+	for _, name := range screenNames {
+		if user, ok := found[nameKey(name)]; ok {
+			users = append(users, user)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	return users, missing, nil
+}
+
+// Get gets the user with exactly the screen name, from the cache if possible.
+// Misses are looked up with getUser, so a CandidatesError is returned when no
+// user has the screen name.
+func (c *UserCache) Get(screenName string) (*twitter.User, error) {
+	if user := c.get(nameKey(screenName)); user != nil {
+		return user, nil
+	}
+	if user := c.load(strings.TrimPrefix(strings.TrimSpace(screenName), "@")); user != nil {
+		return user, nil
+	}
+	user, err := getUser(c.client, screenName)
+	if err != nil {
+		return nil, err
+	}
+	c.fetched(user)
+	return user, nil
+}
+
+// GetByID gets the user with the id, from the cache if possible.
+func (c *UserCache) GetByID(id int64) (*twitter.User, error) {
+	if user := c.get(idKey(id)); user != nil {
+		return user, nil
+	}
+	user, err := getUserByID(c.client, id)
+	if err != nil {
+		return nil, err
+	}
+	c.fetched(user)
+	return user, nil
+}
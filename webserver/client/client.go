@@ -0,0 +1,215 @@
+// Package client is a typed client of the twitteranalytics API that is
+// described by the OpenAPI document at /api/v1/openapi.json, and of the gRPC
+// service that is served alongside it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Client calls the API at BaseURL with APIKey, or anonymously if it is
+	// empty. Requests that fail with a status that might pass, or with a
+	// network error for requests that are safe to send again, are retried up
+	// to MaxRetries times. The wait between attempts starts at RetryWait and
+	// doubles, unless the server says how long to wait with Retry-After.
+	Client struct {
+		BaseURL    string
+		APIKey     string
+		HTTPClient *http.Client
+		MaxRetries int
+		RetryWait  time.Duration
+	}
+
+	// Error is an error returned by the API. Candidates is only set when no
+	// user has the name that was asked for.
+	Error struct {
+		Status                   int
+		Code, Message, RequestID string
+		Candidates               []Candidate
+	}
+
+	// JobError is returned by the polling helpers when a job they are waiting
+	// on fails.
+	JobError struct {
+		Job Job
+	}
+)
+
+const (
+	apiPrefix = "/api/v1"
+
+	defaultMaxRetries = 3
+	defaultRetryWait  = 500 * time.Millisecond
+	// maxRetryWait is the longest the client waits between two attempts.
+	maxRetryWait = 30 * time.Second
+)
+
+// New creates a client of the API served at baseURL, for example
+// https://example.com, that authenticates with apiKey and uses the default
+// retry policy.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: time.Minute},
+		MaxRetries: defaultMaxRetries,
+		RetryWait:  defaultRetryWait,
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("twitteranalytics: %d %s: %s (request %s)", e.Status, e.Code, e.Message, e.RequestID)
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("twitteranalytics: the job analysing %s (%d) failed", e.Job.Username, e.Job.UserID)
+}
+
+// IsNotFound reports whether err is an Error for something that does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// retryable reports whether a request with the method that got the status can
+// be sent again. Requests that are not idempotent are only sent again when the
+// server refused them before doing anything.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == http.MethodGet || method == http.MethodDelete
+	}
+	return false
+}
+
+// retryAfter returns how long the Retry-After header of res says to wait, or
+// zero if it does not say.
+func retryAfter(res *http.Response) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// sleep waits for d, returning early with the context's error if it is done
+// first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeError reads the error the API sent in res.
+func decodeError(res *http.Response) error {
+	apiErr := &Error{Status: res.StatusCode, RequestID: res.Header.Get("X-Request-ID")}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+		// the error did not come from the API, for example from a proxy
+		apiErr.Code = http.StatusText(res.StatusCode)
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	apiErr.Status = res.StatusCode
+	return apiErr
+}
+
+// send makes a single attempt at the request. The returned duration is how
+// long to wait before trying again, and is only meaningful if the returned
+// bool says to try again.
+func (c *Client) send(ctx context.Context, method, u string, body []byte, dst interface{}) (bool, time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		// the request may have been handled before the connection failed
+		idempotent := method == http.MethodGet || method == http.MethodDelete
+		return idempotent && ctx.Err() == nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return retryable(method, res.StatusCode), retryAfter(res), decodeError(res)
+	}
+	if dst == nil {
+		return false, 0, nil
+	}
+	return false, 0, json.NewDecoder(res.Body).Decode(dst)
+}
+
+// do sends a request to the path under the API's prefix with the query and a
+// JSON body, if body is not nil, and decodes the JSON response into dst.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, dst interface{}) error {
+	u := c.BaseURL + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		retry, after, err := c.send(ctx, method, u, data, dst)
+		if err == nil || !retry || attempt >= c.MaxRetries {
+			return err
+		}
+		if after == 0 {
+			after = wait
+			wait *= 2
+		}
+		if after > maxRetryWait {
+			after = maxRetryWait
+		}
+		if err := sleep(ctx, after); err != nil {
+			return err
+		}
+	}
+}
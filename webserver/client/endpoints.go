@@ -0,0 +1,355 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPollInterval is how often the polling helpers check on a job
+	// when no interval is given.
+	defaultPollInterval = 5 * time.Second
+)
+
+// userQuery returns the parameters that identify a user, by id if it is not
+// zero and otherwise by name.
+func userQuery(name string, id int64) url.Values {
+	query := url.Values{}
+	if id != 0 {
+		query.Set("id", strconv.FormatInt(id, 10))
+	} else {
+		query.Set("name", name)
+	}
+	return query
+}
+
+// setInt sets the parameter to n if it is not zero.
+func setInt(query url.Values, key string, n int) {
+	if n != 0 {
+		query.Set(key, strconv.Itoa(n))
+	}
+}
+
+// Analyse gets the analysis of the user with the id, or if it is zero the
+// name. If the user has not been analysed yet then the job that is analysing
+// them is returned instead of a document.
+func (c *Client) Analyse(ctx context.Context, name string, id int64) (*Analysis, error) {
+	raw := json.RawMessage{}
+	if err := c.do(ctx, http.MethodGet, "/analyse", userQuery(name, id), nil, &raw); err != nil {
+		return nil, err
+	}
+	// a job is returned as a message with the job in it
+	pending := &struct {
+		Message string
+		Job     *Job
+	}{}
+	if err := json.Unmarshal(raw, pending); err != nil {
+		return nil, err
+	}
+	if pending.Job != nil {
+		return &Analysis{Message: pending.Message, Job: pending.Job}, nil
+	}
+	doc := &AnalysedDocument{}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	return &Analysis{Document: doc}, nil
+}
+
+// WaitForAnalysis gets the analysis of the user with the id, or if it is zero
+// the name, checking every interval until it is done. It stops when ctx is
+// done or the job fails.
+func (c *Client) WaitForAnalysis(ctx context.Context, name string, id int64, interval time.Duration) (*AnalysedDocument, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		analysis, err := c.Analyse(ctx, name, id)
+		if err != nil {
+			return nil, err
+		}
+		if analysis.Document != nil {
+			return analysis.Document, nil
+		}
+		if analysis.Job.Status == JobStatusFailed {
+			return nil, &JobError{Job: *analysis.Job}
+		}
+		// the job's user is known now, so later checks do not look them up
+		if analysis.Job.UserID != 0 {
+			id = analysis.Job.UserID
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SubmitBatch submits the names to be analysed together.
+func (c *Client) SubmitBatch(ctx context.Context, names []string) (*BatchStatus, error) {
+	status := &BatchStatus{}
+	body := struct{ Names []string }{Names: names}
+	return status, c.do(ctx, http.MethodPost, "/analyse/batch", nil, body, status)
+}
+
+// Batch gets the progress of the batch with the id.
+func (c *Client) Batch(ctx context.Context, id int64) (*BatchStatus, error) {
+	status := &BatchStatus{}
+	query := url.Values{"id": {strconv.FormatInt(id, 10)}}
+	return status, c.do(ctx, http.MethodGet, "/analyse/batch", query, nil, status)
+}
+
+// WaitForBatch gets the progress of the batch with the id, checking every
+// interval until every user in it has been analysed. It stops when ctx is done
+// or a job in the batch fails.
+func (c *Client) WaitForBatch(ctx context.Context, id int64, interval time.Duration) (*BatchStatus, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		status, err := c.Batch(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if status.Done {
+			return status, nil
+		}
+		for _, job := range status.Pending {
+			if job.Status == JobStatusFailed {
+				return status, &JobError{Job: job}
+			}
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Compare lines the users with the names up on the same metrics, in buckets of
+// bucket, day, week or month, over the last days. Empty values are left to the
+// server's defaults. If submit is true the users that have not been analysed
+// are submitted to be.
+func (c *Client) Compare(ctx context.Context, names []string, bucket string, days int, submit bool) (*Comparison, error) {
+	query := url.Values{"names": {strings.Join(names, ",")}}
+	if bucket != "" {
+		query.Set("bucket", bucket)
+	}
+	setInt(query, "days", days)
+	if submit {
+		query.Set("submit", "true")
+	}
+	comparison := &Comparison{}
+	return comparison, c.do(ctx, http.MethodGet, "/compare", query, nil, comparison)
+}
+
+// Tracked gets every tracked user.
+func (c *Client) Tracked(ctx context.Context) ([]Tracked, error) {
+	tracked := make([]Tracked, 0)
+	return tracked, c.do(ctx, http.MethodGet, "/tracked", nil, nil, &tracked)
+}
+
+// Track keeps the analysis of the user with the id, or if it is zero the name,
+// up to date by refreshing it every interval. A zero interval is left to the
+// server's default.
+func (c *Client) Track(ctx context.Context, name string, id int64, interval time.Duration) (*Tracked, error) {
+	query := userQuery(name, id)
+	setInt(query, "interval", int(interval/time.Minute))
+	tracked := &Tracked{}
+	return tracked, c.do(ctx, http.MethodPost, "/tracked", query, nil, tracked)
+}
+
+// Untrack stops tracking the user with the id, or if it is zero the name.
+func (c *Client) Untrack(ctx context.Context, name string, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/tracked", userQuery(name, id), nil, &message{})
+}
+
+// Webhooks gets every webhook.
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	webhooks := make([]Webhook, 0)
+	return webhooks, c.do(ctx, http.MethodGet, "/webhooks", nil, nil, &webhooks)
+}
+
+// CreateWebhook subscribes to the events in req.
+func (c *Client) CreateWebhook(ctx context.Context, req *WebhookRequest) (*Webhook, error) {
+	webhook := &Webhook{}
+	return webhook, c.do(ctx, http.MethodPost, "/webhooks", nil, req, webhook)
+}
+
+// DeleteWebhook removes the webhook with the id.
+func (c *Client) DeleteWebhook(ctx context.Context, id int64) error {
+	query := url.Values{"id": {strconv.FormatInt(id, 10)}}
+	return c.do(ctx, http.MethodDelete, "/webhooks", query, nil, &message{})
+}
+
+// Alerts gets a page of at most limit of the latest alerts, only for the user
+// with the id if it is not zero, starting from the cursor of a previous page if
+// it is not empty. A zero limit is left to the server's default.
+func (c *Client) Alerts(ctx context.Context, userID int64, limit int, cursor string) (*AlertsPage, error) {
+	query := url.Values{}
+	if userID != 0 {
+		query.Set("user", strconv.FormatInt(userID, 10))
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	setInt(query, "limit", limit)
+	page := &AlertsPage{}
+	return page, c.do(ctx, http.MethodGet, "/alerts", query, nil, page)
+}
+
+// AlertRules gets every alert rule.
+func (c *Client) AlertRules(ctx context.Context) ([]AlertRule, error) {
+	rules := make([]AlertRule, 0)
+	return rules, c.do(ctx, http.MethodGet, "/alerts/rules", nil, nil, &rules)
+}
+
+// CreateAlertRule saves the rule, its ID and Created are set by the server.
+func (c *Client) CreateAlertRule(ctx context.Context, rule *AlertRule) (*AlertRule, error) {
+	created := &AlertRule{}
+	return created, c.do(ctx, http.MethodPost, "/alerts/rules", nil, rule, created)
+}
+
+// DeleteAlertRule removes the alert rule with the id.
+func (c *Client) DeleteAlertRule(ctx context.Context, id int64) error {
+	query := url.Values{"id": {strconv.FormatInt(id, 10)}}
+	return c.do(ctx, http.MethodDelete, "/alerts/rules", query, nil, &message{})
+}
+
+// Groups gets every group ordered by name.
+func (c *Client) Groups(ctx context.Context) ([]Group, error) {
+	groups := make([]Group, 0)
+	return groups, c.do(ctx, http.MethodGet, "/groups", nil, nil, &groups)
+}
+
+// SaveGroup saves the group in req, replacing the caller's own group with the
+// same name.
+func (c *Client) SaveGroup(ctx context.Context, req *GroupRequest) (*SavedGroup, error) {
+	saved := &SavedGroup{}
+	return saved, c.do(ctx, http.MethodPost, "/groups", nil, req, saved)
+}
+
+// DeleteGroup removes the group with the name saved by owner, or by the
+// caller if owner is empty.
+func (c *Client) DeleteGroup(ctx context.Context, owner, name string) error {
+	return c.do(ctx, http.MethodDelete, "/groups", groupQuery(owner, name), nil, &message{})
+}
+
+// GroupStats gets the aggregate sentiment of the group with the name saved by
+// owner, or by the caller if owner is empty.
+func (c *Client) GroupStats(ctx context.Context, owner, name string) (*GroupStats, error) {
+	stats := &GroupStats{}
+	return stats, c.do(ctx, http.MethodGet, "/groups/stats", groupQuery(owner, name), nil, stats)
+}
+
+// groupQuery returns the query parameters of the group with the name saved by
+// owner.
+func groupQuery(owner, name string) url.Values {
+	query := url.Values{"name": {name}}
+	if owner != "" {
+		query.Set("owner", owner)
+	}
+	return query
+}
+
+// Leaderboard ranks at most limit users on the metric, average, positive or
+// negative, in the order, asc or desc, out of the users with at least
+// minTweets tweets. Empty values are left to the server's defaults.
+func (c *Client) Leaderboard(ctx context.Context, metric, order string, minTweets, limit int) (*Leaderboard, error) {
+	query := url.Values{}
+	if metric != "" {
+		query.Set("metric", metric)
+	}
+	if order != "" {
+		query.Set("order", order)
+	}
+	setInt(query, "min_tweets", minTweets)
+	setInt(query, "limit", limit)
+	leaderboard := &Leaderboard{}
+	return leaderboard, c.do(ctx, http.MethodGet, "/leaderboard", query, nil, leaderboard)
+}
+
+// Users gets a page of the analysed users that match q.
+func (c *Client) Users(ctx context.Context, q *UsersQuery) (*UsersPage, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"prefix": q.Prefix, "sort": q.Sort, "order": q.Order, "cursor": q.Cursor} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if q.MinScore != nil {
+		query.Set("min_score", strconv.FormatFloat(*q.MinScore, 'f', -1, 64))
+	}
+	if q.MaxScore != nil {
+		query.Set("max_score", strconv.FormatFloat(*q.MaxScore, 'f', -1, 64))
+	}
+	setInt(query, "limit", q.Limit)
+	page := &UsersPage{}
+	return page, c.do(ctx, http.MethodGet, "/users", query, nil, page)
+}
+
+// Suggest gets at most limit analysed users whose usernames start with prefix.
+// A zero limit is left to the server's default.
+func (c *Client) Suggest(ctx context.Context, prefix string, limit int) ([]IndexEntry, error) {
+	query := url.Values{"q": {prefix}}
+	setInt(query, "limit", limit)
+	entries := make([]IndexEntry, 0)
+	return entries, c.do(ctx, http.MethodGet, "/users/suggest", query, nil, &entries)
+}
+
+// Lookup gets the Twitter user with the id, or if it is zero the name.
+func (c *Client) Lookup(ctx context.Context, name string, id int64) (*Candidate, error) {
+	candidate := &Candidate{}
+	return candidate, c.do(ctx, http.MethodGet, "/users/lookup", userQuery(name, id), nil, candidate)
+}
+
+// DeleteUser deletes the analysis of the user with the id, or if it is zero
+// the name, and removes them from the name index. It needs an admin key.
+func (c *Client) DeleteUser(ctx context.Context, name string, id int64) (*DeletedUser, error) {
+	deleted := &DeletedUser{}
+	return deleted, c.do(ctx, http.MethodDelete, "/admin/users", userQuery(name, id), nil, deleted)
+}
+
+// Backfill submits at most limit of the users last analysed before the time to
+// be analysed again, starting from the cursor of the previous backfill if it
+// is not empty. A zero time is now and a zero limit is left to the server's
+// default. It needs an admin key.
+func (c *Client) Backfill(ctx context.Context, before time.Time, limit int, cursor string) (*Backfill, error) {
+	query := url.Values{}
+	if !before.IsZero() {
+		query.Set("before", before.Format(time.RFC3339))
+	}
+	setInt(query, "limit", limit)
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	result := &Backfill{}
+	return result, c.do(ctx, http.MethodPost, "/admin/backfill", query, nil, result)
+}
+
+// Reindex has the indexer rebuild the name index the next time it runs. It
+// needs an admin key.
+func (c *Client) Reindex(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/admin/reindex", nil, nil, &message{})
+}
+
+// Accounts gets every account. It needs an admin key.
+func (c *Client) Accounts(ctx context.Context) ([]Account, error) {
+	accounts := make([]Account, 0)
+	return accounts, c.do(ctx, http.MethodGet, "/admin/accounts", nil, nil, &accounts)
+}
+
+// SetRole gives the account with the username the role. It needs an admin key.
+func (c *Client) SetRole(ctx context.Context, username, role string) (*Account, error) {
+	account := &Account{}
+	query := url.Values{"username": {username}, "role": {role}}
+	return account, c.do(ctx, http.MethodPut, "/admin/accounts", query, nil, account)
+}
+
+// Health reports whether the API is up.
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/health", nil, nil, nil)
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"twitteranalytics/analyticspb"
+)
+
+type (
+	// GRPCClient calls the gRPC service of the webserver with an API key. It
+	// shares the connection it is given, which is left for the caller to
+	// close.
+	GRPCClient struct {
+		client analyticspb.AnalyticsClient
+		apiKey string
+	}
+
+	// AnalyseReply is the job analysing a user. Submitted is false if the
+	// request was collapsed onto a job that was already in flight.
+	AnalyseReply struct {
+		Job       *Job
+		Submitted bool
+	}
+
+	// JobEvent is a single message from WatchJob. A status event carries the
+	// Job, a done event the Document, and failed and timeout events a Message.
+	JobEvent struct {
+		Event    string
+		Job      *Job
+		Document *AnalysedDocument
+		Message  string
+	}
+
+	// JobStream is the stream of events about the job analysing a user.
+	JobStream struct {
+		stream analyticspb.Analytics_WatchJobClient
+	}
+)
+
+const (
+	// JobEventStatus, JobEventDone, JobEventFailed and JobEventTimeout are
+	// the events of a JobStream.
+	JobEventStatus  = "status"
+	JobEventDone    = "done"
+	JobEventFailed  = "failed"
+	JobEventTimeout = "timeout"
+)
+
+// NewGRPC creates a client of the gRPC service on conn that authenticates with
+// apiKey, or anonymously if it is empty.
+func NewGRPC(conn *grpc.ClientConn, apiKey string) *GRPCClient {
+	return &GRPCClient{client: analyticspb.NewAnalyticsClient(conn), apiKey: apiKey}
+}
+
+// withKey returns a copy of ctx that sends the API key with the call.
+func (c *GRPCClient) withKey(ctx context.Context) context.Context {
+	if c.apiKey == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "x-api-key", c.apiKey)
+}
+
+// fromPBTime converts ts to a time, unset stays the zero time.
+func fromPBTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// fromPBJob converts job from its message, nil stays nil.
+func fromPBJob(job *analyticspb.Job) *Job {
+	if job == nil {
+		return nil
+	}
+	return &Job{
+		Username:  job.Username,
+		UserID:    job.UserId,
+		Status:    job.Status,
+		Requested: fromPBTime(job.Requested),
+		Updated:   fromPBTime(job.Updated),
+	}
+}
+
+// fromPBDocument converts doc from its message, nil stays nil.
+func fromPBDocument(doc *analyticspb.AnalysedDocument) *AnalysedDocument {
+	if doc == nil {
+		return nil
+	}
+	days := make([]DayBucket, len(doc.Days))
+	for i, day := range doc.Days {
+		days[i] = DayBucket{Day: fromPBTime(day.Day), PositiveTweets: int(day.PositiveTweets), NegativeTweets: int(day.NegativeTweets)}
+	}
+	return &AnalysedDocument{
+		Username:        doc.Username,
+		UserID:          doc.UserId,
+		LastTweetID:     doc.LastTweetId,
+		EarliestTweetID: doc.EarliestTweetId,
+		PositiveTweets:  int(doc.PositiveTweets),
+		NegativeTweets:  int(doc.NegativeTweets),
+		AverageScore:    doc.AverageScore,
+		Days:            days,
+		LastAnalysed:    fromPBTime(doc.LastAnalysed),
+	}
+}
+
+// pbScore converts a bound on the score to its message, nil stays unset.
+func pbScore(score *float64) *wrapperspb.DoubleValue {
+	if score == nil {
+		return nil
+	}
+	return wrapperspb.Double(*score)
+}
+
+// Analyse submits the user with the id, or if it is zero the name, to be
+// analysed even if they have been before.
+func (c *GRPCClient) Analyse(ctx context.Context, name string, id int64) (*AnalyseReply, error) {
+	reply, err := c.client.Analyse(c.withKey(ctx), &analyticspb.UserRequest{Username: name, UserId: id})
+	if err != nil {
+		return nil, err
+	}
+	return &AnalyseReply{Job: fromPBJob(reply.Job), Submitted: reply.Submitted}, nil
+}
+
+// GetAnalysis gets the analysis of the user with the id, or if it is zero the
+// name. If the user has not been analysed yet then the job that is analysing
+// them is returned instead of a document.
+func (c *GRPCClient) GetAnalysis(ctx context.Context, name string, id int64) (*Analysis, error) {
+	reply, err := c.client.GetAnalysis(c.withKey(ctx), &analyticspb.UserRequest{Username: name, UserId: id})
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Document: fromPBDocument(reply.Document), Message: reply.Message, Job: fromPBJob(reply.Job)}, nil
+}
+
+// ListUsers gets a page of the analysed users that match q.
+func (c *GRPCClient) ListUsers(ctx context.Context, q *UsersQuery) (*UsersPage, error) {
+	req := &analyticspb.ListUsersRequest{
+		Prefix:   q.Prefix,
+		Sort:     q.Sort,
+		Order:    q.Order,
+		MinScore: pbScore(q.MinScore),
+		MaxScore: pbScore(q.MaxScore),
+		Cursor:   q.Cursor,
+		Limit:    int32(q.Limit),
+	}
+	reply, err := c.client.ListUsers(c.withKey(ctx), req)
+	if err != nil {
+		return nil, err
+	}
+	page := &UsersPage{Users: make([]UserSummary, len(reply.Users)), Cursor: reply.Cursor}
+	for i, user := range reply.Users {
+		page.Users[i] = UserSummary{
+			Username:       user.Username,
+			UserID:         user.UserId,
+			PositiveTweets: int(user.PositiveTweets),
+			NegativeTweets: int(user.NegativeTweets),
+			AverageScore:   user.AverageScore,
+			LastAnalysed:   fromPBTime(user.LastAnalysed),
+		}
+	}
+	return page, nil
+}
+
+// WatchJob opens a stream of the changes to the job analysing the user with the
+// id, or if it is zero the name. The stream ends after a done, failed or
+// timeout event.
+func (c *GRPCClient) WatchJob(ctx context.Context, name string, id int64) (*JobStream, error) {
+	stream, err := c.client.WatchJob(c.withKey(ctx), &analyticspb.UserRequest{Username: name, UserId: id})
+	if err != nil {
+		return nil, err
+	}
+	return &JobStream{stream: stream}, nil
+}
+
+// Recv gets the next event, it returns io.EOF once the stream has ended.
+func (s *JobStream) Recv() (*JobEvent, error) {
+	event, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return &JobEvent{Event: event.Event, Job: fromPBJob(event.Job), Document: fromPBDocument(event.Document), Message: event.Message}, nil
+}
@@ -0,0 +1,297 @@
+package client
+
+import "time"
+
+type (
+	// Candidate is a Twitter user that a name could refer to.
+	Candidate struct {
+		UserID           int64
+		ScreenName, Name string
+		FollowersCount   int
+		Verified         bool
+	}
+
+	// DayBucket holds the sentiment counts of the tweets a user made on Day.
+	DayBucket struct {
+		Day                            time.Time
+		PositiveTweets, NegativeTweets int
+	}
+
+	// AnalysedDocument is the analysis of a user's tweets.
+	AnalysedDocument struct {
+		Username                             string
+		UserID, LastTweetID, EarliestTweetID int64
+		TweetScores                          []int
+		PositiveTweets, NegativeTweets       int
+		AverageScore                         float64
+		Days                                 []DayBucket
+		SearchName                           string
+		LastAnalysed                         time.Time
+	}
+
+	// Job is a request to analyse a user as it moves through the pipeline.
+	Job struct {
+		Username           string
+		UserID             int64
+		Status             string
+		Requested, Updated time.Time
+	}
+
+	// Analysis is the answer to a request for a user's analysis. Document is
+	// set if the user has been analysed, otherwise Job is the job that is
+	// analysing them.
+	Analysis struct {
+		Document *AnalysedDocument
+		Message  string
+		Job      *Job
+	}
+
+	// BatchStatus is the progress of a batch of users. Failed holds the users
+	// that could not be submitted to be analysed.
+	BatchStatus struct {
+		ID        int64
+		Owner     string
+		Done      bool
+		Documents []AnalysedDocument
+		Pending   []Job
+		NotFound  []string
+		Failed    []SubmitFailure
+	}
+
+	// SubmitFailure is a user that could not be submitted to be analysed, with
+	// the Code and Message of the error it failed with.
+	SubmitFailure struct {
+		Name, Code, Message string
+	}
+
+	// BucketMetrics are the sentiment metrics of a user's tweets in a single
+	// time bucket. AverageScore is nil if there were no tweets in the bucket.
+	BucketMetrics struct {
+		PositiveTweets, NegativeTweets int
+		AverageScore                   *float64
+	}
+
+	// ComparedUser is a single user in a comparison. Status is pending if
+	// they have not been analysed, Failure is set if they could not be
+	// submitted to be.
+	ComparedUser struct {
+		Username                       string
+		UserID                         int64
+		Analysed                       bool
+		Status                         string
+		PositiveTweets, NegativeTweets int
+		AverageScore, PositiveShare    float64
+		Series                         []BucketMetrics
+		Job                            *Job
+		Failure                        *SubmitFailure
+	}
+
+	// Comparison lines users up on the same metrics and time buckets.
+	Comparison struct {
+		Bucket   string
+		Buckets  []time.Time
+		Users    []ComparedUser
+		NotFound []string
+	}
+
+	// Tracked is a user whose analysis is kept up to date. Owner is the
+	// account that tracked them from the frontend, if any.
+	Tracked struct {
+		Username       string
+		UserID         int64
+		RefreshMinutes int64
+		LastRefreshed  time.Time
+		Owner          string
+	}
+
+	// Webhook is a subscription to events about analysed users.
+	Webhook struct {
+		ID        int64
+		URL       string
+		Events    []string
+		UserIDs   []int64
+		Threshold float64
+		Created   time.Time
+	}
+
+	// WebhookRequest is what a webhook is created from.
+	WebhookRequest struct {
+		URL, Secret string
+		Events      []string
+		UserIDs     []int64
+		Threshold   float64
+	}
+
+	// AlertRule is a condition on a user's sentiment that is checked every
+	// time the user is analysed. Owner is the account that created it from
+	// the frontend, if any.
+	AlertRule struct {
+		ID         int64
+		Name       string
+		UserIDs    []int64
+		Metric     string
+		Comparison string
+		Threshold  float64
+		WindowDays int
+		Created    time.Time
+		Owner      string
+	}
+
+	// Alert is recorded every time a rule starts firing for a user. Owner is
+	// copied from the rule.
+	Alert struct {
+		ID                 int64
+		RuleID             int64
+		RuleName           string
+		UserID             int64
+		Username           string
+		Metric, Comparison string
+		Value, Threshold   float64
+		WindowDays         int
+		Message            string
+		Triggered          time.Time
+		Owner              string
+	}
+
+	// Group is a saved, named list of users. Owner is the account that saved
+	// it from the frontend, if any.
+	Group struct {
+		Name             string
+		Description      string
+		Members          []string
+		UserIDs          []int64
+		Created, Updated time.Time
+		Owner            string
+	}
+
+	// GroupRequest is what a group is saved from.
+	GroupRequest struct {
+		Name, Description string
+		Members           []string
+	}
+
+	// SavedGroup is the answer to saving a group, NotFound holds the members
+	// that no Twitter user has and Failed the ones that could not be submitted
+	// to be analysed.
+	SavedGroup struct {
+		Group    *Group
+		NotFound []string
+		Failed   []SubmitFailure
+	}
+
+	// GroupMember is the analysis of a single member of a group.
+	GroupMember struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore, ZScore           float64
+	}
+
+	// HistogramBin counts the members whose AverageScore is in [Low, High).
+	HistogramBin struct {
+		Low, High float64
+		Count     int
+	}
+
+	// GroupStats is the aggregate sentiment of a group.
+	GroupStats struct {
+		Name                                            string
+		Members, Analysed                               int
+		PositiveTweets, NegativeTweets                  int
+		AverageScore                                    float64
+		MeanMemberScore, MedianMemberScore, StdDevScore float64
+		Distribution                                    []HistogramBin
+		Outliers                                        []GroupMember
+		Scores                                          []GroupMember
+		Pending                                         []string
+	}
+
+	// UserSummary is a single analysed user in a page of users.
+	UserSummary struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore                   float64
+		LastAnalysed                   time.Time
+	}
+
+	// AlertsPage is a page of alerts, newest first. Cursor is passed back to
+	// get the next page, it is empty when there are no more alerts.
+	AlertsPage struct {
+		Alerts []Alert
+		Cursor string
+	}
+
+	// UsersPage is a page of analysed users. Cursor is passed back to get the
+	// next page, it is empty when there are no more users.
+	UsersPage struct {
+		Users  []UserSummary
+		Cursor string
+	}
+
+	// UsersQuery is what a page of users is searched for with. Empty fields
+	// are left to the server's defaults and nil scores are not bounded.
+	UsersQuery struct {
+		Prefix             string
+		Sort, Order        string
+		MinScore, MaxScore *float64
+		Cursor             string
+		Limit              int
+	}
+
+	// IndexEntry is a suggested user.
+	IndexEntry struct {
+		Username string
+		UserID   int64
+	}
+
+	// LeaderboardEntry is a single user on a leaderboard.
+	LeaderboardEntry struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore                   float64
+	}
+
+	// Leaderboard is a ranking of users.
+	Leaderboard struct {
+		Metric, Order string
+		MinTweets     int
+		Generated     time.Time
+		Users         []LeaderboardEntry
+	}
+
+	// Account is a person that signs in to the frontend. Role is viewer,
+	// analyst or admin.
+	Account struct {
+		Username string
+		Role     string
+		Created  time.Time
+	}
+
+	// DeletedUser is a user that an admin deleted. Objects is how many of
+	// their tweet documents were deleted.
+	DeletedUser struct {
+		Username string
+		UserID   int64
+		Objects  int
+	}
+
+	// Backfill is the jobs a backfill started, and the ones that were already
+	// running. Cursor is empty on the last page.
+	Backfill struct {
+		Submitted, InFlight []Job
+		Cursor              string
+	}
+
+	// message is the body of responses that only say what happened.
+	message struct {
+		Message string
+	}
+)
+
+const (
+	// JobStatusDone and JobStatusFailed are the statuses a job ends in.
+	JobStatusDone   = "done"
+	JobStatusFailed = "failed"
+)
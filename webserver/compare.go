@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+type (
+	// BucketMetrics are the sentiment metrics of a user's tweets in a single
+	// time bucket. AverageScore is nil if there were no tweets in the bucket.
+	BucketMetrics struct {
+		PositiveTweets, NegativeTweets int
+		AverageScore                   *float64
+	}
+
+	// ComparedUser is a single user in a comparison. Series holds the metrics
+	// of the user for each of the comparison's buckets. If the user has not
+	// been analysed yet then Analysed is false, Status is pending and Job is
+	// their job, if they have one. Failure is set if they could not be
+	// submitted to be analysed.
+	ComparedUser struct {
+		Username                       string
+		UserID                         int64
+		Analysed                       bool
+		Status                         string
+		PositiveTweets, NegativeTweets int
+		AverageScore, PositiveShare    float64
+		Series                         []BucketMetrics
+		Job                            *Job           `json:",omitempty"`
+		Failure                        *SubmitFailure `json:",omitempty"`
+	}
+
+	// Comparison lines users up on the same metrics and time buckets. Buckets
+	// holds the start of each bucket, from the earliest to the latest.
+	Comparison struct {
+		Bucket   string
+		Buckets  []time.Time
+		Users    []ComparedUser
+		NotFound []string
+	}
+)
+
+const (
+	bucketDay   = "day"
+	bucketWeek  = "week"
+	bucketMonth = "month"
+
+	comparedAnalysed = "analysed"
+	comparedPending  = "pending"
+
+	// minCompare and maxCompare bound how many users can be compared at once.
+	minCompare = 2
+	maxCompare = 10
+	// defaultCompareDays is how far back a comparison goes by default.
+	defaultCompareDays = 90
+	// maxCompareDays is the furthest back a comparison can go.
+	maxCompareDays = 5 * 365
+)
+
+// bucketStart returns the start of the bucket that t falls in.
+func bucketStart(t time.Time, bucket string) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	switch bucket {
+	case bucketWeek:
+		// weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case bucketMonth:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// nextBucket returns the start of the bucket after the one starting at start.
+func nextBucket(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case bucketWeek:
+		return start.AddDate(0, 0, 7)
+	case bucketMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// buckets returns the start of every bucket from the one containing from up to
+// and including the one containing to.
+func buckets(from, to time.Time, bucket string) []time.Time {
+	starts := make([]time.Time, 0)
+	for start := bucketStart(from, bucket); !start.After(to); start = nextBucket(start, bucket) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// series sums the days of doc into the buckets.
+func series(doc *AnalysedDocument, starts []time.Time, bucket string) []BucketMetrics {
+	metrics := make([]BucketMetrics, len(starts))
+	index := make(map[time.Time]int, len(starts))
+	for i, start := range starts {
+		index[start] = i
+	}
+	for _, day := range doc.Days {
+		i, ok := index[bucketStart(day.Day, bucket)]
+		if !ok {
+			continue
+		}
+		metrics[i].PositiveTweets += day.PositiveTweets
+		metrics[i].NegativeTweets += day.NegativeTweets
+	}
+	for i := range metrics {
+		if total := metrics[i].PositiveTweets + metrics[i].NegativeTweets; total > 0 {
+			average := float64(metrics[i].PositiveTweets-metrics[i].NegativeTweets) / float64(total)
+			metrics[i].AverageScore = &average
+		}
+	}
+	return metrics
+}
+
+// positiveShare returns the share of the user's tweets that were positive.
+func positiveShare(doc *AnalysedDocument) float64 {
+	if total := doc.PositiveTweets + doc.NegativeTweets; total > 0 {
+		return float64(doc.PositiveTweets) / float64(total)
+	}
+	return 0
+}
+
+// unmarshalCompare gets the names, bucket size and number of days to compare
+// from the query parameters.
+func unmarshalCompare(values url.Values) ([]string, string, int, error) {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(values.Get("names"), ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) < minCompare || len(names) > maxCompare {
+		return nil, "", 0, invalid("between %d and %d names must be compared", minCompare, maxCompare)
+	}
+	bucket, days, err := unmarshalBuckets(values)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return names, bucket, days, nil
+}
+
+// unmarshalBuckets gets the bucket size and number of days to break a user's
+// tweets down over from the query parameters.
+func unmarshalBuckets(values url.Values) (string, int, error) {
+	bucket := values.Get("bucket")
+	if bucket == "" {
+		bucket = bucketWeek
+	} else if bucket != bucketDay && bucket != bucketWeek && bucket != bucketMonth {
+		return "", 0, invalid("bucket must be %s, %s or %s", bucketDay, bucketWeek, bucketMonth)
+	}
+	days := defaultCompareDays
+	if d := values.Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return "", 0, err
+		}
+		if n < 1 || n > maxCompareDays {
+			return "", 0, invalid("days must be between 1 and %d", maxCompareDays)
+		}
+		days = n
+	}
+	return bucket, days, nil
+}
+
+// recentBuckets returns the start of every bucket in the last days days.
+func recentBuckets(days int, bucket string) []time.Time {
+	now := time.Now()
+	return buckets(now.AddDate(0, 0, -days+1), now, bucket)
+}
+
+// currentJob returns the job for the user with userID, it is nil if they do not
+// have one.
+func currentJob(ds *datastore.Client, userID int64) (*Job, error) {
+	job := &Job{}
+	if err := ds.Get(context.Background(), jobKey(userID), job); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// compare builds a comparison of the users with the names over the last days
+// days. Users that have not been analysed yet are pending, if submit is true
+// they are also submitted to be analysed as long as the caller may submit all
+// of them. Users that cannot be submitted have a Failure rather than failing
+// the comparison.
+func compare(ctx context.Context, names []string, bucket string, days int, submit bool, users *UserCache, ds *datastore.Client, topic *pubsub.Topic) (*Comparison, error) {
+	found, missing, err := users.GetMany(names)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(found))
+	for _, user := range found {
+		ids = append(ids, user.ID)
+	}
+	docs, analysed, err := getDocuments(ds, ids)
+	if err != nil {
+		return nil, err
+	}
+	comparison := &Comparison{
+		Bucket:   bucket,
+		Buckets:  recentBuckets(days, bucket),
+		Users:    make([]ComparedUser, 0, len(found)),
+		NotFound: missing,
+	}
+	var submitErr error
+	if submit {
+		pending := 0
+		for i := range found {
+			if !analysed[i] {
+				pending++
+			}
+		}
+		submitErr = checkSubmit(ctx, pending, ds)
+	}
+	for i, user := range found {
+		compared := ComparedUser{
+			Username: user.ScreenName,
+			UserID:   user.ID,
+			Analysed: analysed[i],
+			Status:   comparedAnalysed,
+		}
+		if analysed[i] {
+			doc := &docs[i]
+			compared.PositiveTweets, compared.NegativeTweets = doc.PositiveTweets, doc.NegativeTweets
+			compared.AverageScore = doc.AverageScore
+			compared.PositiveShare = positiveShare(doc)
+			compared.Series = series(doc, comparison.Buckets, bucket)
+			comparison.Users = append(comparison.Users, compared)
+			continue
+		}
+		compared.Status = comparedPending
+		compared.Series = make([]BucketMetrics, len(comparison.Buckets))
+		switch {
+		case submit && submitErr == nil:
+			if compared.Job, _, err = submitJob(ctx, user.ScreenName, user.ID, ds, topic); err != nil {
+				failure := submitFailure(ctx, user.ScreenName, err)
+				compared.Failure = &failure
+			}
+		case submit:
+			failure := submitFailure(ctx, user.ScreenName, submitErr)
+			compared.Failure = &failure
+		default:
+			if compared.Job, err = currentJob(ds, user.ID); err != nil {
+				return nil, err
+			}
+		}
+		comparison.Users = append(comparison.Users, compared)
+	}
+	return comparison, nil
+}
+
+// unmarshalSubmit reads the submit parameter, which asks for the users that
+// have not been analysed to be submitted.
+func unmarshalSubmit(values url.Values) (bool, error) {
+	switch values.Get("submit") {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	}
+	return false, invalid("submit must be true or false")
+}
+
+// CompareHO returns a handler that compares the users in the comma separated
+// names parameter side by side. The bucket parameter sets the size of the time
+// buckets (day, week or month), days sets how far back they go and submit=true
+// submits the users that have not been analysed.
+func CompareHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		names, bucket, days, err := unmarshalCompare(r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		submit, err := unmarshalSubmit(r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		comparison, err := compare(r.Context(), names, bucket, days, submit, users, ds, topic)
+		if err != nil {
+			writeError("Compare", err, w)
+			return
+		}
+		writeJSON(comparison, w)
+	}
+}
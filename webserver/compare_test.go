@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// date returns midnight UTC on the day.
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestBuckets(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to time.Time
+		bucket   string
+		want     []time.Time
+	}{
+		{"days include both ends", date(2021, 3, 1).Add(15 * time.Hour), date(2021, 3, 3).Add(time.Hour), bucketDay,
+			[]time.Time{date(2021, 3, 1), date(2021, 3, 2), date(2021, 3, 3)}},
+		{"weeks start on Monday", date(2021, 3, 3), date(2021, 3, 15), bucketWeek,
+			[]time.Time{date(2021, 3, 1), date(2021, 3, 8), date(2021, 3, 15)}},
+		{"a Sunday is in the week before it", date(2021, 3, 7), date(2021, 3, 7), bucketWeek,
+			[]time.Time{date(2021, 3, 1)}},
+		{"months start on the first", date(2020, 12, 31), date(2021, 2, 1), bucketMonth,
+			[]time.Time{date(2020, 12, 1), date(2021, 1, 1), date(2021, 2, 1)}},
+		{"from after to", date(2021, 3, 2), date(2021, 3, 1), bucketDay, []time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := buckets(test.from, test.to, test.bucket); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("buckets() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	doc := &AnalysedDocument{Days: []DayBucket{
+		{Day: date(2021, 2, 28), PositiveTweets: 9, NegativeTweets: 9},
+		{Day: date(2021, 3, 1), PositiveTweets: 3, NegativeTweets: 1},
+		{Day: date(2021, 3, 2), PositiveTweets: 1, NegativeTweets: 3},
+		{Day: date(2021, 3, 9), PositiveTweets: 0, NegativeTweets: 2},
+	}}
+	score := func(average float64) *float64 { return &average }
+	tests := []struct {
+		name   string
+		starts []time.Time
+		bucket string
+		want   []BucketMetrics
+	}{
+		{"days outside the buckets are left out", []time.Time{date(2021, 3, 1), date(2021, 3, 2), date(2021, 3, 3)}, bucketDay, []BucketMetrics{
+			{PositiveTweets: 3, NegativeTweets: 1, AverageScore: score(0.5)},
+			{PositiveTweets: 1, NegativeTweets: 3, AverageScore: score(-0.5)},
+			{},
+		}},
+		{"days are summed into weeks", []time.Time{date(2021, 3, 1), date(2021, 3, 8)}, bucketWeek, []BucketMetrics{
+			{PositiveTweets: 4, NegativeTweets: 4, AverageScore: score(0)},
+			{PositiveTweets: 0, NegativeTweets: 2, AverageScore: score(-1)},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := series(doc, test.starts, test.bucket); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("series() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// APIError is an error that is reported to the caller with Status and
+	// Code instead of the ones classify would give it.
+	APIError struct {
+		Status int
+		Code   string
+		Err    error
+	}
+
+	// ValidationError is an error in what the caller sent, it is reported
+	// with a 400.
+	ValidationError struct {
+		Err error
+	}
+
+	// ErrorResponse is the JSON body that every error is returned in.
+	// Candidates is only set when no user has the name that was asked for.
+	ErrorResponse struct {
+		Code, Message, RequestID string
+		Candidates               []Candidate `json:",omitempty"`
+	}
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength is the longest request id that is accepted from the
+	// caller, longer ones are replaced.
+	maxRequestIDLength = 64
+
+	codeBadRequest       = "bad_request"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeRateLimited      = "rate_limited"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeUpstream         = "upstream_error"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+
+	// internalMessage is the message of errors that were not expected, their
+	// own messages can describe the server and are only logged.
+	internalMessage = "something went wrong, try again later"
+
+	// twitterRateLimited is the Twitter API error code for a rate limit.
+	twitterRateLimited = 88
+)
+
+func (e *APIError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// invalid returns a ValidationError with the formatted message.
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Err: fmt.Errorf(format, args...)}
+}
+
+// classify returns the status and code that err is reported with. Errors from
+// Twitter and the Google APIs are mapped from their own codes, what the caller
+// sent is only blamed for ValidationErrors and errors parsing numbers, times
+// and JSON, and everything else is an internal error.
+func classify(err error) (int, string) {
+	// this has to come first because it is also a net.Error
+	if err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable, codeUnavailable
+	}
+	switch e := err.(type) {
+	case *APIError:
+		return e.Status, e.Code
+	case *ValidationError, *strconv.NumError, *time.ParseError, *json.SyntaxError, *json.UnmarshalTypeError:
+		return http.StatusBadRequest, codeBadRequest
+	case *CandidatesError:
+		return http.StatusNotFound, codeNotFound
+	case twitter.APIError:
+		if isNotFound(err) || hasErrorCode(err, twitterNoMatches) {
+			return http.StatusNotFound, codeNotFound
+		}
+		if hasErrorCode(err, twitterRateLimited) {
+			return http.StatusTooManyRequests, codeRateLimited
+		}
+		return http.StatusBadGateway, codeUpstream
+	case net.Error:
+		return http.StatusBadGateway, codeUpstream
+	}
+	if err == datastore.ErrNoSuchEntity || err == storage.ErrObjectNotExist {
+		return http.StatusNotFound, codeNotFound
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the JSON body was empty or cut short
+		return http.StatusBadRequest, codeBadRequest
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.NotFound:
+			return http.StatusNotFound, codeNotFound
+		case codes.ResourceExhausted:
+			return http.StatusTooManyRequests, codeRateLimited
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return http.StatusServiceUnavailable, codeUnavailable
+		case codes.InvalidArgument:
+			return http.StatusBadRequest, codeBadRequest
+		}
+		return http.StatusBadGateway, codeUpstream
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// publicMessage returns the message err is reported to the caller with, which
+// is internalMessage for errors that were not expected.
+func publicMessage(err error, code string) string {
+	if _, ok := err.(*APIError); !ok && code == codeInternal {
+		return internalMessage
+	}
+	return err.Error()
+}
+
+// writeErrorResponse sends body to the caller with the status.
+func writeErrorResponse(body *ErrorResponse, status int, w http.ResponseWriter) {
+	body.RequestID = w.Header().Get(requestIDHeader)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError reports err to the caller with the status classify gives it.
+// location is where the error happened, it is logged for server errors.
+func writeError(location string, err error, w http.ResponseWriter) {
+	status, code := classify(err)
+	if status >= http.StatusInternalServerError {
+		logEntry(levelError, err.Error(), logFields{"location": location, "request_id": w.Header().Get(requestIDHeader)})
+	}
+	writeErrorResponse(&ErrorResponse{Code: code, Message: publicMessage(err, code)}, status, w)
+}
+
+// notAllowed reports that the request used a method other than the allowed
+// ones.
+func notAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	message := r.URL.Path + " only accepts " + strings.Join(allowed, ", ") + " requests"
+	writeErrorResponse(&ErrorResponse{Code: codeMethodNotAllowed, Message: message}, http.StatusMethodNotAllowed, w)
+}
+
+// requestID returns the id the caller gave the request, or a new random one if
+// it did not give a usable one.
+func requestID(r *http.Request) string {
+	return checkRequestID(r.Header.Get(requestIDHeader))
+}
+
+// checkRequestID returns id if it can be used as a request id, otherwise a new
+// random one.
+func checkRequestID(id string) string {
+	if id != "" && len(id) <= maxRequestIDLength && !strings.ContainsAny(id, "\r\n") {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logEntry(levelError, "could not make a request id: "+err.Error(), logFields{"location": "RequestID"})
+	}
+	return hex.EncodeToString(b)
+}
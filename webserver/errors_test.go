@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassify(t *testing.T) {
+	_, numErr := strconv.Atoi("ten")
+	_, timeErr := time.Parse(time.RFC3339, "yesterday")
+	syntaxErr := json.Unmarshal([]byte("{"), &struct{}{})
+	typeErr := json.Unmarshal([]byte(`{"Limit": "ten"}`), &struct{ Limit int }{})
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"an APIError keeps its status", &APIError{Status: http.StatusConflict, Code: codeConflict, Err: errors.New("taken")}, http.StatusConflict, codeConflict},
+		{"a validation error", invalid("limit must be positive"), http.StatusBadRequest, codeBadRequest},
+		{"a number that cannot be parsed", numErr, http.StatusBadRequest, codeBadRequest},
+		{"a time that cannot be parsed", timeErr, http.StatusBadRequest, codeBadRequest},
+		{"JSON that cannot be parsed", syntaxErr, http.StatusBadRequest, codeBadRequest},
+		{"JSON of the wrong type", typeErr, http.StatusBadRequest, codeBadRequest},
+		{"an empty body", io.EOF, http.StatusBadRequest, codeBadRequest},
+		{"candidates", &CandidatesError{}, http.StatusNotFound, codeNotFound},
+		{"a missing entity", datastore.ErrNoSuchEntity, http.StatusNotFound, codeNotFound},
+		{"a deadline", context.DeadlineExceeded, http.StatusServiceUnavailable, codeUnavailable},
+		{"an unavailable Google API", status.Error(codes.Unavailable, "down"), http.StatusServiceUnavailable, codeUnavailable},
+		{"another Google API error", status.Error(codes.Internal, "broken"), http.StatusBadGateway, codeUpstream},
+		{"an unexpected error", errors.New("datastore: invalid entity type"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, code := classify(test.err)
+			if status != test.status || code != test.code {
+				t.Errorf("classify(%v) = %d, %s, want %d, %s", test.err, status, code, test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestPublicMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"a validation error", invalid("limit must be positive"), "limit must be positive"},
+		{"an internal APIError", &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Err: errors.New("streaming is not supported")}, "streaming is not supported"},
+		{"an unexpected error", errors.New("datastore: invalid entity type"), internalMessage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, code := classify(test.err)
+			if got := publicMessage(test.err, code); got != test.want {
+				t.Errorf("publicMessage() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -8,9 +8,13 @@ require (
 	cloud.google.com/go/storage v1.15.0
 	github.com/dghubble/go-twitter v0.0.0-20201011215211-4b180d0cc78d
 	github.com/dghubble/oauth1 v0.7.0
+	github.com/go-redis/redis/v8 v8.11.0
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	github.com/graphql-go/graphql v0.8.0
+	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20210414194228-064579744ee0 // indirect
-	golang.org/x/oauth2 v0.0.0-20210413134643-5e61552d6c78 // indirect
-	golang.org/x/sys v0.0.0-20210414055047-fe65e336abe0 // indirect
-	google.golang.org/grpc v1.37.0 // indirect
+	google.golang.org/api v0.45.0
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.26.0
 )
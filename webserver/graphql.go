@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+type (
+	// TimeBucket is the sentiment of a user's tweets in the time bucket that
+	// starts at Start. AverageScore is nil if there were no tweets in it.
+	TimeBucket struct {
+		Start                          time.Time
+		PositiveTweets, NegativeTweets int
+		AverageScore                   *float64
+	}
+
+	// GraphQLRequest is a GraphQL query, it is the body of a POST or the
+	// parameters of a GET.
+	GraphQLRequest struct {
+		Query         string
+		OperationName string
+		Variables     map[string]interface{}
+	}
+
+	// documentsPage is a page of analysed users as it is resolved by GraphQL.
+	documentsPage struct {
+		Users  []*AnalysedDocument
+		Cursor string
+	}
+
+	// graphQLCost counts what an operation selects, expanding fragments where
+	// they are spread. spreading holds the fragments that are being expanded,
+	// so that fragments that spread each other are not followed forever.
+	graphQLCost struct {
+		fragments              map[string]*ast.FragmentDefinition
+		spreading              map[string]bool
+		roots, fields, aliases int
+	}
+)
+
+const (
+	// maxGraphQLDepth is how deeply a GraphQL operation can nest fields,
+	// maxGraphQLFields is how many fields it can select counting every time a
+	// fragment is spread, and maxGraphQLAliases is how many of them can be
+	// aliased. A mutation can only have maxGraphQLMutations fields, so that
+	// aliases cannot submit more users than one request to the REST API can.
+	maxGraphQLDepth     = 8
+	maxGraphQLFields    = 200
+	maxGraphQLAliases   = 20
+	maxGraphQLMutations = 1
+)
+
+// userArgs gets the name and id arguments that identify a user.
+func userArgs(args map[string]interface{}) (string, int64, error) {
+	name, _ := args["name"].(string)
+	if id, ok := args["id"].(string); ok {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		return "", userID, err
+	}
+	if name == "" {
+		return "", 0, invalid("either name or id must be given")
+	}
+	return name, 0, nil
+}
+
+// argValues turns the arguments with the keys into query parameters, so that
+// they are checked the same way as those of the HTTP API.
+func argValues(args map[string]interface{}, keys map[string]string) url.Values {
+	values := url.Values{}
+	for arg, key := range keys {
+		switch value := args[arg].(type) {
+		case string:
+			values.Set(key, value)
+		case int:
+			values.Set(key, strconv.Itoa(value))
+		case float64:
+			values.Set(key, strconv.FormatFloat(value, 'f', -1, 64))
+		case []interface{}:
+			parts := make([]string, 0, len(value))
+			for _, part := range value {
+				if s, ok := part.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+			values.Set(key, strings.Join(parts, ","))
+		}
+	}
+	return values
+}
+
+// getDocument gets the analysed document of the user with the id, it is nil if
+// the user has not been analysed.
+func getDocument(ctx context.Context, ds *datastore.Client, userID int64) (*AnalysedDocument, error) {
+	doc := &AnalysedDocument{}
+	err := ds.Get(ctx, datastore.IDKey(userKind, userID, nil), doc)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// InitGraphQL builds the GraphQL schema over users, analyses, time buckets and
+// comparisons. It resolves them with the same logic as the HTTP handlers.
+// Analyses and comparisons can submit users, so they are mutations.
+func InitGraphQL(users *UserCache, ds *datastore.Client, topic *pubsub.Topic, limiter *RateLimiter) graphql.Schema {
+	jobType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Job",
+		Description: "A request to analyse a user as it moves through the pipeline.",
+		Fields: graphql.Fields{
+			"username":  &graphql.Field{Type: graphql.String},
+			"userId":    &graphql.Field{Type: graphql.ID},
+			"status":    &graphql.Field{Type: graphql.String},
+			"requested": &graphql.Field{Type: graphql.DateTime},
+			"updated":   &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+	dayType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Day",
+		Description: "The sentiment counts of the tweets a user made on a day.",
+		Fields: graphql.Fields{
+			"day":            &graphql.Field{Type: graphql.DateTime},
+			"positiveTweets": &graphql.Field{Type: graphql.Int},
+			"negativeTweets": &graphql.Field{Type: graphql.Int},
+		},
+	})
+	timeBucketType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "TimeBucket",
+		Description: "The sentiment of a user's tweets in a day, week or month. averageScore is null if there were no tweets in it.",
+		Fields: graphql.Fields{
+			"start":          &graphql.Field{Type: graphql.DateTime},
+			"positiveTweets": &graphql.Field{Type: graphql.Int},
+			"negativeTweets": &graphql.Field{Type: graphql.Int},
+			"averageScore":   &graphql.Field{Type: graphql.Float},
+		},
+	})
+	bucketMetricsType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "BucketMetrics",
+		Description: "The sentiment of a user's tweets in one of a comparison's buckets. averageScore is null if there were no tweets in it.",
+		Fields: graphql.Fields{
+			"positiveTweets": &graphql.Field{Type: graphql.Int},
+			"negativeTweets": &graphql.Field{Type: graphql.Int},
+			"averageScore":   &graphql.Field{Type: graphql.Float},
+		},
+	})
+	bucketArgs := graphql.FieldConfigArgument{
+		"bucket": &graphql.ArgumentConfig{Type: graphql.String, Description: "day, week or month, week by default."},
+		"days":   &graphql.ArgumentConfig{Type: graphql.Int, Description: "How many days back to go, 90 by default."},
+	}
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "User",
+		Description: "An analysed Twitter user.",
+		Fields: graphql.Fields{
+			"username": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*AnalysedDocument).Username, nil
+				},
+			},
+			"userId": &graphql.Field{
+				Type: graphql.ID,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*AnalysedDocument).UserID, nil
+				},
+			},
+			"positiveTweets": &graphql.Field{Type: graphql.Int},
+			"negativeTweets": &graphql.Field{Type: graphql.Int},
+			"averageScore":   &graphql.Field{Type: graphql.Float},
+			"positiveShare": &graphql.Field{
+				Type: graphql.Float,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return positiveShare(p.Source.(*AnalysedDocument)), nil
+				},
+			},
+			"tweetScores":  &graphql.Field{Type: graphql.NewList(graphql.Int)},
+			"lastAnalysed": &graphql.Field{Type: graphql.DateTime},
+			"days": &graphql.Field{
+				Type:        graphql.NewList(dayType),
+				Description: "The days the user tweeted on, only those in [from, to] if they are given.",
+				Args: graphql.FieldConfigArgument{
+					"from": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"to":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					from, hasFrom := p.Args["from"].(time.Time)
+					to, hasTo := p.Args["to"].(time.Time)
+					days := make([]DayBucket, 0)
+					for _, day := range p.Source.(*AnalysedDocument).Days {
+						if (hasFrom && day.Day.Before(from)) || (hasTo && day.Day.After(to)) {
+							continue
+						}
+						days = append(days, day)
+					}
+					return days, nil
+				},
+			},
+			"series": &graphql.Field{
+				Type:        graphql.NewList(timeBucketType),
+				Description: "The user's sentiment broken down into time buckets, the same as in a comparison.",
+				Args:        bucketArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					bucket, days, err := unmarshalBuckets(argValues(p.Args, map[string]string{"bucket": "bucket", "days": "days"}))
+					if err != nil {
+						return nil, err
+					}
+					starts := recentBuckets(days, bucket)
+					metrics := series(p.Source.(*AnalysedDocument), starts, bucket)
+					buckets := make([]TimeBucket, len(starts))
+					for i, start := range starts {
+						buckets[i] = TimeBucket{
+							Start:          start,
+							PositiveTweets: metrics[i].PositiveTweets,
+							NegativeTweets: metrics[i].NegativeTweets,
+							AverageScore:   metrics[i].AverageScore,
+						}
+					}
+					return buckets, nil
+				},
+			},
+		},
+	})
+	analysisType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Analysis",
+		Description: "The user's analysis if they have been analysed, otherwise the job that is analysing them and a message about it.",
+		Fields: graphql.Fields{
+			"document": &graphql.Field{Type: userType},
+			"message":  &graphql.Field{Type: graphql.String},
+			"job":      &graphql.Field{Type: jobType},
+		},
+	})
+	usersPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "UsersPage",
+		Description: "A page of analysed users. cursor is passed back to get the next page, it is empty on the last page.",
+		Fields: graphql.Fields{
+			"users":  &graphql.Field{Type: graphql.NewList(userType)},
+			"cursor": &graphql.Field{Type: graphql.String},
+		},
+	})
+	submitFailureType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SubmitFailure",
+		Description: "Why a user could not be submitted to be analysed, with the code and message of the error.",
+		Fields: graphql.Fields{
+			"name":    &graphql.Field{Type: graphql.String},
+			"code":    &graphql.Field{Type: graphql.String},
+			"message": &graphql.Field{Type: graphql.String},
+		},
+	})
+	comparedUserType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ComparedUser",
+		Description: "A single user in a comparison. If they have not been analysed yet then status is pending, job is the job that was submitted for them and failure says why they could not be submitted, if they could not.",
+		Fields: graphql.Fields{
+			"username":       &graphql.Field{Type: graphql.String},
+			"userId":         &graphql.Field{Type: graphql.ID},
+			"analysed":       &graphql.Field{Type: graphql.Boolean},
+			"positiveTweets": &graphql.Field{Type: graphql.Int},
+			"negativeTweets": &graphql.Field{Type: graphql.Int},
+			"averageScore":   &graphql.Field{Type: graphql.Float},
+			"positiveShare":  &graphql.Field{Type: graphql.Float},
+			"series":         &graphql.Field{Type: graphql.NewList(bucketMetricsType)},
+			"job":            &graphql.Field{Type: jobType},
+			"status":         &graphql.Field{Type: graphql.String},
+			"failure":        &graphql.Field{Type: submitFailureType},
+		},
+	})
+	comparisonType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Comparison",
+		Description: "Users lined up on the same metrics and time buckets.",
+		Fields: graphql.Fields{
+			"bucket":   &graphql.Field{Type: graphql.String},
+			"buckets":  &graphql.Field{Type: graphql.NewList(graphql.DateTime)},
+			"users":    &graphql.Field{Type: graphql.NewList(comparedUserType)},
+			"notFound": &graphql.Field{Type: graphql.NewList(graphql.String)},
+		},
+	})
+	userIDArgs := graphql.FieldConfigArgument{
+		"name": &graphql.ArgumentConfig{Type: graphql.String, Description: "Screen name of the Twitter user, used if id is not given."},
+		"id":   &graphql.ArgumentConfig{Type: graphql.ID, Description: "Twitter id of the user."},
+	}
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type:        userType,
+				Description: "An analysed user, null if they have not been analysed.",
+				Args:        userIDArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					name, id, err := userArgs(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					if id == 0 {
+						user, err := findUser(users, name, 0)
+						if err != nil {
+							return nil, err
+						}
+						id = user.ID
+					}
+					return getDocument(p.Context, ds, id)
+				},
+			},
+			"users": &graphql.Field{
+				Type:        usersPageType,
+				Description: "The same as /api/v1/users, a page of the analysed users.",
+				Args: graphql.FieldConfigArgument{
+					"prefix":   &graphql.ArgumentConfig{Type: graphql.String},
+					"sort":     &graphql.ArgumentConfig{Type: graphql.String, Description: "name, score or analysed."},
+					"order":    &graphql.ArgumentConfig{Type: graphql.String, Description: "asc or desc."},
+					"minScore": &graphql.ArgumentConfig{Type: graphql.Float},
+					"maxScore": &graphql.ArgumentConfig{Type: graphql.Float},
+					"cursor":   &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":    &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					query, err := unmarshalUsersQuery(argValues(p.Args, map[string]string{
+						"prefix":   "prefix",
+						"sort":     "sort",
+						"order":    "order",
+						"minScore": "min_score",
+						"maxScore": "max_score",
+						"cursor":   "cursor",
+						"limit":    "limit",
+					}))
+					if err != nil {
+						return nil, err
+					}
+					docs, cursor, err := listDocuments(ds, query)
+					if err != nil {
+						return nil, err
+					}
+					page := &documentsPage{Users: make([]*AnalysedDocument, len(docs)), Cursor: cursor}
+					for i := range docs {
+						page.Users[i] = &docs[i]
+					}
+					return page, nil
+				},
+			},
+		},
+	})
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Mutation",
+		Description: "Fields that submit users to be analysed, they can only be POSTed.",
+		Fields: graphql.Fields{
+			"analyse": &graphql.Field{
+				Type:        analysisType,
+				Description: "The same as /api/v1/analyse, users that have not been analysed are submitted to be.",
+				Args:        userIDArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := limitMutation(p.Context, limiter, "/analyse"); err != nil {
+						return nil, err
+					}
+					name, id, err := userArgs(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					user, err := findUser(users, name, id)
+					if err != nil {
+						return nil, err
+					}
+					data, err := getData(p.Context, user.ScreenName, user.ID, ds, topic)
+					if err != nil {
+						return nil, err
+					}
+					if message, ok := data.(JobMessage); ok {
+						return &AnalysisReply{Message: message.Message, Job: message.Job}, nil
+					}
+					doc := data.(AnalysedDocument)
+					return &AnalysisReply{Document: &doc}, nil
+				},
+			},
+			"compare": &graphql.Field{
+				Type:        comparisonType,
+				Description: "The same as /api/v1/compare with submit=true, users that have not been analysed are submitted to be.",
+				Args: graphql.FieldConfigArgument{
+					"names":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+					"bucket": bucketArgs["bucket"],
+					"days":   bucketArgs["days"],
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := limitMutation(p.Context, limiter, "/compare"); err != nil {
+						return nil, err
+					}
+					names, bucket, days, err := unmarshalCompare(argValues(p.Args, map[string]string{"names": "names", "bucket": "bucket", "days": "days"}))
+					if err != nil {
+						return nil, err
+					}
+					return compare(p.Context, names, bucket, days, true, users, ds, topic)
+				},
+			},
+		},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: queryType, Mutation: mutationType})
+	if err != nil {
+		log.Fatalf("Could not build the GraphQL schema: %v\n", err)
+	}
+	return schema
+}
+
+// limitMutation holds the caller to the rate limit of the route that does the
+// same as a mutation, so that mutations are not a way around it.
+func limitMutation(ctx context.Context, limiter *RateLimiter, route string) error {
+	_, err := limiter.Allow(ctx, route, limitKeyFrom(ctx))
+	return err
+}
+
+// graphQLOperation parses the request and returns the operation it runs and
+// its fragments. The operation is nil if there is not one with the name,
+// graphql.Do reports that.
+func graphQLOperation(req *GraphQLRequest) (*ast.OperationDefinition, map[string]*ast.FragmentDefinition, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return nil, nil, &ValidationError{Err: err}
+	}
+	var operation *ast.OperationDefinition
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, definition := range doc.Definitions {
+		switch def := definition.(type) {
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			named := def.Name != nil && def.Name.Value == req.OperationName
+			if operation == nil && (req.OperationName == "" || named) {
+				operation = def
+			}
+		}
+	}
+	return operation, fragments, nil
+}
+
+// add counts the selections, which are depth fields deep.
+func (c *graphQLCost) add(set *ast.SelectionSet, depth int) error {
+	if set == nil {
+		return nil
+	}
+	if depth > maxGraphQLDepth {
+		return invalid("the query can nest fields at most %d deep", maxGraphQLDepth)
+	}
+	for _, selection := range set.Selections {
+		switch sel := selection.(type) {
+		case *ast.Field:
+			if depth == 1 {
+				c.roots++
+			}
+			if c.fields++; c.fields > maxGraphQLFields {
+				return invalid("the query can select at most %d fields", maxGraphQLFields)
+			}
+			if sel.Alias != nil && sel.Alias.Value != sel.Name.Value {
+				if c.aliases++; c.aliases > maxGraphQLAliases {
+					return invalid("the query can alias at most %d fields", maxGraphQLAliases)
+				}
+			}
+			if err := c.add(sel.SelectionSet, depth+1); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := c.add(sel.SelectionSet, depth); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			fragment, ok := c.fragments[sel.Name.Value]
+			if !ok || c.spreading[sel.Name.Value] {
+				// graphql.Do reports unknown and cyclic fragments
+				continue
+			}
+			c.spreading[sel.Name.Value] = true
+			err := c.add(fragment.SelectionSet, depth)
+			delete(c.spreading, sel.Name.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkGraphQLCost fails with a 400 if the operation nests fields too deeply,
+// selects too many or makes more than one mutation.
+func checkGraphQLCost(operation *ast.OperationDefinition, fragments map[string]*ast.FragmentDefinition) error {
+	cost := &graphQLCost{fragments: fragments, spreading: make(map[string]bool)}
+	err := cost.add(operation.SelectionSet, 1)
+	if err == nil && operation.Operation == ast.OperationTypeMutation && cost.roots > maxGraphQLMutations {
+		err = invalid("a request can make at most %d mutation", maxGraphQLMutations)
+	}
+	return err
+}
+
+// unmarshalGraphQL gets the GraphQL request from the body of a POST or the
+// parameters of a GET.
+func unmarshalGraphQL(r *http.Request) (*GraphQLRequest, error) {
+	req := &GraphQLRequest{}
+	if r.Method == http.MethodPost {
+		return req, json.NewDecoder(r.Body).Decode(req)
+	}
+	values := r.URL.Query()
+	req.Query, req.OperationName = values.Get("query"), values.Get("operationName")
+	if variables := values.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// GraphQLHO returns a handler that runs GraphQL queries against the schema, so
+// that a chart can fetch exactly the slices of users, analyses, time buckets
+// and comparisons it needs in one round trip. Mutations have to be POSTed, so
+// that they need the CSRF token while signed in, and operations that cost too
+// much are refused. Errors from the query are returned next to the data, as
+// GraphQL does, with an OK status.
+func GraphQLHO(schema graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			notAllowed(w, r, http.MethodGet, http.MethodPost)
+			return
+		}
+		req, err := unmarshalGraphQL(r)
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		if req.Query == "" {
+			writeError("Unmarshal", invalid("query was empty, but should not have been"), w)
+			return
+		}
+		operation, fragments, err := graphQLOperation(req)
+		if err != nil {
+			writeError("Parse", err, w)
+			return
+		}
+		if operation != nil {
+			if operation.Operation == ast.OperationTypeMutation && r.Method != http.MethodPost {
+				notAllowed(w, r, http.MethodPost)
+				return
+			}
+			if err := checkGraphQLCost(operation, fragments); err != nil {
+				writeError("Cost", err, w)
+				return
+			}
+		}
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        r.Context(),
+		})
+		writeJSON(result, w)
+	}
+}
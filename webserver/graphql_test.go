@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckGraphQLCost(t *testing.T) {
+	tests := []struct {
+		name, query string
+		ok          bool
+	}{
+		{"a query", `{ users(limit: 10) { users { username series(bucket: "month") { start averageScore } } } }`, true},
+		{"a mutation", `mutation { analyse(name: "someone") { message } }`, true},
+		{"two mutations", `mutation { a: analyse(name: "a") { message } b: analyse(name: "b") { message } }`, false},
+		{"two mutations through a fragment", `mutation { ...both } fragment both on Mutation { a: analyse(name: "a") { message } b: analyse(name: "b") { message } }`, false},
+		{"too deep", `{ a { b { c { d { e { f { g { h { i } } } } } } } } }`, false},
+		{"too many aliases", "{ " + strings.Repeat("u: user(name: \"x\") { username } ", 21) + "}", false},
+		{"too many fields through fragments", `{ ...a ...a } fragment a on Query { users { users { ` + strings.Repeat("username ", 100) + ` } } }`, false},
+		{"fragments that spread each other", `{ ...a } fragment a on Query { ...b } fragment b on Query { ...a }`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operation, fragments, err := graphQLOperation(&GraphQLRequest{Query: test.query})
+			if err != nil {
+				t.Fatalf("graphQLOperation() = %v", err)
+			}
+			if err := checkGraphQLCost(operation, fragments); (err == nil) != test.ok {
+				t.Errorf("checkGraphQLCost() = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestLimitMutation(t *testing.T) {
+	limiter := &RateLimiter{
+		limits:   map[string]Limit{"/analyse": {Rate: 0.001, Burst: 1}},
+		fallback: Limit{Rate: 10, Burst: 30},
+		store:    &memoryStore{buckets: make(map[string]*tokenBucket), swept: time.Now()},
+	}
+	alice := context.WithValue(context.Background(), limitKeyContextKey{}, "caller:alice")
+	bob := context.WithValue(context.Background(), limitKeyContextKey{}, "caller:bob")
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		route string
+		ok    bool
+	}{
+		{"the first analyse", alice, "/analyse", true},
+		{"the second analyse is over the limit of /analyse", alice, "/analyse", false},
+		{"another caller has their own limit", bob, "/analyse", true},
+		{"a route without its own limit falls back to *", alice, "/compare", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := limitMutation(test.ctx, limiter, test.route)
+			if test.ok && err != nil {
+				t.Errorf("limitMutation() = %v, want nil", err)
+			}
+			if apiErr, ok := err.(*APIError); !test.ok && (!ok || apiErr.Code != codeRateLimited) {
+				t.Errorf("limitMutation() = %v, want a %s", err, codeRateLimited)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+type (
+	// Group is the entity in the datastore for a saved, named list of users.
+	// Members holds the screen names of the users in the same order as
+	// UserIDs. Owner is the account or key that saved the group, it is empty
+	// if it was saved anonymously. Names only have to be unique per owner.
+	Group struct {
+		Name             string
+		Description      string   `datastore:",noindex"`
+		Members          []string `datastore:",noindex"`
+		UserIDs          []int64  `datastore:",noindex"`
+		Created, Updated time.Time
+		Owner            string
+	}
+
+	// GroupRequest is the body of a request to save a group.
+	GroupRequest struct {
+		Name, Description string
+		Members           []string
+	}
+
+	// SavedGroup is returned for a group that was saved. NotFound holds the
+	// members that no Twitter user has and Failed the ones that could not be
+	// submitted to be analysed.
+	SavedGroup struct {
+		Group    *Group
+		NotFound []string
+		Failed   []SubmitFailure
+	}
+
+	// GroupMember is the analysis of a single member of a group. ZScore is how
+	// many standard deviations the member's score is from the group's mean.
+	GroupMember struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore, ZScore           float64
+	}
+
+	// HistogramBin counts the members whose AverageScore is in [Low, High).
+	HistogramBin struct {
+		Low, High float64
+		Count     int
+	}
+
+	// GroupStats is the aggregate sentiment of a group. AverageScore is over
+	// every tweet of every member, while the Member* fields describe the
+	// spread of the members' own AverageScores. Pending holds the members
+	// that have not been analysed yet.
+	GroupStats struct {
+		Name                                            string
+		Members, Analysed                               int
+		PositiveTweets, NegativeTweets                  int
+		AverageScore                                    float64
+		MeanMemberScore, MedianMemberScore, StdDevScore float64
+		Distribution                                    []HistogramBin
+		Outliers                                        []GroupMember
+		Scores                                          []GroupMember
+		Pending                                         []string
+	}
+)
+
+const (
+	groupKind = "Group"
+
+	// maxGroupSize is the most members a group can have.
+	maxGroupSize = 500
+	// maxGroupName is the longest a group's name can be.
+	maxGroupName = 100
+	// histogramBins is how many bins the range of scores, [-1, 1], is split
+	// into for the distribution.
+	histogramBins = 10
+	// histogramEpsilon is how far below the edge of a bin a score can be
+	// and still be counted in it, to make up for rounding.
+	histogramEpsilon = 1e-9
+	// outlierZScore is how far from the mean, in standard deviations, a
+	// member has to be to be an outlier.
+	outlierZScore = 2.0
+)
+
+// groupKey returns the key of the group with the name saved by owner. Groups
+// that were saved anonymously are keyed by their name alone, as every group
+// was before groups were kept apart by owner.
+func groupKey(owner, name string) *datastore.Key {
+	if owner == "" {
+		return datastore.NameKey(groupKind, name, nil)
+	}
+	return datastore.NameKey(groupKind, owner+"/"+name, nil)
+}
+
+// findGroup gets the group with the name saved by owner with get, which is
+// the Get of a client or a transaction. A group owner saved before groups were
+// kept apart by owner is found under its old key. The key is nil if there is
+// no such group.
+func findGroup(get func(*datastore.Key, interface{}) error, owner, name string) (*datastore.Key, *Group, error) {
+	keys := []*datastore.Key{groupKey(owner, name)}
+	if owner != "" {
+		keys = append(keys, groupKey("", name))
+	}
+	for _, key := range keys {
+		group := &Group{}
+		if err := get(key, group); err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if group.Owner == owner {
+			return key, group, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// dsGet returns the Get of the client as findGroup wants it.
+func dsGet(ctx context.Context, ds *datastore.Client) func(*datastore.Key, interface{}) error {
+	return func(key *datastore.Key, dst interface{}) error {
+		return ds.Get(ctx, key, dst)
+	}
+}
+
+// Validate returns an error if the request cannot be saved as a group.
+func (req *GroupRequest) Validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return invalid("group name was empty, but should not have been")
+	}
+	if len(req.Name) > maxGroupName {
+		return invalid("group name can be at most %d characters", maxGroupName)
+	}
+	if len(req.Members) == 0 {
+		return invalid("group must have at least one member")
+	}
+	if len(req.Members) > maxGroupSize {
+		return invalid("group can have at most %d members", maxGroupSize)
+	}
+	return nil
+}
+
+// saveGroup resolves the members of the group and saves it, replacing the
+// caller's own group with the same name. Members that have not been analysed
+// yet are submitted to be analysed, it fails before submitting any of them if
+// the caller cannot submit all of them and otherwise the ones that still fail
+// are returned with the group. The names that no Twitter user has are also
+// returned.
+func saveGroup(ctx context.Context, req *GroupRequest, users *UserCache, ds *datastore.Client, topic *pubsub.Topic) (*SavedGroup, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	owner := ownerFrom(ctx)
+	// checked again when the group is saved, this only avoids submitting the
+	// members of a group that cannot be saved
+	if _, old, err := findGroup(dsGet(ctx, ds), owner, req.Name); err != nil {
+		return nil, err
+	} else if old != nil {
+		if err := checkOwner(ctx, old.Owner); err != nil {
+			return nil, err
+		}
+	}
+	found, missing, err := users.GetMany(req.Members)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	group := &Group{
+		Name:        req.Name,
+		Description: req.Description,
+		Members:     make([]string, 0, len(found)),
+		UserIDs:     make([]int64, 0, len(found)),
+		Created:     now,
+		Updated:     now,
+		Owner:       owner,
+	}
+	seen := make(map[int64]bool, len(found))
+	for _, user := range found {
+		if seen[user.ID] {
+			continue
+		}
+		seen[user.ID] = true
+		group.Members = append(group.Members, user.ScreenName)
+		group.UserIDs = append(group.UserIDs, user.ID)
+	}
+	_, analysed, err := getDocuments(ds, group.UserIDs)
+	if err != nil {
+		return nil, err
+	}
+	unanalysed := 0
+	for i := range group.UserIDs {
+		if !analysed[i] {
+			unanalysed++
+		}
+	}
+	if err := checkSubmit(ctx, unanalysed, ds); err != nil {
+		return nil, err
+	}
+	saved := &SavedGroup{Group: group, NotFound: missing, Failed: make([]SubmitFailure, 0)}
+	for i, id := range group.UserIDs {
+		if !analysed[i] {
+			if _, _, err := submitJob(ctx, group.Members[i], id, ds, topic); err != nil {
+				saved.Failed = append(saved.Failed, submitFailure(ctx, group.Members[i], err))
+			}
+		}
+	}
+	key := groupKey(owner, group.Name)
+	_, err = ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+		oldKey, old, err := findGroup(tx.Get, owner, group.Name)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if err := checkOwner(ctx, old.Owner); err != nil {
+				return err
+			}
+			group.Created = old.Created
+			// a group saved before groups were kept apart by owner moves
+			// under its owner
+			if oldKey.Name != key.Name {
+				if err := tx.Delete(oldKey); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = tx.Put(key, group)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// deleteGroup deletes the group with the name saved by owner, it fails with a
+// 403 if the caller is not the owner or an admin.
+func deleteGroup(ctx context.Context, ds *datastore.Client, owner, name string) error {
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		key, group, err := findGroup(tx.Get, owner, name)
+		if err != nil || group == nil {
+			return err
+		}
+		if err := checkOwner(ctx, group.Owner); err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return err
+}
+
+// unmarshalGroup gets the name of a group and who saved it from the query
+// parameters, the owner is the caller themselves unless the owner parameter
+// says otherwise.
+func unmarshalGroup(ctx context.Context, values url.Values) (string, string, error) {
+	name := values.Get("name")
+	if name == "" {
+		return "", "", invalid("group name was empty, but should not have been")
+	}
+	if owner := values.Get("owner"); owner != "" {
+		return owner, name, nil
+	}
+	return ownerFrom(ctx), name, nil
+}
+
+// listGroups gets all of the groups ordered by name, or only the ones saved by
+// owner if it is not empty.
+func listGroups(ds *datastore.Client, owner string) ([]Group, error) {
+	groups := make([]Group, 0)
+	if _, err := ds.GetAll(context.Background(), datastore.NewQuery(groupKind).Order("Name"), &groups); err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return groups, nil
+	}
+	owned := make([]Group, 0, len(groups))
+	for _, group := range groups {
+		if group.Owner == owner {
+			owned = append(owned, group)
+		}
+	}
+	return owned, nil
+}
+
+// median returns the median of sorted values.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// histogram counts the scores, which are in [-1, 1], into evenly sized bins.
+func histogram(scores []float64) []HistogramBin {
+	width := 2.0 / histogramBins
+	bins := make([]HistogramBin, histogramBins)
+	for i := range bins {
+		bins[i].Low = -1 + float64(i)*width
+		bins[i].High = bins[i].Low + width
+	}
+	for _, score := range scores {
+		// a score on the edge of a bin can come out a hair below it, which
+		// would put it in the bin before
+		i := int((score+1)/width + histogramEpsilon)
+		if i >= histogramBins {
+			// a score of exactly 1 belongs in the last bin
+			i = histogramBins - 1
+		} else if i < 0 {
+			i = 0
+		}
+		bins[i].Count++
+	}
+	return bins
+}
+
+// groupStats aggregates the analysed documents of the members of the group.
+func groupStats(group *Group, ds *datastore.Client) (*GroupStats, error) {
+	docs, analysed, err := getDocuments(ds, group.UserIDs)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate(group, docs, analysed), nil
+}
+
+// aggregate works out the stats of the group from the documents of its
+// members, analysed says which of them have been analysed.
+func aggregate(group *Group, docs []AnalysedDocument, analysed []bool) *GroupStats {
+	stats := &GroupStats{
+		Name:     group.Name,
+		Members:  len(group.UserIDs),
+		Outliers: make([]GroupMember, 0),
+		Scores:   make([]GroupMember, 0, len(group.UserIDs)),
+		Pending:  make([]string, 0),
+	}
+	scores := make([]float64, 0, len(group.UserIDs))
+	for i, id := range group.UserIDs {
+		if !analysed[i] {
+			stats.Pending = append(stats.Pending, group.Members[i])
+			continue
+		}
+		doc := &docs[i]
+		stats.PositiveTweets += doc.PositiveTweets
+		stats.NegativeTweets += doc.NegativeTweets
+		stats.Scores = append(stats.Scores, GroupMember{
+			Username:       group.Members[i],
+			UserID:         id,
+			PositiveTweets: doc.PositiveTweets,
+			NegativeTweets: doc.NegativeTweets,
+			AverageScore:   doc.AverageScore,
+		})
+		scores = append(scores, doc.AverageScore)
+	}
+	stats.Analysed = len(scores)
+	stats.Distribution = histogram(scores)
+	if stats.Analysed == 0 {
+		return stats
+	}
+	if total := stats.PositiveTweets + stats.NegativeTweets; total > 0 {
+		stats.AverageScore = float64(stats.PositiveTweets-stats.NegativeTweets) / float64(total)
+	}
+	sum := 0.0
+	for _, score := range scores {
+		sum += score
+	}
+	stats.MeanMemberScore = sum / float64(len(scores))
+	variance := 0.0
+	for _, score := range scores {
+		variance += (score - stats.MeanMemberScore) * (score - stats.MeanMemberScore)
+	}
+	stats.StdDevScore = math.Sqrt(variance / float64(len(scores)))
+	sorted := append([]float64(nil), scores...)
+	sort.Float64s(sorted)
+	stats.MedianMemberScore = median(sorted)
+	for i := range stats.Scores {
+		member := &stats.Scores[i]
+		if stats.StdDevScore > 0 {
+			member.ZScore = (member.AverageScore - stats.MeanMemberScore) / stats.StdDevScore
+		}
+		if math.Abs(member.ZScore) >= outlierZScore {
+			stats.Outliers = append(stats.Outliers, *member)
+		}
+	}
+	sort.Slice(stats.Scores, func(i, j int) bool { return stats.Scores[i].AverageScore > stats.Scores[j].AverageScore })
+	return stats
+}
+
+// GroupsHO returns a handler for saved groups. GET lists all of the groups, or
+// only the ones of the account that is signed in with mine=true, POST saves one
+// from a JSON GroupRequest body, and DELETE removes the group with the name
+// parameter, saved by the caller or by the owner parameter.
+func GroupsHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			owner, err := mineOnly(r)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			groups, err := listGroups(ds, owner)
+			if err != nil {
+				writeError("List", err, w)
+				return
+			}
+			data = groups
+		case http.MethodPost:
+			req := &GroupRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			saved, err := saveGroup(r.Context(), req, users, ds, topic)
+			if err != nil {
+				writeError("Save", err, w)
+				return
+			}
+			data = saved
+		case http.MethodDelete:
+			owner, name, err := unmarshalGroup(r.Context(), r.URL.Query())
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			if err := deleteGroup(r.Context(), ds, owner, name); err != nil {
+				writeError("Delete", err, w)
+				return
+			}
+			data = struct{ Message string }{Message: "The group has been deleted."}
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+			return
+		}
+		writeJSON(data, w)
+	}
+}
+
+// GroupStatsHO returns a handler for the aggregate sentiment of the group with
+// the name parameter, saved by the caller or by the owner parameter.
+func GroupStatsHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		owner, name, err := unmarshalGroup(r.Context(), r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		_, group, err := findGroup(dsGet(r.Context(), ds), owner, name)
+		if err != nil {
+			writeError("Group", err, w)
+			return
+		}
+		if group == nil {
+			writeError("Group", &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: fmt.Errorf("there is no group %s", name)}, w)
+			return
+		}
+		stats, err := groupStats(group, ds)
+		if err != nil {
+			writeError("Stats", err, w)
+			return
+		}
+		writeJSON(stats, w)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGroupKey(t *testing.T) {
+	tests := []struct {
+		name, owner, group string
+		want               string
+	}{
+		{"an account's group", "alice", "friends", "alice/friends"},
+		{"a key's group", "key:ta_12345678", "friends", "key:ta_12345678/friends"},
+		{"an anonymous group keeps its old key", "", "friends", "friends"},
+		{"a name with a slash", "alice", "eu/politicians", "alice/eu/politicians"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := groupKey(test.owner, test.group).Name; got != test.want {
+				t.Errorf("groupKey() = %q, want %q", got, test.want)
+			}
+		})
+	}
+	if groupKey("alice", "friends").Equal(groupKey("bob", "friends")) {
+		t.Error("alice and bob share the key of the group friends")
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []float64
+		want   float64
+	}{
+		{"no scores", nil, 0},
+		{"one score", []float64{0.3}, 0.3},
+		{"an odd number of scores", []float64{-1, 0.2, 0.9}, 0.2},
+		{"an even number of scores", []float64{-0.5, 0, 0.5, 1}, 0.25},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := median(test.sorted); got != test.want {
+				t.Errorf("median(%v) = %v, want %v", test.sorted, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []float64
+		want   []int
+	}{
+		{"no scores", nil, []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"the ends of the range", []float64{-1, 1}, []int{1, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"a bin includes its low edge", []float64{0, 0.19, 0.2}, []int{0, 0, 0, 0, 0, 2, 1, 0, 0, 0}},
+		{"every edge", []float64{-0.8, -0.6, -0.4, -0.2, 0.4, 0.6, 0.8}, []int{0, 1, 1, 1, 1, 0, 0, 1, 1, 1}},
+		{"scores outside the range go in the end bins", []float64{-1.5, 1.5}, []int{1, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bins := histogram(test.scores)
+			counts := make([]int, len(bins))
+			for i, bin := range bins {
+				counts[i] = bin.Count
+			}
+			if !reflect.DeepEqual(counts, test.want) {
+				t.Errorf("histogram(%v) counts = %v, want %v", test.scores, counts, test.want)
+			}
+			if bins[0].Low != -1 || math.Abs(bins[len(bins)-1].High-1) > 1e-9 {
+				t.Errorf("histogram() covers [%v, %v), want [-1, 1)", bins[0].Low, bins[len(bins)-1].High)
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	t.Run("members that have not been analysed are pending", func(t *testing.T) {
+		group := &Group{Name: "friends", Members: []string{"alice", "bob", "carol"}, UserIDs: []int64{1, 2, 3}}
+		docs := []AnalysedDocument{
+			{PositiveTweets: 3, NegativeTweets: 1, AverageScore: -0.5},
+			{PositiveTweets: 1, NegativeTweets: 3, AverageScore: 0.5},
+			{},
+		}
+		stats := aggregate(group, docs, []bool{true, true, false})
+		if stats.Members != 3 || stats.Analysed != 2 || !reflect.DeepEqual(stats.Pending, []string{"carol"}) {
+			t.Errorf("aggregate() = %d members, %d analysed, %v pending, want 3, 2, [carol]", stats.Members, stats.Analysed, stats.Pending)
+		}
+		if stats.PositiveTweets != 4 || stats.NegativeTweets != 4 || stats.AverageScore != 0 {
+			t.Errorf("aggregate() tweets = %d, %d, %v, want 4, 4, 0", stats.PositiveTweets, stats.NegativeTweets, stats.AverageScore)
+		}
+		if stats.MeanMemberScore != 0 || stats.MedianMemberScore != 0 || stats.StdDevScore != 0.5 {
+			t.Errorf("aggregate() mean, median, std dev = %v, %v, %v, want 0, 0, 0.5", stats.MeanMemberScore, stats.MedianMemberScore, stats.StdDevScore)
+		}
+		if len(stats.Scores) != 2 || stats.Scores[0].Username != "bob" || len(stats.Outliers) != 0 {
+			t.Errorf("aggregate() scores = %+v, outliers = %+v, want bob first and no outliers", stats.Scores, stats.Outliers)
+		}
+	})
+	t.Run("a member far from the mean is an outlier", func(t *testing.T) {
+		group := &Group{}
+		docs, analysed := make([]AnalysedDocument, 10), make([]bool, 10)
+		for i := range docs {
+			group.Members = append(group.Members, string(rune('a'+i)))
+			group.UserIDs = append(group.UserIDs, int64(i+1))
+			analysed[i] = true
+		}
+		docs[9].AverageScore = 1
+		stats := aggregate(group, docs, analysed)
+		if len(stats.Outliers) != 1 || stats.Outliers[0].Username != "j" || math.Abs(stats.Outliers[0].ZScore-3) > 1e-9 {
+			t.Errorf("aggregate() outliers = %+v, want j with a z-score of 3", stats.Outliers)
+		}
+	})
+	t.Run("nobody has been analysed", func(t *testing.T) {
+		group := &Group{Members: []string{"alice"}, UserIDs: []int64{1}}
+		stats := aggregate(group, make([]AnalysedDocument, 1), []bool{false})
+		if stats.Analysed != 0 || len(stats.Distribution) != histogramBins || stats.StdDevScore != 0 {
+			t.Errorf("aggregate() = %+v, want nothing analysed and an empty distribution", stats)
+		}
+	})
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"twitteranalytics/analyticspb"
+)
+
+type (
+	// AnalyticsService serves analyticspb.AnalyticsServer, the gRPC service
+	// that backend services use in place of the HTTP API, with the same logic
+	// as the HTTP handlers.
+	AnalyticsService struct {
+		analyticspb.UnimplementedAnalyticsServer
+		users *UserCache
+		ds    *datastore.Client
+		topic *pubsub.Topic
+	}
+
+	// AnalysisReply holds the user's Document if they have been analysed,
+	// otherwise the Job that is analysing them and a Message about it.
+	AnalysisReply struct {
+		Document *AnalysedDocument
+		Message  string
+		Job      *Job
+	}
+
+	// callerStream is a server stream whose context carries the caller or
+	// the request id.
+	callerStream struct {
+		grpc.ServerStream
+		ctx context.Context
+	}
+)
+
+const (
+	// requestIDMetadata is the metadata key the request id is taken from and
+	// returned in, metadata keys are lower case.
+	requestIDMetadata = "x-request-id"
+	// apiKeyMetadata is the metadata key the API key is taken from.
+	apiKeyMetadata = "x-api-key"
+)
+
+// grpcRoutes maps each method to the HTTP route whose rate limit it is held
+// to.
+var grpcRoutes = map[string]string{
+	"Analyse":     "/analyse",
+	"GetAnalysis": "/analyse",
+	"ListUsers":   "/users",
+	"WatchJob":    "/analyse/stream",
+}
+
+// grpcError turns err into a gRPC status with the code that matches the HTTP
+// status classify gives it.
+func grpcError(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	code := codes.Internal
+	httpStatus, httpCode := classify(err)
+	switch httpStatus {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	if code == codes.Internal || code == codes.Unavailable {
+		logEntry(levelError, err.Error(), logFields{"location": "gRPC"})
+	}
+	return status.Error(code, publicMessage(err, httpCode))
+}
+
+// grpcRequestID returns the request id the caller sent in the metadata, or a
+// new one if it did not send a usable one.
+func grpcRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(requestIDMetadata); len(ids) > 0 {
+		return checkRequestID(ids[0])
+	}
+	return checkRequestID("")
+}
+
+// logCall writes a call that has finished to the access log and its metrics,
+// the same way LogHandlerHO and MetricsHO do for HTTP requests.
+func logCall(id, method string, start time.Time, entry *accessLog, err error) {
+	observeCall(method, status.Code(err), start)
+	level := levelInfo
+	if code := status.Code(err); code == codes.Internal || code == codes.Unavailable || code == codes.Unknown {
+		level = levelError
+	}
+	logEntry(level, "call", entry.fields(logFields{
+		"request_id": id,
+		"method":     method,
+		"status":     status.Code(err).String(),
+		"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+	}))
+}
+
+// logUnary gives the call a request id, returns it in the header and logs the
+// call once it has finished.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start, entry := time.Now(), &accessLog{}
+	id := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+	ctx = context.WithValue(withRequestID(ctx, id), accessLogContextKey{}, entry)
+	res, err := handler(ctx, req)
+	logCall(id, info.FullMethod, start, entry, err)
+	return res, err
+}
+
+// logStream gives the stream a request id, returns it in the header and logs
+// the stream once it has finished.
+func logStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start, entry := time.Now(), &accessLog{}
+	id := grpcRequestID(stream.Context())
+	stream.SetHeader(metadata.Pairs(requestIDMetadata, id))
+	ctx := context.WithValue(withRequestID(stream.Context(), id), accessLogContextKey{}, entry)
+	err := handler(srv, &callerStream{ServerStream: stream, ctx: ctx})
+	logCall(id, info.FullMethod, start, entry, err)
+	return err
+}
+
+func (s *callerStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcCaller authenticates the API key in the metadata of ctx and returns a
+// copy of ctx that carries the caller.
+func grpcCaller(ctx context.Context, keys *APIKeys) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	key := ""
+	if values := md.Get(apiKeyMetadata); len(values) > 0 {
+		key = values[0]
+	}
+	caller, err := keys.Authenticate(key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	logCaller(ctx, caller)
+	ctx = withCaller(ctx, caller)
+	// every method reads analyses, submitting jobs is held to the caller's quota
+	if err := requireRole(ctx, roleViewer); err != nil {
+		return nil, grpcError(err)
+	}
+	return ctx, nil
+}
+
+// authUnary returns an interceptor that authenticates every call with keys,
+// the same way AuthHO does for HTTP requests.
+func authUnary(keys *APIKeys) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := grpcCaller(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authStream returns an interceptor that authenticates every stream with keys.
+func authStream(keys *APIKeys) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcCaller(stream.Context(), keys)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &callerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// grpcRoute returns the route whose rate limit the method is held to, methods
+// without one fall back to the default limit.
+func grpcRoute(fullMethod string) string {
+	if route, ok := grpcRoutes[path.Base(fullMethod)]; ok {
+		return route
+	}
+	return fullMethod
+}
+
+// grpcPeer returns the address the call came from.
+func grpcPeer(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// limitCall takes a call to the method from the bucket of the caller in ctx,
+// the same way LimitHO does for HTTP requests, and returns a copy of ctx that
+// carries who the caller is limited as. When the bucket is empty it tells the
+// caller in the retry-after header how long to wait.
+func limitCall(ctx context.Context, limiter *RateLimiter, fullMethod string) (context.Context, error) {
+	who := limitKey(callerFrom(ctx), grpcPeer(ctx))
+	if seconds, err := limiter.Allow(ctx, grpcRoute(fullMethod), who); err != nil {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(seconds)))
+		return nil, grpcError(err)
+	}
+	return context.WithValue(ctx, limitKeyContextKey{}, who), nil
+}
+
+// limitUnary returns an interceptor that holds every call to the rate limit of
+// its route. It has to come after authUnary.
+func limitUnary(limiter *RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := limitCall(ctx, limiter, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// limitStream returns an interceptor that holds every stream to the rate limit
+// of its route. It has to come after authStream.
+func limitStream(limiter *RateLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := limitCall(stream.Context(), limiter, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &callerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// pbTime converts t to a timestamp, the zero time is left unset.
+func pbTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// pbJob converts job to its message, nil stays nil.
+func pbJob(job *Job) *analyticspb.Job {
+	if job == nil {
+		return nil
+	}
+	return &analyticspb.Job{
+		Username:  job.Username,
+		UserId:    job.UserID,
+		Status:    job.Status,
+		Requested: pbTime(job.Requested),
+		Updated:   pbTime(job.Updated),
+	}
+}
+
+// pbDocument converts doc to its message, nil stays nil. The scores of the
+// single tweets are left out.
+func pbDocument(doc *AnalysedDocument) *analyticspb.AnalysedDocument {
+	if doc == nil {
+		return nil
+	}
+	days := make([]*analyticspb.DayBucket, len(doc.Days))
+	for i, day := range doc.Days {
+		days[i] = &analyticspb.DayBucket{Day: pbTime(day.Day), PositiveTweets: int32(day.PositiveTweets), NegativeTweets: int32(day.NegativeTweets)}
+	}
+	return &analyticspb.AnalysedDocument{
+		Username:        doc.Username,
+		UserId:          doc.UserID,
+		LastTweetId:     doc.LastTweetID,
+		EarliestTweetId: doc.EarliestTweetID,
+		PositiveTweets:  int32(doc.PositiveTweets),
+		NegativeTweets:  int32(doc.NegativeTweets),
+		AverageScore:    doc.AverageScore,
+		Days:            days,
+		LastAnalysed:    pbTime(doc.LastAnalysed),
+	}
+}
+
+// pbUsersPage converts page to its message.
+func pbUsersPage(page *UsersPage) *analyticspb.UsersPage {
+	users := make([]*analyticspb.UserSummary, len(page.Users))
+	for i, user := range page.Users {
+		users[i] = &analyticspb.UserSummary{
+			Username:       user.Username,
+			UserId:         user.UserID,
+			PositiveTweets: int32(user.PositiveTweets),
+			NegativeTweets: int32(user.NegativeTweets),
+			AverageScore:   user.AverageScore,
+			LastAnalysed:   pbTime(user.LastAnalysed),
+		}
+	}
+	return &analyticspb.UsersPage{Users: users, Cursor: page.Cursor}
+}
+
+// Analyse submits the user to be analysed, even if they have been analysed
+// before, so that their newest tweets are picked up.
+func (s *AnalyticsService) Analyse(ctx context.Context, req *analyticspb.UserRequest) (*analyticspb.AnalyseReply, error) {
+	user, err := findUser(s.users, req.Username, req.UserId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	job, submitted, err := submitJob(ctx, user.ScreenName, user.ID, s.ds, s.topic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &analyticspb.AnalyseReply{Job: pbJob(job), Submitted: submitted}, nil
+}
+
+// GetAnalysis works like /api/v1/analyse, it gets the user's analysis or
+// submits them to be analysed if they have not been yet.
+func (s *AnalyticsService) GetAnalysis(ctx context.Context, req *analyticspb.UserRequest) (*analyticspb.AnalysisReply, error) {
+	user, err := findUser(s.users, req.Username, req.UserId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	data, err := getData(ctx, user.ScreenName, user.ID, s.ds, s.topic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if message, ok := data.(JobMessage); ok {
+		return &analyticspb.AnalysisReply{Message: message.Message, Job: pbJob(message.Job)}, nil
+	}
+	doc := data.(AnalysedDocument)
+	return &analyticspb.AnalysisReply{Document: pbDocument(&doc)}, nil
+}
+
+// usersValues returns req as the query parameters of /api/v1/users, so that it
+// is checked the same way.
+func usersValues(req *analyticspb.ListUsersRequest) url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{"prefix": req.Prefix, "sort": req.Sort, "order": req.Order, "cursor": req.Cursor} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if req.MinScore != nil {
+		values.Set("min_score", strconv.FormatFloat(req.MinScore.Value, 'f', -1, 64))
+	}
+	if req.MaxScore != nil {
+		values.Set("max_score", strconv.FormatFloat(req.MaxScore.Value, 'f', -1, 64))
+	}
+	if req.Limit != 0 {
+		values.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	return values
+}
+
+// ListUsers works like /api/v1/users, it gets a page of the analysed users.
+func (s *AnalyticsService) ListUsers(ctx context.Context, req *analyticspb.ListUsersRequest) (*analyticspb.UsersPage, error) {
+	query, err := unmarshalUsersQuery(usersValues(req))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	page, err := listUsers(s.ds, query)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return pbUsersPage(page), nil
+}
+
+// WatchJob works like /api/v1/analyse/stream, it sends an event every time the
+// job analysing the user changes and finishes with the analysed document.
+func (s *AnalyticsService) WatchJob(req *analyticspb.UserRequest, stream analyticspb.Analytics_WatchJobServer) error {
+	user, err := findUser(s.users, req.Username, req.UserId)
+	if err != nil {
+		return grpcError(err)
+	}
+	data, err := getData(stream.Context(), user.ScreenName, user.ID, s.ds, s.topic)
+	if err != nil {
+		return grpcError(err)
+	}
+	message, ok := data.(JobMessage)
+	if !ok {
+		// the user has already been analysed
+		doc := data.(AnalysedDocument)
+		return stream.Send(&analyticspb.JobEvent{Event: eventDone, Document: pbDocument(&doc)})
+	}
+	if err := stream.Send(&analyticspb.JobEvent{Event: eventStatus, Job: pbJob(message.Job)}); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	job, err := followJob(ctx, message.Job, s.ds, func(job *Job) error {
+		return stream.Send(&analyticspb.JobEvent{Event: eventStatus, Job: pbJob(job)})
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	switch job.Status {
+	case jobStatusDone:
+		doc := &AnalysedDocument{}
+		if err := s.ds.Get(ctx, datastore.IDKey(userKind, job.UserID, nil), doc); err != nil {
+			return grpcError(err)
+		}
+		return stream.Send(&analyticspb.JobEvent{Event: eventDone, Document: pbDocument(doc)})
+	case jobStatusFailed:
+		return stream.Send(&analyticspb.JobEvent{Event: eventFailed, Job: pbJob(job), Message: "This user could not be analysed."})
+	}
+	return stream.Send(&analyticspb.JobEvent{Event: eventTimeout, Job: pbJob(job), Message: "This user is still being analysed. Check back later to see more about them."})
+}
+
+// InitGRPC creates the gRPC server and registers the analytics service on it.
+// Calls are authenticated with keys and held to the rate limits of limiter.
+func InitGRPC(users *UserCache, ds *datastore.Client, topic *pubsub.Topic, keys *APIKeys, limiter *RateLimiter) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(logUnary, authUnary(keys), limitUnary(limiter)),
+		grpc.ChainStreamInterceptor(logStream, authStream(keys), limitStream(limiter)),
+	)
+	analyticspb.RegisterAnalyticsServer(server, &AnalyticsService{users: users, ds: ds, topic: topic})
+	return server
+}
+
+// ServeGRPC serves the gRPC server on GRPC_ADDRESS until it fails.
+func ServeGRPC(server *grpc.Server) {
+	address := os.Getenv(envVarNames[evGRPCAddress])
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Could not listen for gRPC on %s: %v\n", address, err)
+	}
+	log.Fatal(server.Serve(listener))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimitCall(t *testing.T) {
+	limiter := &RateLimiter{
+		limits:   map[string]Limit{"/analyse": {Rate: 0.001, Burst: 1}},
+		fallback: Limit{Rate: 10, Burst: 30},
+		store:    &memoryStore{buckets: make(map[string]*tokenBucket), swept: time.Now()},
+	}
+	alice := withCaller(context.Background(), &Caller{ID: "alice"})
+	bob := withCaller(context.Background(), &Caller{ID: "bob"})
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		ok     bool
+	}{
+		{"the first analyse", alice, "/twitteranalytics.v1.Analytics/Analyse", true},
+		{"GetAnalysis shares the limit of /analyse", alice, "/twitteranalytics.v1.Analytics/GetAnalysis", false},
+		{"another caller has their own limit", bob, "/twitteranalytics.v1.Analytics/Analyse", true},
+		{"a method of another route is not limited by /analyse", alice, "/twitteranalytics.v1.Analytics/ListUsers", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, err := limitCall(test.ctx, limiter, test.method)
+			if test.ok && (err != nil || limitKeyFrom(ctx) == "") {
+				t.Errorf("limitCall() = %v, want the call to be allowed", err)
+			}
+			if !test.ok && status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("limitCall() = %v, want %s", err, codes.ResourceExhausted)
+			}
+		})
+	}
+}
+
+func TestGRPCRoute(t *testing.T) {
+	tests := []struct {
+		method, route string
+	}{
+		{"/twitteranalytics.v1.Analytics/Analyse", "/analyse"},
+		{"/twitteranalytics.v1.Analytics/GetAnalysis", "/analyse"},
+		{"/twitteranalytics.v1.Analytics/ListUsers", "/users"},
+		{"/twitteranalytics.v1.Analytics/WatchJob", "/analyse/stream"},
+		{"/twitteranalytics.v1.Analytics/Unknown", "/twitteranalytics.v1.Analytics/Unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			if route := grpcRoute(test.method); route != test.route {
+				t.Errorf("grpcRoute(%q) = %q, want %q", test.method, route, test.route)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+type (
+	// Job is the entity in the datastore that records a fetch request for a
+	// user while it moves through the pipeline. There is at most one Job per
+	// user, it is keyed by the user's id.
+	Job struct {
+		Username           string
+		UserID             int64
+		Status             string
+		Requested, Updated time.Time
+	}
+
+	// JobMessage is returned in place of an AnalysedDocument while the user is
+	// waiting to be analysed.
+	JobMessage struct {
+		Message string
+		Job     *Job
+	}
+
+	// SubmitFailure is a user that could not be submitted to be analysed, with
+	// the Code and Message that the error would have been returned with.
+	SubmitFailure struct {
+		Name, Code, Message string
+	}
+)
+
+const (
+	jobKind = "Job"
+
+	jobStatusQueued = "queued"
+	jobStatusDone   = "done"
+	jobStatusFailed = "failed"
+
+	// jobTimeout is how long a job can go without finishing before another
+	// request for the same user is allowed to submit it again.
+	jobTimeout = 30 * time.Minute
+
+	// submitRole is the role a caller needs to submit new jobs, how many they
+	// can submit is bounded by their quota.
+	submitRole = roleViewer
+)
+
+// jobKey returns the key of the Job entity for the user with userID.
+func jobKey(userID int64) *datastore.Key {
+	return datastore.IDKey(jobKind, userID, nil)
+}
+
+// InFlight returns true if the job has not finished yet and has not been
+// waiting long enough to be considered lost.
+func (j *Job) InFlight() bool {
+	if j.Status == jobStatusDone || j.Status == jobStatusFailed {
+		return false
+	}
+	return time.Since(j.Requested) < jobTimeout
+}
+
+// submitJob records a job for the user and publishes a FetchMessage for it. If
+// a job for the user is already in flight then nothing is published and the
+// existing job is returned instead. The returned bool is true only when a new
+// job was submitted. New jobs need the caller in ctx to have submitRole and
+// are counted against their quota, which is refunded if the job cannot be
+// published.
+func submitJob(ctx context.Context, username string, userID int64, ds *datastore.Client, topic *pubsub.Topic) (*Job, bool, error) {
+	job := &Job{}
+	submitted := false
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		submitted = false
+		if err := tx.Get(jobKey(userID), job); err == nil && job.InFlight() {
+			// collapse this request onto the job that is already running
+			return nil
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := checkSameSite(ctx); err != nil {
+			return err
+		}
+		if err := requireRole(ctx, submitRole); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := useQuota(tx, callerFrom(ctx), now); err != nil {
+			return err
+		}
+		*job = Job{
+			Username:  username,
+			UserID:    userID,
+			Status:    jobStatusQueued,
+			Requested: now,
+			Updated:   now,
+		}
+		submitted = true
+		_, err := tx.Put(jobKey(userID), job)
+		return err
+	})
+	if err != nil || !submitted {
+		return job, false, err
+	}
+	if err := publishFetch(ctx, username, userID, topic); err != nil {
+		// the job will never be picked up, so let the next request retry it
+		// and give the caller back what it used of their quota
+		failed := *job
+		failed.Status, failed.Updated = jobStatusFailed, time.Now()
+		_, txErr := ds.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+			if _, err := tx.Put(jobKey(userID), &failed); err != nil {
+				return err
+			}
+			return refundQuota(tx, callerFrom(ctx), job.Requested)
+		})
+		if txErr != nil {
+			return nil, false, txErr
+		}
+		return nil, false, err
+	}
+	jobsSubmitted.Inc()
+	logEntry(levelInfo, "job submitted", logFields{"request_id": requestIDFrom(ctx), "user_id": userID, "username": username})
+	return job, true, nil
+}
+
+// checkSubmit fails unless the caller in ctx can submit n new jobs, it is
+// checked before submitting many users at once so that they are not left half
+// submitted when the caller's role or quota runs out partway through.
+func checkSubmit(ctx context.Context, n int, ds *datastore.Client) error {
+	if n == 0 {
+		return nil
+	}
+	if err := checkSameSite(ctx); err != nil {
+		return err
+	}
+	if err := requireRole(ctx, submitRole); err != nil {
+		return err
+	}
+	return checkQuota(ds, callerFrom(ctx), n)
+}
+
+// submitFailure records that the user with the name could not be submitted
+// because of err, which is logged if it was not expected.
+func submitFailure(ctx context.Context, name string, err error) SubmitFailure {
+	status, code := classify(err)
+	if status >= http.StatusInternalServerError {
+		logEntry(levelError, err.Error(), logFields{"location": "Submit", "request_id": requestIDFrom(ctx), "username": name})
+	}
+	return SubmitFailure{Name: name, Code: code, Message: publicMessage(err, code)}
+}
+
+// publishFetch sends a FetchMessage for the user to the fetcher, carrying the
+// id of the request in ctx.
+func publishFetch(ctx context.Context, username string, userID int64, topic *pubsub.Topic) error {
+	fm := &FetchMessage{
+		Username:  username,
+		UserID:    userID,
+		RequestID: requestIDFrom(ctx),
+	}
+	message, err := json.Marshal(fm)
+	if err != nil {
+		return err
+	}
+	res := topic.Publish(context.Background(), &pubsub.Message{
+		Data: message,
+	})
+	_, err = res.Get(context.Background())
+	return err
+}
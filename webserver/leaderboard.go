@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type (
+	// LeaderboardEntry is a single user on a leaderboard.
+	LeaderboardEntry struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore                   float64
+	}
+
+	// Board is the users that rank highest, or lowest if Order is asc, on
+	// Metric out of every user with at least MinTweets tweets, as built by
+	// name-index.
+	Board struct {
+		Metric, Order string
+		MinTweets     int
+		Users         []LeaderboardEntry
+	}
+
+	// Leaderboards is every board built by name-index.
+	Leaderboards struct {
+		Generated time.Time
+		Boards    []Board
+	}
+
+	// Leaderboard is a ranking of users that is returned to the caller.
+	Leaderboard struct {
+		Metric, Order string
+		MinTweets     int
+		Generated     time.Time
+		Users         []LeaderboardEntry
+	}
+
+	// LeaderboardCache keeps the boards built by name-index in memory, they
+	// are read again at most every manifestTTL.
+	LeaderboardCache struct {
+		bucket *storage.BucketHandle
+
+		mu      sync.Mutex
+		boards  *Leaderboards
+		checked time.Time
+	}
+)
+
+const (
+	leaderboardsObject = "name-index/leaderboards.json"
+
+	leaderboardAverage  = "average"
+	leaderboardPositive = "positive"
+	leaderboardNegative = "negative"
+
+	// defaultLeaderboardLimit is how many users are ranked when no limit is
+	// given.
+	defaultLeaderboardLimit = 25
+	// maxLeaderboardLimit is the most users that can be ranked.
+	maxLeaderboardLimit = 100
+)
+
+// NewLeaderboardCache creates a cache of the boards in bucket.
+func NewLeaderboardCache(bucket *storage.BucketHandle) *LeaderboardCache {
+	return &LeaderboardCache{bucket: bucket}
+}
+
+// get returns the boards, reading them again if they are older than
+// manifestTTL. If they cannot be read then the last boards are used.
+func (c *LeaderboardCache) get() (*Leaderboards, error) {
+	c.mu.Lock()
+	boards, checked := c.boards, c.checked
+	c.mu.Unlock()
+	if boards != nil && time.Since(checked) < manifestTTL {
+		return boards, nil
+	}
+	fresh := &Leaderboards{Boards: make([]Board, 0)}
+	// boards that have not been built yet have nobody on them
+	if err := readObject(c.bucket, leaderboardsObject, fresh); err != nil && err != storage.ErrObjectNotExist {
+		if boards == nil {
+			return nil, err
+		}
+		logEntry(levelError, "could not refresh the leaderboards: "+err.Error(), logFields{"location": "Leaderboards"})
+		fresh = boards
+	}
+	c.mu.Lock()
+	c.boards, c.checked = fresh, time.Now()
+	c.mu.Unlock()
+	return fresh, nil
+}
+
+// Rank returns at most limit users ranked on the metric in the order, out of
+// the users with at least minTweets tweets. It is answered from the board with
+// the highest minimum that is not over minTweets, filtered down to minTweets.
+func (c *LeaderboardCache) Rank(metric, order string, minTweets, limit int) (*Leaderboard, error) {
+	boards, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	leaderboard := &Leaderboard{
+		Metric:    metric,
+		Order:     order,
+		MinTweets: minTweets,
+		Generated: boards.Generated,
+		Users:     make([]LeaderboardEntry, 0, limit),
+	}
+	var best *Board
+	for i := range boards.Boards {
+		board := &boards.Boards[i]
+		if board.Metric != metric || board.Order != order || board.MinTweets > minTweets {
+			continue
+		}
+		if best == nil || board.MinTweets > best.MinTweets {
+			best = board
+		}
+	}
+	if best == nil {
+		return leaderboard, nil
+	}
+	for _, user := range best.Users {
+		if len(leaderboard.Users) == limit {
+			break
+		}
+		if user.PositiveTweets+user.NegativeTweets >= minTweets {
+			leaderboard.Users = append(leaderboard.Users, user)
+		}
+	}
+	return leaderboard, nil
+}
+
+// unmarshalLeaderboard gets the metric, order and minimum number of tweets of
+// a leaderboard from the query parameters.
+func unmarshalLeaderboard(values url.Values) (string, string, int, error) {
+	metric := values.Get("metric")
+	switch metric {
+	case "":
+		metric = leaderboardAverage
+	case leaderboardAverage, leaderboardPositive, leaderboardNegative:
+	default:
+		return "", "", 0, invalid("metric must be %s, %s or %s", leaderboardAverage, leaderboardPositive, leaderboardNegative)
+	}
+	order := values.Get("order")
+	if order == "" {
+		order = "desc"
+	} else if order != "asc" && order != "desc" {
+		return "", "", 0, invalid("order must be asc or desc")
+	}
+	minTweets := 1
+	if m := values.Get("min_tweets"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			return "", "", 0, err
+		}
+		if n < 1 {
+			return "", "", 0, invalid("min_tweets must be positive")
+		}
+		minTweets = n
+	}
+	return metric, order, minTweets, nil
+}
+
+// LeaderboardHO returns a handler that ranks the analysed users. metric is
+// average, positive or negative, order is asc or desc, min_tweets is the
+// smallest sample a user needs to be ranked and limit caps how many users are
+// returned.
+func LeaderboardHO(cache *LeaderboardCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		metric, order, minTweets, err := unmarshalLeaderboard(r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		limit, err := unmarshalLimit(r.URL.Query(), defaultLeaderboardLimit)
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		if limit > maxLeaderboardLimit {
+			writeError("Unmarshal", invalid("limit can be at most %d", maxLeaderboardLimit), w)
+			return
+		}
+		leaderboard, err := cache.Rank(metric, order, minTweets, limit)
+		if err != nil {
+			writeError("Rank", err, w)
+			return
+		}
+		writeJSON(leaderboard, w)
+	}
+}
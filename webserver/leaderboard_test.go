@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRank(t *testing.T) {
+	users := []LeaderboardEntry{
+		{Username: "a", PositiveTweets: 5},
+		{Username: "b", PositiveTweets: 60},
+		{Username: "c", PositiveTweets: 20},
+		{Username: "d", PositiveTweets: 120},
+	}
+	cache := &LeaderboardCache{checked: time.Now(), boards: &Leaderboards{Boards: []Board{
+		{Metric: leaderboardAverage, Order: "desc", MinTweets: 1, Users: users},
+		{Metric: leaderboardAverage, Order: "desc", MinTweets: 50, Users: []LeaderboardEntry{users[1], users[3]}},
+		{Metric: leaderboardAverage, Order: "asc", MinTweets: 1, Users: []LeaderboardEntry{users[3]}},
+	}}}
+	tests := []struct {
+		name          string
+		metric, order string
+		minTweets     int
+		limit         int
+		want          []string
+	}{
+		{"the board with the minimum", leaderboardAverage, "desc", 1, 10, []string{"a", "b", "c", "d"}},
+		{"the limit", leaderboardAverage, "desc", 1, 2, []string{"a", "b"}},
+		{"a minimum between boards is filtered from the one below it", leaderboardAverage, "desc", 10, 10, []string{"b", "c", "d"}},
+		{"the highest board that is not over the minimum", leaderboardAverage, "desc", 100, 10, []string{"d"}},
+		{"the order picks the board", leaderboardAverage, "asc", 1, 10, []string{"d"}},
+		{"a metric without a board", leaderboardPositive, "desc", 1, 10, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leaderboard, err := cache.Rank(test.metric, test.order, test.minTweets, test.limit)
+			if err != nil {
+				t.Fatalf("Rank() = %v", err)
+			}
+			names := make([]string, len(leaderboard.Users))
+			for i, user := range leaderboard.Users {
+				names[i] = user.Username
+			}
+			if !reflect.DeepEqual(names, test.want) || leaderboard.MinTweets != test.minTweets {
+				t.Errorf("Rank() = %v with at least %d tweets, want %v with at least %d", names, leaderboard.MinTweets, test.want, test.minTweets)
+			}
+		})
+	}
+}
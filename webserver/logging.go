@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// logFields are the fields of a log entry besides its time, level, service
+	// and message.
+	logFields map[string]interface{}
+
+	// jsonLogWriter turns every line the standard logger writes into a JSON log
+	// entry, so that everything that is logged comes out structured. Entries
+	// are written with logEntry, so the standard logger is only left with
+	// fatal errors and the errors of libraries, which are logged as errors.
+	jsonLogWriter struct{}
+
+	// accessLog is what is learnt about a request while it is handled that is
+	// logged once it has been. The handlers fill it in through the request's
+	// context.
+	accessLog struct {
+		Caller, Account string
+		UserID          int64
+	}
+
+	// statusRecorder is a ResponseWriter that remembers the status and how many
+	// bytes were written, it still flushes so that Server-Sent Events work.
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+		bytes  int
+	}
+
+	// requestIDContextKey is the key the request id is stored under in a
+	// request's context.
+	requestIDContextKey struct{}
+	// accessLogContextKey is the key the accessLog is stored under in a
+	// request's context.
+	accessLogContextKey struct{}
+)
+
+const (
+	serviceName = "webserver"
+
+	levelInfo  = "info"
+	levelError = "error"
+)
+
+// logMu stops log entries that are written at the same time from interleaving.
+var logMu sync.Mutex
+
+// InitLogging makes the standard logger write JSON log entries.
+func InitLogging() {
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+}
+
+// logEntry writes a JSON log entry with the level, message and fields to
+// stderr.
+func logEntry(level, message string, fields logFields) {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for name, value := range fields {
+		entry[name] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["service"] = serviceName
+	entry["message"] = message
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": levelError, "service": serviceName, "message": message, "error": err.Error()})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	logEntry(levelError, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// withRequestID returns a copy of ctx that carries the request id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestIDFrom returns the request id in ctx, it is empty if there is not
+// one.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// accessLogFrom returns the accessLog of the request in ctx, it is nil if the
+// request is not logged.
+func accessLogFrom(ctx context.Context) *accessLog {
+	entry, _ := ctx.Value(accessLogContextKey{}).(*accessLog)
+	return entry
+}
+
+// logCaller records who made the request in ctx in its access log.
+func logCaller(ctx context.Context, caller *Caller) {
+	if entry := accessLogFrom(ctx); entry != nil && caller != nil {
+		entry.Caller, entry.Account = caller.Name, caller.Account
+	}
+}
+
+// logUserID records the Twitter user the request in ctx was about in its
+// access log.
+func logUserID(ctx context.Context, userID int64) {
+	if entry := accessLogFrom(ctx); entry != nil {
+		entry.UserID = userID
+	}
+}
+
+// fields returns the fields the access log adds to a log entry.
+func (a *accessLog) fields(fields logFields) logFields {
+	if a.Caller != "" {
+		fields["caller"] = a.Caller
+	}
+	if a.Account != "" {
+		fields["account"] = a.Account
+	}
+	if a.UserID != 0 {
+		fields["user_id"] = a.UserID
+	}
+	return fields
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// LogHandlerHO wraps fun so that every request is written to the access log
+// with its request id, status, latency and who made it once it has been
+// handled.
+func LogHandlerHO(fun http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLog{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		fun(recorder, r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, entry)))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		level := levelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = levelError
+		}
+		logEntry(level, "request", entry.fields(logFields{
+			"request_id": w.Header().Get(requestIDHeader),
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     recorder.status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"bytes":      recorder.bytes,
+			"remote":     r.RemoteAddr,
+		}))
+	}
+}
+
+// LogHandler writes every request to handler to the access log.
+type LogHandler struct {
+	handler http.Handler
+}
+
+func (lh LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	LogHandlerHO(lh.handler.ServeHTTP)(w, r)
+}
+
+func NewLogHandler(handler http.Handler) http.Handler {
+	return LogHandler{handler}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -24,6 +23,15 @@ var envVarNames = []string{
 	"PROJECT_ID",
 	"PUB_SUB_PUBLISH_ID",
 	"ADDRESS",
+	"USER_CACHE_DATASTORE",
+	"GRPC_ADDRESS",
+	"ANONYMOUS_DAILY_QUOTA",
+	"ANONYMOUS_ROLE",
+	"RATE_LIMITS",
+	"RATE_LIMIT_REDIS",
+	"TRUSTED_PROXIES",
+	"METRICS_ADDRESS",
+	"ACCOUNT_DAILY_QUOTA",
 }
 
 const (
@@ -36,10 +44,15 @@ const (
 	evProjectID
 	evPubSubPublishID
 	evAddress
-)
-
-const (
-	objectKey = "name-index.json"
+	evUserCacheDatastore
+	evGRPCAddress
+	evAnonymousDailyQuota
+	evAnonymousRole
+	evRateLimits
+	evRateLimitRedis
+	evTrustedProxies
+	evMetricsAddress
+	evAccountDailyQuota
 )
 
 // InitTwitter initializes the twitter api client
@@ -68,7 +81,7 @@ func InitDatastore() *datastore.Client {
 
 func InitPubSub() *pubsub.Client {
 	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, os.Getenv(envVarNames[evProjectID])))
+	client, err := pubsub.NewClient(ctx, os.Getenv(envVarNames[evProjectID]))
 	if err != nil {
 		log.Fatalf("Could not set up pub sub client: #{err}\n")
 	}
@@ -119,16 +132,13 @@ func InitLibs() (*twitter.Client, *datastore.Client, *storage.BucketHandle, *pub
 	return InitTwitter(), InitDatastore(), InitStorage(), InitPubSub()
 }
 
-// Users gets a list of users from a file in the bucket
-func UsersHO(bucket *storage.BucketHandle) http.HandlerFunc {
-	obj := bucket.Object(objectKey)
-	return func(w http.ResponseWriter, r *http.Request) {
-		dataReader, err := obj.NewReader(context.Background())
-		if err != nil {
-			w.Write([]byte("{\"Message\":\"Could not get index from bucket. There are likely no users in it yet. Make a new Query!\""))
-		}
-		io.Copy(w, dataReader)
+// InitUserCache creates the cache of Twitter users, it is backed by the
+// datastore if USER_CACHE_DATASTORE is "true".
+func InitUserCache(tClient *twitter.Client, ds *datastore.Client) *UserCache {
+	if os.Getenv(envVarNames[evUserCacheDatastore]) != "true" {
+		ds = nil
 	}
+	return NewUserCache(tClient, ds, userCacheSize, userCacheTTL)
 }
 
 // Health is a probe endpoint, it always returns StatusOK and "Healthy".
@@ -136,38 +146,73 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Healthy"))
 }
 
-func LogHandlerHO(fun http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.RequestURI)
-		fun(w, r)
-	}
-}
-
-type LogHandler struct {
-	handler http.Handler
-}
-
-func (lh LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
-	lh.handler.ServeHTTP(w, r)
-}
-
-func NewLogHandler(handler http.Handler) http.Handler {
-	return LogHandler{handler}
-}
-
-// main starts up the webserver.
+// main starts up the webserver, or runs an admin command if one is given.
 func main() {
+	if len(os.Args) > 1 {
+		RunAdmin(os.Args[1:])
+		return
+	}
+	InitLogging()
 	// Get clients
 	tClient, ds, bucket, psClient := InitLibs()
 	topic := ConfigurePubSub(psClient)
+	users := InitUserCache(tClient, ds)
+	index := NewSuggestIndex(bucket)
+	leaderboards := NewLeaderboardCache(bucket)
+	keys := InitAPIKeys(ds)
+	limiter := InitRateLimiter()
+	schema := InitGraphQL(users, ds, topic, limiter)
 	// Handle requests for static files
-	http.Handle("/static/", NewLogHandler(http.StripPrefix("/static", http.FileServer(http.Dir("../static")))))
-	// Handle calls to the analysis endpoint
-	http.HandleFunc("/api/analyse", LogHandlerHO(GetAnalysisHO(tClient, ds, topic)))
-	// Handle calls to get list of users that have already been analysed
-	http.HandleFunc("/api/users", UsersHO(bucket))
-	// Handle calls to the health endpoint
-	http.HandleFunc("/api/health", Health)
+	http.Handle("/static/", MetricsHO("/static/", NewLogHandler(http.StripPrefix("/static", http.FileServer(http.Dir("../static")))).ServeHTTP))
+	routes := []Route{
+		// Handle calls to the analysis endpoint
+		{"/analyse", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/analyse", RoleHO(roleViewer, roleViewer, GetAnalysisHO(users, ds, topic)))))},
+		// Handle calls to stream the progress of an analysis to the browser
+		{"/analyse/stream", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/analyse/stream", RoleHO(roleViewer, roleViewer, StreamAnalysisHO(users, ds, topic)))))},
+		// Handle calls to analyse many users at once and to poll on them
+		{"/analyse/batch", []string{http.MethodGet, http.MethodPost}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/analyse/batch", RoleHO(roleViewer, roleAnalyst, BatchHO(users, ds, topic)))))},
+		// Handle calls to compare users side by side
+		{"/compare", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/compare", RoleHO(roleViewer, roleViewer, CompareHO(users, ds, topic)))))},
+		// Handle calls to list, track and untrack users that are kept up to date
+		{"/tracked", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/tracked", RoleHO(roleViewer, roleAnalyst, TrackedHO(users, ds, topic)))))},
+		// Handle calls to list, create and delete webhook subscriptions
+		{"/webhooks", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/webhooks", RoleHO(roleAnalyst, roleAnalyst, WebhooksHO(ds)))))},
+		// Handle calls to get the alert history and to manage the rules behind it
+		{"/alerts", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/alerts", RoleHO(roleViewer, roleViewer, AlertsHO(ds)))))},
+		{"/alerts/rules", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/alerts/rules", RoleHO(roleViewer, roleAnalyst, AlertRulesHO(ds)))))},
+		// Handle calls to manage saved groups of users and to get their aggregate sentiment
+		{"/groups", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/groups", RoleHO(roleViewer, roleAnalyst, GroupsHO(users, ds, topic)))))},
+		{"/groups/stats", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/groups/stats", RoleHO(roleViewer, roleViewer, GroupStatsHO(ds)))))},
+		// Handle calls to rank the most positive and most negative users
+		{"/leaderboard", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/leaderboard", RoleHO(roleViewer, roleViewer, LeaderboardHO(leaderboards)))))},
+		// Handle calls to suggest analysed users as the search box is typed in
+		{"/users/suggest", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/users/suggest", RoleHO(roleViewer, roleViewer, SuggestHO(index)))))},
+		// Handle calls to resolve a name or id to a single Twitter user
+		{"/users/lookup", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/users/lookup", RoleHO(roleViewer, roleViewer, LookupHO(users)))))},
+		// Handle calls to page through the users that have already been analysed
+		{"/users", []string{http.MethodGet}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/users", RoleHO(roleViewer, roleViewer, UsersHO(ds)))))},
+		// Handle GraphQL queries for exactly the slices of users, analyses and comparisons a chart needs
+		{"/graphql", []string{http.MethodGet, http.MethodPost}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/graphql", RoleHO(roleViewer, roleViewer, GraphQLHO(schema)))))},
+		// Handle calls to register accounts and to sign in and out of them
+		{"/accounts", []string{http.MethodPost}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/accounts", AccountsHO(ds))))},
+		{"/session", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/session", SessionHO(ds))))},
+		// Handle calls from admins to delete users, backfill analyses, rebuild the name index and give accounts roles
+		{"/admin/users", []string{http.MethodDelete}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/admin/users", RoleHO(roleAdmin, roleAdmin, AdminUsersHO(ds, bucket)))))},
+		{"/admin/backfill", []string{http.MethodPost}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/admin/backfill", RoleHO(roleAdmin, roleAdmin, AdminBackfillHO(ds, topic)))))},
+		{"/admin/reindex", []string{http.MethodPost}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/admin/reindex", RoleHO(roleAdmin, roleAdmin, AdminReindexHO(ds)))))},
+		{"/admin/accounts", []string{http.MethodGet, http.MethodPut}, LogHandlerHO(keys.AuthHO(limiter.LimitHO("/admin/accounts", RoleHO(roleAdmin, roleAdmin, AdminAccountsHO(ds)))))},
+		// Handle calls for the OpenAPI document that describes these endpoints
+		{"/openapi.json", []string{http.MethodGet}, OpenAPI},
+		// Handle calls to the health endpoint
+		{"/health", []string{http.MethodGet}, Health},
+	}
+	if err := CheckSpec(openAPISpec, routes); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	HandleRoutes(routes)
+	// Serve the same analysis to backend services over gRPC
+	go ServeGRPC(InitGRPC(users, ds, topic, keys, limiter))
+	// Serve the metrics away from the API, so that they are not public
+	go ServeMetrics()
 	log.Fatal(http.ListenAndServe(os.Getenv(envVarNames[evAddress]), nil))
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+)
+
+// The metrics of the webserver, they are served at /metrics on METRICS_ADDRESS
+// so that they are not reachable through the ingress.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webserver_http_requests_total",
+		Help: "How many HTTP requests were handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webserver_http_request_duration_seconds",
+		Help:    "How long HTTP requests took to handle, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webserver_grpc_requests_total",
+		Help: "How many gRPC calls were handled, by method and code.",
+	}, []string{"method", "code"})
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webserver_grpc_request_duration_seconds",
+		Help:    "How long gRPC calls took to handle, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	jobsSubmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webserver_jobs_submitted_total",
+		Help: "How many users were submitted to be fetched and analysed.",
+	})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webserver_rate_limited_total",
+		Help: "How many requests were refused for going over the rate limit, by route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, grpcRequests, grpcDuration, jobsSubmitted, rateLimited)
+}
+
+// MetricsHO wraps fun so that the requests to the route are counted and
+// timed.
+func MetricsHO(route string, fun http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		fun(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeCall counts and times a gRPC call that has finished.
+func observeCall(method string, code codes.Code, start time.Time) {
+	grpcRequests.WithLabelValues(method, code.String()).Inc()
+	grpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// ServeMetrics serves the metrics at /metrics on METRICS_ADDRESS, it is not
+// served at all if METRICS_ADDRESS is empty.
+func ServeMetrics() {
+	addr := os.Getenv(envVarNames[evMetricsAddress])
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// migrateBatchSize is how many users are migrated in each transaction.
+const migrateBatchSize = 100
+
+// property returns the value of the property with the name, it is nil if
+// there is no such property.
+func property(props datastore.PropertyList, name string) interface{} {
+	for _, p := range props {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+// migrateUsers sets SearchName and LastAnalysed on the users that were
+// analysed before the analyser stored them, so that /users can search and sort
+// them and backfills find them. LastAnalysed is when their job was last
+// updated, or the zero time if they have no job so that they are the first to
+// be backfilled. Users that already have a SearchName are skipped, so it can
+// be run again.
+func migrateUsers(ds *datastore.Client) error {
+	ctx := context.Background()
+	keys, err := ds.GetAll(ctx, datastore.NewQuery(userKind).KeysOnly(), nil)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for start := 0; start < len(keys); start += migrateBatchSize {
+		end := start + migrateBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		n, err := migrateUserBatch(ctx, keys[start:end], ds)
+		if err != nil {
+			return err
+		}
+		migrated += n
+	}
+	fmt.Printf("Migrated %d of %d user(s).\n", migrated, len(keys))
+	return nil
+}
+
+// migrateUserBatch migrates the users with the keys in one transaction, so
+// that an analysis that is stored at the same time is not lost. They are
+// loaded as property lists so that nothing else about them changes. It
+// returns how many of them needed migrating.
+func migrateUserBatch(ctx context.Context, keys []*datastore.Key, ds *datastore.Client) (int, error) {
+	migrated := 0
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		migrated = 0
+		users := make([]datastore.PropertyList, len(keys))
+		if err := tx.GetMulti(keys, users); err != nil {
+			return err
+		}
+		jobKeys := make([]*datastore.Key, len(keys))
+		for i, key := range keys {
+			jobKeys[i] = jobKey(key.ID)
+		}
+		jobs := make([]Job, len(keys))
+		hasJob := make([]bool, len(keys))
+		err := tx.GetMulti(jobKeys, jobs)
+		for i := range hasJob {
+			hasJob[i] = err == nil
+		}
+		if multi, ok := err.(datastore.MultiError); ok {
+			for i, jobErr := range multi {
+				if jobErr != nil && jobErr != datastore.ErrNoSuchEntity {
+					return jobErr
+				}
+				hasJob[i] = jobErr == nil
+			}
+		} else if err != nil {
+			return err
+		}
+		changedKeys := make([]*datastore.Key, 0, len(keys))
+		changed := make([]datastore.PropertyList, 0, len(keys))
+		for i, props := range users {
+			if property(props, "SearchName") != nil {
+				continue
+			}
+			username, _ := property(props, "Username").(string)
+			lastAnalysed := time.Time{}
+			if hasJob[i] {
+				lastAnalysed = jobs[i].Updated
+			}
+			props = append(props,
+				datastore.Property{Name: "SearchName", Value: strings.ToLower(username)},
+				datastore.Property{Name: "LastAnalysed", Value: lastAnalysed},
+			)
+			changedKeys = append(changedKeys, keys[i])
+			changed = append(changed, props)
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		migrated = len(changed)
+		_, err = tx.PutMulti(changedKeys, changed)
+		return err
+	})
+	return migrated, err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type (
+	// Limit is how often a caller can make requests to a route: Rate requests
+	// a second on average and up to Burst at once. A Rate of zero has no
+	// limit.
+	Limit struct {
+		Rate  float64
+		Burst int
+	}
+
+	// limitStore keeps the token buckets. take takes a token from the bucket
+	// with the key, which holds limit.Burst tokens and gains limit.Rate a
+	// second. If the bucket is empty it returns how long until it has a token.
+	limitStore interface {
+		take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+	}
+
+	// tokenBucket is a bucket of the memoryStore with the limit, it had
+	// tokens at updated.
+	tokenBucket struct {
+		tokens  float64
+		updated time.Time
+		limit   Limit
+	}
+
+	// memoryStore keeps the buckets in this replica's memory, so every replica
+	// allows the whole limit. Full buckets are dropped every sweepInterval.
+	memoryStore struct {
+		mu      sync.Mutex
+		buckets map[string]*tokenBucket
+		swept   time.Time
+	}
+
+	// redisStore keeps the buckets in Redis, so the limits hold across every
+	// replica.
+	redisStore struct {
+		client *redis.Client
+	}
+
+	// RateLimiter limits how often each caller can make requests to each
+	// route. Callers with an API key or an account are told apart by it and
+	// everybody else by their IP address, which is taken from X-Forwarded-For
+	// when there are trustedProxies in front of the webserver.
+	RateLimiter struct {
+		limits         map[string]Limit
+		fallback       Limit
+		store          limitStore
+		trustedProxies int
+	}
+)
+
+const (
+	// defaultLimitRoute is the route in RATE_LIMITS whose limit applies to
+	// every route that is not given its own.
+	defaultLimitRoute = "*"
+	// sweepInterval is how often the memoryStore drops full buckets.
+	sweepInterval = time.Minute
+	// redisTimeout is the longest a request waits on Redis before it is let
+	// through without being limited.
+	redisTimeout = 100 * time.Millisecond
+)
+
+// takeScript refills and takes a token from the bucket in KEYS[1] atomically.
+// ARGV holds the rate, the burst and the time now in seconds. It returns 1 if a
+// token was taken and otherwise 0 and how many seconds until there is one. The
+// bucket expires once it would be full again.
+var takeScript = redis.NewScript(`
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local taken, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {taken, tostring(wait)}
+`)
+
+// refill returns how many tokens a bucket that had tokens at updated has now.
+func refill(tokens float64, updated, now time.Time, limit Limit) float64 {
+	return math.Min(float64(limit.Burst), tokens+now.Sub(updated).Seconds()*limit.Rate)
+}
+
+func (s *memoryStore) take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > sweepInterval {
+		for k, b := range s.buckets {
+			if refill(b.tokens, b.updated, now, b.limit) >= float64(b.limit.Burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.tokens, b.updated = refill(b.tokens, b.updated, now, limit), now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+func (s *redisStore) take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	args := []interface{}{strconv.FormatFloat(limit.Rate, 'f', -1, 64), limit.Burst, strconv.FormatFloat(now, 'f', 6, 64)}
+	reply, err := takeScript.Run(ctx, s.client, []string{key}, args...).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	res, ok := reply.([]interface{})
+	if !ok || len(res) != 2 {
+		return false, 0, fmt.Errorf("the rate limit script returned %v", reply)
+	}
+	if taken, _ := res[0].(int64); taken == 1 {
+		return true, 0, nil
+	}
+	wait, _ := res[1].(string)
+	seconds, err := strconv.ParseFloat(wait, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return false, time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseLimits reads limits in the form route=rate:burst, separated by commas,
+// for example "*=5:20,/analyse=0.5:5".
+func parseLimits(value string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not route=rate:burst", field)
+		}
+		numbers := strings.Split(parts[1], ":")
+		if len(numbers) != 2 {
+			return nil, fmt.Errorf("%q is not route=rate:burst", field)
+		}
+		rate, err := strconv.ParseFloat(numbers[0], 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("the rate of %s must be a number that is not negative", parts[0])
+		}
+		burst, err := strconv.Atoi(numbers[1])
+		if err != nil || (rate > 0 && burst < 1) {
+			return nil, fmt.Errorf("the burst of %s must be at least 1", parts[0])
+		}
+		limits[parts[0]] = Limit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// InitRateLimiter creates the rate limiter with the limits in RATE_LIMITS. The
+// buckets are kept in the Redis at RATE_LIMIT_REDIS, or in memory if it is
+// empty. TRUSTED_PROXIES is how many proxies in front of the webserver add to
+// X-Forwarded-For.
+func InitRateLimiter() *RateLimiter {
+	limits, err := parseLimits(os.Getenv(envVarNames[evRateLimits]))
+	if err != nil {
+		log.Fatalf("Could not read the rate limits: %v\n", err)
+	}
+	proxies, err := strconv.Atoi(os.Getenv(envVarNames[evTrustedProxies]))
+	if err != nil || proxies < 0 {
+		log.Fatalf("Could not read the number of trusted proxies: %v\n", err)
+	}
+	limiter := &RateLimiter{limits: limits, fallback: limits[defaultLimitRoute], trustedProxies: proxies}
+	if addr := os.Getenv(envVarNames[evRateLimitRedis]); addr != "" {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			log.Fatalf("Could not connect to Redis: %v\n", err)
+		}
+		limiter.store = &redisStore{client: client}
+	} else {
+		limiter.store = &memoryStore{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+	}
+	return limiter
+}
+
+// clientIP returns the address the request came from. The address the last
+// trusted proxy saw is taken from X-Forwarded-For, since the ones before it
+// could have been made up by the client.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustedProxies > 0 {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if i := len(forwarded) - l.trustedProxies; i >= 0 && strings.TrimSpace(forwarded[i]) != "" {
+			return strings.TrimSpace(forwarded[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitKeyContextKey is the key the caller's rate limit key is stored under in
+// a request's context.
+type limitKeyContextKey struct{}
+
+// limitKey returns who the limits of a caller are kept under: their key or
+// account, or their address if they are anonymous.
+func limitKey(caller *Caller, addr string) string {
+	if caller != nil && caller.ID != anonymousCaller {
+		return "caller:" + caller.ID
+	}
+	return "ip:" + addr
+}
+
+// limitKeyFrom returns the rate limit key in ctx, it is empty if the request
+// was not limited.
+func limitKeyFrom(ctx context.Context) string {
+	who, _ := ctx.Value(limitKeyContextKey{}).(string)
+	return who
+}
+
+// Allow takes a request to the route from the bucket of who. It fails with a
+// 429 and the seconds until the next request is allowed if the bucket is
+// empty. If the store cannot be reached the request is allowed.
+func (l *RateLimiter) Allow(ctx context.Context, route, who string) (int, error) {
+	limit, ok := l.limits[route]
+	if !ok {
+		limit = l.fallback
+	}
+	if limit.Rate <= 0 {
+		return 0, nil
+	}
+	taken, wait, err := l.store.take(ctx, "ratelimit:"+route+":"+who, limit)
+	if err != nil {
+		logEntry(levelError, err.Error(), logFields{"location": "RateLimit", "request_id": requestIDFrom(ctx)})
+		return 0, nil
+	}
+	if taken {
+		return 0, nil
+	}
+	rateLimited.WithLabelValues(route).Inc()
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds, &APIError{
+		Status: http.StatusTooManyRequests,
+		Code:   codeRateLimited,
+		Err:    fmt.Errorf("too many requests to %s, %g a second are allowed with bursts of %d, try again in %d seconds", route, limit.Rate, limit.Burst, seconds),
+	}
+}
+
+// LimitHO wraps fun so that each caller can only make requests to the route as
+// often as its limit allows, the rest fail with a 429 and a Retry-After
+// header. It has to be wrapped by AuthHO. Who the caller is limited as is put
+// in the request's context, so that handlers can hold them to the limits of
+// other routes too.
+func (l *RateLimiter) LimitHO(route string, fun http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		who := limitKey(callerFrom(r.Context()), l.clientIP(r))
+		if seconds, err := l.Allow(r.Context(), route, who); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeError("RateLimit", err, w)
+			return
+		}
+		fun(w, r.WithContext(context.WithValue(r.Context(), limitKeyContextKey{}, who)))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 3}
+	tests := []struct {
+		name string
+		// ago is how long before the request the bucket was last updated,
+		// with tokens left in it, a nil bucket has not been used yet
+		bucket *tokenBucket
+		ago    time.Duration
+		taken  bool
+	}{
+		{"a new bucket is full", nil, 0, true},
+		{"a bucket with a token left", &tokenBucket{tokens: 1, limit: limit}, 0, true},
+		{"an empty bucket", &tokenBucket{tokens: 0.5, limit: limit}, 0, false},
+		{"an empty bucket that has refilled", &tokenBucket{tokens: 0, limit: limit}, 2 * time.Second, true},
+		{"a bucket never holds more than the burst", &tokenBucket{tokens: 0, limit: limit}, time.Hour, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &memoryStore{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+			if test.bucket != nil {
+				test.bucket.updated = time.Now().Add(-test.ago)
+				store.buckets["caller"] = test.bucket
+			}
+			taken, wait, err := store.take(context.Background(), "caller", limit)
+			if err != nil {
+				t.Fatalf("take() = %v", err)
+			}
+			if taken != test.taken {
+				t.Errorf("take() taken = %v, want %v", taken, test.taken)
+			}
+			if taken && wait != 0 {
+				t.Errorf("take() wait = %v, want 0 when a token was taken", wait)
+			}
+			if !taken && (wait <= 0 || wait > time.Second) {
+				t.Errorf("take() wait = %v, want up to a second", wait)
+			}
+			if tokens := store.buckets["caller"].tokens; tokens > float64(limit.Burst-1)+1e-6 {
+				t.Errorf("%v tokens are left, want at most %d", tokens, limit.Burst-1)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	store := &memoryStore{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+	limit := Limit{Rate: 0.001, Burst: 3}
+	for i := 0; i < limit.Burst; i++ {
+		if taken, _, _ := store.take(context.Background(), "a", limit); !taken {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	if taken, _, _ := store.take(context.Background(), "a", limit); taken {
+		t.Error("the request after the burst was let through")
+	}
+	if taken, _, _ := store.take(context.Background(), "b", limit); !taken {
+		t.Error("another caller was limited by the first one's bucket")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 3}
+	store := &memoryStore{
+		buckets: map[string]*tokenBucket{
+			"full":  {tokens: 0, updated: time.Now().Add(-time.Hour), limit: limit},
+			"empty": {tokens: 0, updated: time.Now(), limit: limit},
+		},
+		swept: time.Now().Add(-2 * sweepInterval),
+	}
+	store.take(context.Background(), "new", limit)
+	if _, ok := store.buckets["full"]; ok {
+		t.Error("the full bucket was not swept")
+	}
+	if _, ok := store.buckets["empty"]; !ok {
+		t.Error("the empty bucket was swept")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]Limit
+		ok    bool
+	}{
+		{"", map[string]Limit{}, true},
+		{"*=10:30, /analyse=1:10", map[string]Limit{"*": {10, 30}, "/analyse": {1, 10}}, true},
+		{"/users=0:0", map[string]Limit{"/users": {0, 0}}, true},
+		{"*=10", nil, false},
+		{"*10:30", nil, false},
+		{"*=-1:30", nil, false},
+		{"*=1:0", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseLimits(test.value)
+			if (err == nil) != test.ok {
+				t.Fatalf("parseLimits() = %v, want ok %v", err, test.ok)
+			}
+			if test.ok && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseLimits() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Role is what a caller is allowed to do. Every role can do everything the
+// roles before it can: viewers read what has been analysed and submit users to
+// be analysed within their quota, analysts also submit batches and manage
+// tracked users, webhooks, alert rules and groups, and admins also use the
+// /admin endpoints.
+type Role string
+
+const (
+	// roleNone is the role of anonymous callers when they have to sign in or
+	// use a key to do anything.
+	roleNone    Role = "none"
+	roleViewer  Role = "viewer"
+	roleAnalyst Role = "analyst"
+	roleAdmin   Role = "admin"
+)
+
+// roleRanks orders the roles, a role can do everything the roles with a lower
+// rank can.
+var roleRanks = map[Role]int{
+	roleNone:    0,
+	roleViewer:  1,
+	roleAnalyst: 2,
+	roleAdmin:   3,
+}
+
+// parseRole checks that role is one that can be given to a key or an account.
+func parseRole(role string) (Role, error) {
+	switch r := Role(role); r {
+	case roleViewer, roleAnalyst, roleAdmin:
+		return r, nil
+	}
+	return "", invalid("role must be %s, %s or %s", roleViewer, roleAnalyst, roleAdmin)
+}
+
+// AtLeast reports whether the role can do everything that min can.
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+// higherRole returns whichever of a and b can do more.
+func higherRole(a, b Role) Role {
+	if a.AtLeast(b) {
+		return a
+	}
+	return b
+}
+
+// requireRole fails unless the caller in ctx has at least the role, with a 401
+// if there is no caller or they are anonymous and anonymous callers cannot do
+// anything, and a 403 otherwise.
+func requireRole(ctx context.Context, role Role) error {
+	caller := callerFrom(ctx)
+	if caller != nil && caller.Role.AtLeast(role) {
+		return nil
+	}
+	if caller == nil || caller.Role == roleNone {
+		return &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Err: errors.New("sign in or use an API key first")}
+	}
+	return &APIError{Status: http.StatusForbidden, Code: codeForbidden, Err: fmt.Errorf("this needs the %s role, you have the %s role", role, caller.Role)}
+}
+
+// RoleHO wraps fun so that GET requests need at least the read role and every
+// other request at least the write role. It has to be wrapped by AuthHO.
+func RoleHO(read, write Role, fun http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = read
+		}
+		if err := requireRole(r.Context(), role); err != nil {
+			writeError("Role", err, w)
+			return
+		}
+		fun(w, r)
+	}
+}
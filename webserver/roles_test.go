@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller *Caller
+		role   Role
+		status int
+	}{
+		{"no caller", nil, roleViewer, http.StatusUnauthorized},
+		{"anonymous callers that cannot do anything", &Caller{Role: roleNone}, roleViewer, http.StatusUnauthorized},
+		{"viewers can read", &Caller{Role: roleViewer}, roleViewer, 0},
+		{"viewers can submit", &Caller{Role: roleViewer}, submitRole, 0},
+		{"viewers cannot manage", &Caller{Role: roleViewer}, roleAnalyst, http.StatusForbidden},
+		{"analysts can manage", &Caller{Role: roleAnalyst}, roleAnalyst, 0},
+		{"analysts cannot administer", &Caller{Role: roleAnalyst}, roleAdmin, http.StatusForbidden},
+		{"admins can do everything", &Caller{Role: roleAdmin}, roleAdmin, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.caller != nil {
+				ctx = withCaller(ctx, test.caller)
+			}
+			err := requireRole(ctx, test.role)
+			if test.status == 0 {
+				if err != nil {
+					t.Errorf("requireRole() = %v, want nil", err)
+				}
+				return
+			}
+			if apiErr, ok := err.(*APIError); !ok || apiErr.Status != test.status {
+				t.Errorf("requireRole() = %v, want a %d", err, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type (
+	// Route is an endpoint of the API. It is served under apiPrefix and, so
+	// that older clients keep working, under legacyPrefix. Methods are the
+	// only request methods that reach Handler.
+	Route struct {
+		Path    string
+		Methods []string
+		Handler http.HandlerFunc
+	}
+
+	// openAPIDocument is the part of an OpenAPI document that is checked
+	// against the routes.
+	openAPIDocument struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+)
+
+const (
+	apiPrefix    = "/api/v1"
+	legacyPrefix = "/api"
+)
+
+// openAPISpec is the OpenAPI document that describes every route.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI returns the OpenAPI document that describes the API.
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// serve gives the request an id, which is returned in the X-Request-ID header
+// and carried in its context, refuses methods the route does not accept and
+// then passes the request on to the route's handler.
+func (route Route) serve(w http.ResponseWriter, r *http.Request) {
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+	for _, method := range route.Methods {
+		if r.Method == method {
+			route.Handler(w, r.WithContext(withRequestID(r.Context(), id)))
+			return
+		}
+	}
+	notAllowed(w, r, route.Methods...)
+}
+
+// HandleRoutes serves every route under both prefixes, counting and timing
+// the requests to each.
+func HandleRoutes(routes []Route) {
+	for _, route := range routes {
+		handler := MetricsHO(route.Path, route.serve)
+		http.HandleFunc(apiPrefix+route.Path, handler)
+		http.HandleFunc(legacyPrefix+route.Path, handler)
+	}
+}
+
+// CheckSpec returns an error describing every path and method that is in only
+// one of the OpenAPI document and the routes.
+func CheckSpec(spec []byte, routes []Route) error {
+	doc := &openAPIDocument{}
+	if err := json.Unmarshal(spec, doc); err != nil {
+		return err
+	}
+	documented := make(map[string]bool)
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			switch method {
+			case "get", "put", "post", "delete", "patch", "head", "options", "trace":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	problems := make([]string, 0)
+	for _, route := range routes {
+		for _, method := range route.Methods {
+			operation := method + " " + apiPrefix + route.Path
+			if !documented[operation] {
+				problems = append(problems, operation+" is not documented")
+			}
+			delete(documented, operation)
+		}
+	}
+	for operation := range documented {
+		problems = append(problems, operation+" is documented but not served")
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("the OpenAPI document does not match the routes: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -11,6 +11,15 @@ $env:PROJECT_ID = "twitteranalytics-310723"
 $env:PUB_SUB_TOPIC_ID = "twitter-fetch"
 # App config env variables
 $env:ADDRESS = "0.0.0.0:80"
+$env:USER_CACHE_DATASTORE = "false"
+$env:GRPC_ADDRESS = "0.0.0.0:9000"
+$env:ANONYMOUS_DAILY_QUOTA = "100"
+$env:ANONYMOUS_ROLE = "viewer"
+$env:ACCOUNT_DAILY_QUOTA = "100"
+$env:RATE_LIMITS = "*=10:30,/analyse=1:10,/analyse/stream=1:10,/analyse/batch=0.1:3"
+$env:RATE_LIMIT_REDIS = ""
+$env:TRUSTED_PROXIES = "0"
+$env:METRICS_ADDRESS = "0.0.0.0:9100"
 # Build the app
 go build -o ../build/twitteranalytics.exe ..
 # Open a tab in the browser pointed at the webserver
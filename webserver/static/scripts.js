@@ -3,36 +3,304 @@ google.charts.setOnLoadCallback(() => {
     document.getElementById('search').addEventListener('click', async (ev) => {
         startLoading()
         const username = document.getElementById('twitter-handle').value;
-        //const username = 'elonmusk';
-        console.log(`http://localhost/api/analyse?name=${encodeURI(username)}`)
+        console.log(`http://localhost/api/v1/users/lookup?name=${encodeURIComponent(username)}`)
         const resp = await fetch(
-            `http://localhost/api/analyse?name=${encodeURI(username)}`
+            `http://localhost/api/v1/users/lookup?name=${encodeURIComponent(username)}`
         );
-        if (resp.ok) {
-            document.getElementById("loading-indicator-container").classList.remove("loader")
-            const data = await resp.json();
-            console.log(data)
-            if (data.UserID) {
-                let positiveCount = data.PositiveTweets
-                let negativeCount = data.NegativeTweets
-                let averageSentiment = data.AverageScore * 100
-                createPositiveNegativeTable(positiveCount, negativeCount)
-                createSentimentPieChart(positiveCount, negativeCount)
-                createAverageSentimentChart(averageSentiment)
-            } else {
-                alert(data.Message)
+        const data = await resp.json();
+        if (!resp.ok) {
+            stopLoading()
+            if (data.Candidates) {
+                // nobody has exactly that screen name, let the user pick one
+                showCandidates(data.Message, data.Candidates)
+                return
             }
-            // const data = testData;
-            // createDataSummaryTable(username, data);
-            // createSentimentScoreChart(username, data.Scores);
-            // createSentimentDistChart(username, data.ScoreDist);
-            // createTopicChart(username, data.Topics);
-        } else {
+            alert('BAD RESPONSE: ' + resp.status + ': ' + data.Message);
+            return
+        }
+        // ids do not fit in a javascript number, so the exact screen name is
+        // used to refer to the user from here on
+        analyse(data.ScreenName)
+    });
+    let suggestTimeout = null
+    document.getElementById('twitter-handle').addEventListener('input', (ev) => {
+        // wait for a pause in typing before asking for suggestions
+        clearTimeout(suggestTimeout)
+        suggestTimeout = setTimeout(() => suggest(ev.target.value), 150)
+    });
+    document.getElementById('compare').addEventListener('click', async (ev) => {
+        const names = document.getElementById('compare-handles').value;
+        console.log(`http://localhost/api/v1/compare?names=${encodeURIComponent(names)}&submit=true`)
+        // comparing submits the users that have not been analysed, which needs
+        // the CSRF token while signed in
+        const resp = await fetch(
+            `http://localhost/api/v1/compare?names=${encodeURIComponent(names)}&submit=true`,
+            { headers: { 'X-CSRF-Token': csrfToken() } }
+        );
+        if (!resp.ok) {
             alert('BAD RESPONSE: ' + resp.status + ': ' + (await resp.text()));
+            return
+        }
+        showComparison(await resp.json())
+    });
+    document.getElementById('sign-in').addEventListener('click', () => signIn('session'));
+    document.getElementById('register').addEventListener('click', () => signIn('accounts'));
+    document.getElementById('sign-out').addEventListener('click', async (ev) => {
+        const resp = await send('DELETE', 'http://localhost/api/v1/session')
+        if (!resp.ok) {
+            alert('BAD RESPONSE: ' + resp.status + ': ' + (await resp.json()).Message);
+            return
+        }
+        showAccount(null)
+    });
+    document.getElementById('track').addEventListener('click', async (ev) => {
+        const username = document.getElementById('twitter-handle').value.trim().replace(/^@/, '');
+        const resp = await send('POST', `http://localhost/api/v1/tracked?name=${encodeURIComponent(username)}`)
+        if (!resp.ok) {
+            alert('BAD RESPONSE: ' + resp.status + ': ' + (await resp.json()).Message);
+            return
         }
+        loadTracked()
     });
+    loadAccount()
 });
 
+// csrfToken returns the token the webserver wants back in the X-CSRF-Token
+// header of every request that changes something while signed in
+function csrfToken() {
+    const cookie = document.cookie.split('; ').find((c) => c.startsWith('csrf_token='))
+    return cookie ? decodeURIComponent(cookie.substring('csrf_token='.length)) : ''
+}
+
+// send makes a request that changes something, with body as JSON if it is given
+async function send(method, url, body) {
+    const headers = { 'X-CSRF-Token': csrfToken() }
+    if (body !== undefined) {
+        headers['Content-Type'] = 'application/json'
+        body = JSON.stringify(body)
+    }
+    return fetch(url, { method: method, headers: headers, body: body })
+}
+
+// signIn signs in to an account, registering it first if path is accounts
+async function signIn(path) {
+    const resp = await send('POST', `http://localhost/api/v1/${path}`, {
+        Username: document.getElementById('account-username').value,
+        Password: document.getElementById('account-password').value,
+    })
+    const data = await resp.json()
+    if (!resp.ok) {
+        alert('BAD RESPONSE: ' + resp.status + ': ' + data.Message);
+        return
+    }
+    document.getElementById('account-password').value = ''
+    showAccount(data)
+}
+
+async function loadAccount() {
+    const resp = await fetch('http://localhost/api/v1/session')
+    // a 401 only means that nobody is signed in
+    showAccount(resp.ok ? await resp.json() : null)
+}
+
+function showAccount(account) {
+    const signedIn = account !== null
+    document.getElementById('signed-in-as').innerText = signedIn ? `Signed in as ${account.Username} (${account.Role})` : ''
+    for (const id of ['account-username', 'account-password', 'sign-in', 'register']) {
+        document.getElementById(id).hidden = signedIn
+    }
+    document.getElementById('sign-out').hidden = !signedIn
+    document.getElementById('tracked-section').hidden = !signedIn
+    if (signedIn) {
+        loadTracked()
+    }
+}
+
+async function loadTracked() {
+    const resp = await fetch('http://localhost/api/v1/tracked?mine=true')
+    if (!resp.ok) {
+        console.log('BAD RESPONSE: ' + resp.status + ': ' + (await resp.text()))
+        return
+    }
+    const list = document.getElementById('tracked-list')
+    list.innerHTML = ''
+    for (const tracked of await resp.json()) {
+        const item = document.createElement('li')
+        const button = document.createElement('button')
+        button.innerText = tracked.Username
+        button.addEventListener('click', () => {
+            document.getElementById('twitter-handle').value = tracked.Username
+            startLoading()
+            analyse(tracked.Username)
+        })
+        const untrack = document.createElement('button')
+        untrack.innerText = 'Untrack'
+        untrack.addEventListener('click', async () => {
+            const resp = await send('DELETE', `http://localhost/api/v1/tracked?name=${encodeURIComponent(tracked.Username)}`)
+            if (!resp.ok) {
+                alert('BAD RESPONSE: ' + resp.status + ': ' + (await resp.json()).Message);
+                return
+            }
+            loadTracked()
+        })
+        item.appendChild(button)
+        item.appendChild(untrack)
+        list.appendChild(item)
+    }
+}
+
+async function suggest(prefix) {
+    prefix = prefix.trim().replace(/^@/, '')
+    const list = document.getElementById('handle-suggestions')
+    if (prefix.length === 0) {
+        list.innerHTML = ''
+        return
+    }
+    const resp = await fetch(
+        `http://localhost/api/v1/users/suggest?q=${encodeURIComponent(prefix)}`
+    );
+    if (!resp.ok) {
+        // suggestions are only a convenience, searching still works without them
+        console.log('BAD RESPONSE: ' + resp.status + ': ' + (await resp.text()))
+        return
+    }
+    const suggestions = await resp.json()
+    list.innerHTML = ''
+    for (const suggestion of suggestions) {
+        const option = document.createElement('option')
+        option.value = suggestion.Username
+        list.appendChild(option)
+    }
+}
+
+function showComparison(comparison) {
+    console.log(comparison)
+    if (comparison.NotFound.length > 0) {
+        alert('These accounts could not be found: ' + comparison.NotFound.join(', '))
+    }
+    const pending = comparison.Users.filter((user) => !user.Analysed && !user.Failure)
+    if (pending.length > 0) {
+        alert('These accounts have been submitted to be analysed, compare again later to include them: ' +
+            pending.map((user) => user.Username).join(', '))
+    }
+    const failed = comparison.Users.filter((user) => user.Failure)
+    if (failed.length > 0) {
+        alert('These accounts could not be submitted to be analysed: ' +
+            failed.map((user) => `${user.Username} (${user.Failure.Message})`).join(', '))
+    }
+    const users = comparison.Users.filter((user) => user.Analysed)
+    createComparisonTable(users)
+    createComparisonChart(comparison.Buckets, users)
+}
+
+function createComparisonTable(users) {
+    let data = new google.visualization.DataTable()
+    data.addColumn('string', 'Account')
+    data.addColumn('number', 'Positive')
+    data.addColumn('number', 'Negative')
+    data.addColumn('number', 'Positive Share')
+    data.addColumn('number', 'Average Sentiment')
+    for (const user of users) {
+        data.addRow([
+            `@${user.Username}`,
+            user.PositiveTweets,
+            user.NegativeTweets,
+            user.PositiveShare * 100,
+            user.AverageScore * 100,
+        ])
+    }
+    let table = new google.visualization.Table(document.getElementById("compare-table-container"))
+    table.draw(data, { width: '100%' })
+}
+
+function createComparisonChart(buckets, users) {
+    let data = new google.visualization.DataTable()
+    data.addColumn('date', 'Week')
+    for (const user of users) {
+        data.addColumn('number', `@${user.Username}`)
+    }
+    buckets.forEach((bucket, i) => {
+        const row = [new Date(bucket)]
+        for (const user of users) {
+            const score = user.Series[i].AverageScore
+            row.push(score === null ? null : score * 100)
+        }
+        data.addRow(row)
+    })
+    let options = {
+        title: "Average Tweet Sentiment by Week",
+        interpolateNulls: true,
+        vAxis: {
+            maxValue: 100,
+            minValue: -100,
+        }
+    };
+    let chart = new google.visualization.LineChart(document.getElementById("compare-chart-container"));
+    chart.draw(data, options);
+}
+
+function analyse(screenName) {
+    startLoading()
+    console.log(`http://localhost/api/v1/analyse/stream?name=${encodeURIComponent(screenName)}`)
+    // EventSource cannot set headers, so the CSRF token goes in the URL
+    const source = new EventSource(
+        `http://localhost/api/v1/analyse/stream?name=${encodeURIComponent(screenName)}&csrf_token=${encodeURIComponent(csrfToken())}`
+    );
+    source.addEventListener('status', (ev) => {
+        const job = JSON.parse(ev.data);
+        setStatus(`Analysis ${job.Status}...`)
+    });
+    source.addEventListener('done', (ev) => {
+        source.close()
+        stopLoading()
+        showAnalysis(JSON.parse(ev.data))
+    });
+    source.addEventListener('failed', (ev) => {
+        source.close()
+        stopLoading()
+        alert(JSON.parse(ev.data).Message)
+    });
+    source.addEventListener('timeout', (ev) => {
+        source.close()
+        stopLoading()
+        alert(JSON.parse(ev.data).Message)
+    });
+    source.onerror = () => {
+        // the stream is closed by the final event, so any error happened
+        // before the analysis was received
+        source.close()
+        stopLoading()
+        alert('Could not get the analysis for this user from the server.')
+    };
+}
+
+function showCandidates(message, candidates) {
+    const container = document.getElementById("candidates-container")
+    const title = document.createElement("p")
+    title.innerText = message
+    container.appendChild(title)
+    const list = document.createElement("ul")
+    for (const candidate of candidates) {
+        const item = document.createElement("li")
+        const button = document.createElement("button")
+        button.innerText = `@${candidate.ScreenName} (${candidate.Name}, ${candidate.FollowersCount} followers)`
+        button.addEventListener('click', () => analyse(candidate.ScreenName))
+        item.appendChild(button)
+        list.appendChild(item)
+    }
+    container.appendChild(list)
+}
+
+function showAnalysis(data) {
+    console.log(data)
+    let positiveCount = data.PositiveTweets
+    let negativeCount = data.NegativeTweets
+    let averageSentiment = data.AverageScore * 100
+    createPositiveNegativeTable(positiveCount, negativeCount)
+    createSentimentPieChart(positiveCount, negativeCount)
+    createAverageSentimentChart(averageSentiment)
+}
+
 function createPositiveNegativeTable(positveCount, negativeCount) {
    let tData = google.visualization.arrayToDataTable([
        ['Sentiment', 'Count', { role: 'style' }],
@@ -103,8 +371,19 @@ function createAverageSentimentChart(averageSentiment) {
 }
 
 const startLoading = () => {
+    setStatus("")
+    document.getElementById("candidates-container").innerHTML = ""
     document.getElementById("sentiment-counts-container").innerHTML = ""
     document.getElementById("sentiment-pie-chart-wrapper").innerHTML = ""
     document.getElementById("average-sentiment-wrapper").innerHTML = ""
     document.getElementById("loading-indicator-container").classList.add("loader")
-}
\ No newline at end of file
+}
+
+const stopLoading = () => {
+    setStatus("")
+    document.getElementById("loading-indicator-container").classList.remove("loader")
+}
+
+const setStatus = (status) => {
+    document.getElementById("status").innerText = status
+}
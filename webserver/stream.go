@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// streamInterval is how often the job is checked for progress.
+	streamInterval = 2 * time.Second
+	// streamTimeout is the longest a stream is kept open before the browser
+	// is told to check back later.
+	streamTimeout = 10 * time.Minute
+
+	eventStatus  = "status"
+	eventDone    = "done"
+	eventFailed  = "failed"
+	eventTimeout = "timeout"
+)
+
+// writeEvent sends a single Server-Sent Event with data encoded as JSON.
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// followJob checks the job every streamInterval and calls changed every time
+// its status changes, until it is done, fails, streamTimeout passes or ctx is
+// done. The last state of the job that was seen is returned.
+func followJob(ctx context.Context, job *Job, ds *datastore.Client, changed func(*Job) error) (*Job, error) {
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	timeout := time.After(streamTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-timeout:
+			return job, nil
+		case <-ticker.C:
+		}
+		next := &Job{}
+		if err := ds.Get(ctx, jobKey(job.UserID), next); err != nil {
+			return job, err
+		}
+		if next.Status != job.Status {
+			if err := changed(next); err != nil {
+				return next, err
+			}
+		}
+		job = next
+		if job.Status == jobStatusDone || job.Status == jobStatusFailed {
+			return job, nil
+		}
+	}
+}
+
+// watchJob sends a status event every time the job changes, until it is done,
+// fails, or the request goes away. When the job is done the analysed document
+// is sent as the final event.
+func watchJob(ctx context.Context, job *Job, ds *datastore.Client, w http.ResponseWriter, flusher http.Flusher) error {
+	job, err := followJob(ctx, job, ds, func(job *Job) error {
+		return writeEvent(w, flusher, eventStatus, job)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch job.Status {
+	case jobStatusDone:
+		doc := &AnalysedDocument{}
+		if err := ds.Get(ctx, datastore.IDKey(userKind, job.UserID, nil), doc); err != nil {
+			return err
+		}
+		return writeEvent(w, flusher, eventDone, doc)
+	case jobStatusFailed:
+		return writeEvent(w, flusher, eventFailed, struct{ Message string }{Message: "This user could not be analysed."})
+	}
+	return writeEvent(w, flusher, eventTimeout, struct{ Message string }{Message: "This user is still being analysed. Check back later to see more about them."})
+}
+
+// StreamAnalysisHO returns a handler that works like GetAnalysis but keeps the
+// connection open, pushing the progress of the analysis to the browser as
+// Server-Sent Events and finishing with the analysed document.
+func StreamAnalysisHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError("Stream", &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Err: errors.New("streaming is not supported")}, w)
+			return
+		}
+		user, err := lookupUser(users, r.URL.Query())
+		if err != nil {
+			writeUserError(err, w)
+			return
+		}
+		data, err := getData(r.Context(), user.ScreenName, user.ID, ds, topic)
+		if err != nil {
+			writeError("Data", err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		message, ok := data.(JobMessage)
+		if !ok {
+			// the user has already been analysed
+			writeEvent(w, flusher, eventDone, data)
+			return
+		}
+		if err := writeEvent(w, flusher, eventStatus, message.Job); err != nil {
+			return
+		}
+		if err := watchJob(r.Context(), message.Job, ds, w, flusher); err != nil {
+			writeEvent(w, flusher, eventFailed, struct{ Message string }{Message: err.Error()})
+		}
+	}
+}
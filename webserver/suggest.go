@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type (
+	// IndexEntry is a single user in a segment of the prefix index written by
+	// name-index.
+	IndexEntry struct {
+		Username string
+		UserID   int64
+	}
+
+	// SegmentInfo describes a single segment of the index. Version is the
+	// version of the index that the segment was last written in.
+	SegmentInfo struct {
+		Version int64
+		Users   int
+	}
+
+	// Manifest describes the prefix index written by name-index. Segments maps
+	// the key of every segment to its info.
+	Manifest struct {
+		Version   int64
+		Updated   time.Time
+		Compacted time.Time
+		Users     int
+		Segments  map[string]SegmentInfo
+	}
+
+	// cachedSegment is a segment kept in memory by a SuggestIndex.
+	cachedSegment struct {
+		version int64
+		entries []IndexEntry
+	}
+
+	// SuggestIndex answers prefix searches from the index in the bucket. The
+	// manifest is read again at most every manifestTTL, and segments are kept
+	// in memory until the manifest points to a newer version of them.
+	SuggestIndex struct {
+		bucket *storage.BucketHandle
+
+		mu       sync.Mutex
+		manifest *Manifest
+		checked  time.Time
+		segments map[string]cachedSegment
+	}
+)
+
+const (
+	manifestObject = "name-index/manifest.json"
+	segmentsPrefix = "name-index/segments/"
+
+	// segmentKeyLength is how many leading characters of a lower case username
+	// decide which segment the user is in, it must match name-index.
+	segmentKeyLength = 2
+	// manifestTTL is how long the manifest is trusted before it is read again.
+	manifestTTL = time.Minute
+	// defaultSuggestLimit is how many suggestions are returned when no limit
+	// is given.
+	defaultSuggestLimit = 10
+	// maxSuggestLimit is the most suggestions that can be returned.
+	maxSuggestLimit = 50
+)
+
+// NewSuggestIndex creates an index that reads from bucket.
+func NewSuggestIndex(bucket *storage.BucketHandle) *SuggestIndex {
+	return &SuggestIndex{
+		bucket:   bucket,
+		segments: make(map[string]cachedSegment),
+	}
+}
+
+// searchName is the form of a username that the index is sorted and searched
+// by, usernames are not case sensitive.
+func searchName(username string) string {
+	return strings.ToLower(username)
+}
+
+// segmentKey returns the key of the segment that a username belongs in.
+func segmentKey(username string) string {
+	name := []rune(searchName(username))
+	if len(name) > segmentKeyLength {
+		name = name[:segmentKeyLength]
+	}
+	return string(name)
+}
+
+// segmentObject returns the name of the object a version of a segment is
+// stored in.
+func segmentObject(key string, version int64) string {
+	return segmentsPrefix + key + "/" + strconv.FormatInt(version, 10) + ".json"
+}
+
+// readObject decodes the JSON object with the name into dst.
+func readObject(bucket *storage.BucketHandle, name string, dst interface{}) error {
+	r, err := bucket.Object(name).NewReader(context.Background())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(dst)
+}
+
+// getManifest returns the manifest, reading it again if it is older than
+// manifestTTL or refresh is true. If the manifest cannot be read then the last
+// one is used. Cached segments that the manifest no longer lists are dropped.
+func (idx *SuggestIndex) getManifest(refresh bool) (*Manifest, error) {
+	idx.mu.Lock()
+	manifest, checked := idx.manifest, idx.checked
+	idx.mu.Unlock()
+	if manifest != nil && !refresh && time.Since(checked) < manifestTTL {
+		return manifest, nil
+	}
+	fresh := &Manifest{Segments: make(map[string]SegmentInfo)}
+	// an index that does not exist yet has nothing in it
+	if err := readObject(idx.bucket, manifestObject, fresh); err != nil && err != storage.ErrObjectNotExist {
+		if manifest == nil {
+			return nil, err
+		}
+		logEntry(levelError, "could not refresh the name index: "+err.Error(), logFields{"location": "Suggest"})
+		fresh = manifest
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for key := range idx.segments {
+		if _, ok := fresh.Segments[key]; !ok {
+			delete(idx.segments, key)
+		}
+	}
+	idx.manifest, idx.checked = fresh, time.Now()
+	return fresh, nil
+}
+
+// getSegment returns the entries of the segment with the key, reading it from
+// the bucket if it is not in memory.
+func (idx *SuggestIndex) getSegment(manifest *Manifest, key string) ([]IndexEntry, error) {
+	info, ok := manifest.Segments[key]
+	if !ok {
+		return nil, nil
+	}
+	idx.mu.Lock()
+	cached, ok := idx.segments[key]
+	idx.mu.Unlock()
+	if ok && cached.version == info.Version {
+		return cached.entries, nil
+	}
+	entries := make([]IndexEntry, 0, info.Users)
+	if err := readObject(idx.bucket, segmentObject(key, info.Version), &entries); err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	if current, ok := idx.segments[key]; !ok || current.version < info.Version {
+		idx.segments[key] = cachedSegment{version: info.Version, entries: entries}
+	}
+	idx.mu.Unlock()
+	return entries, nil
+}
+
+// Suggest returns at most limit users whose usernames start with prefix, in
+// username order.
+func (idx *SuggestIndex) Suggest(prefix string, limit int) ([]IndexEntry, error) {
+	manifest, err := idx.getManifest(false)
+	if err != nil {
+		return nil, err
+	}
+	suggestions, err := idx.suggest(manifest, searchName(prefix), limit)
+	if err == storage.ErrObjectNotExist {
+		// name-index removes old segments when it compacts the index, so the
+		// manifest is out of date
+		if manifest, err = idx.getManifest(true); err != nil {
+			return nil, err
+		}
+		suggestions, err = idx.suggest(manifest, searchName(prefix), limit)
+	}
+	return suggestions, err
+}
+
+// suggest searches the segments in manifest. Prefixes shorter than a segment
+// key are answered from every segment that starts with them.
+func (idx *SuggestIndex) suggest(manifest *Manifest, prefix string, limit int) ([]IndexEntry, error) {
+	keys := make([]string, 0)
+	if len([]rune(prefix)) >= segmentKeyLength {
+		keys = append(keys, segmentKey(prefix))
+	} else {
+		for key := range manifest.Segments {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+	suggestions := make([]IndexEntry, 0, limit)
+	for _, key := range keys {
+		entries, err := idx.getSegment(manifest, key)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(entries), func(i int) bool { return searchName(entries[i].Username) >= prefix })
+		for ; i < len(entries) && strings.HasPrefix(searchName(entries[i].Username), prefix); i++ {
+			if len(suggestions) == limit {
+				return suggestions, nil
+			}
+			suggestions = append(suggestions, entries[i])
+		}
+	}
+	return suggestions, nil
+}
+
+// SuggestHO returns a handler that suggests analysed users whose usernames
+// start with the q parameter, for autocompleting the search box. limit caps how
+// many users are suggested.
+func SuggestHO(index *SuggestIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+		if prefix == "" {
+			writeError("Unmarshal", invalid("q was empty, but should not have been"), w)
+			return
+		}
+		limit, err := unmarshalLimit(r.URL.Query(), defaultSuggestLimit)
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		if limit > maxSuggestLimit {
+			writeError("Unmarshal", invalid("limit can be at most %d", maxSuggestLimit), w)
+			return
+		}
+		suggestions, err := index.Suggest(prefix, limit)
+		if err != nil {
+			writeError("Suggest", err, w)
+			return
+		}
+		writeJSON(suggestions, w)
+	}
+}
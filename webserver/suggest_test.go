@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	manifest := &Manifest{Segments: map[string]SegmentInfo{
+		"al": {Version: 2, Users: 3},
+		"am": {Version: 1, Users: 1},
+		"bo": {Version: 1, Users: 1},
+		"ö":  {Version: 1, Users: 1},
+	}}
+	idx := &SuggestIndex{segments: map[string]cachedSegment{
+		"al": {version: 2, entries: []IndexEntry{{"Al", 1}, {"alice", 2}, {"ALICIA", 3}}},
+		"am": {version: 1, entries: []IndexEntry{{"amy", 4}}},
+		"bo": {version: 1, entries: []IndexEntry{{"bob", 5}}},
+		"ö":  {version: 1, entries: []IndexEntry{{"Ö", 6}}},
+	}}
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{"a prefix as long as a key reads its segment", "al", 10, []string{"Al", "alice", "ALICIA"}},
+		{"a longer prefix", "alic", 10, []string{"alice", "ALICIA"}},
+		{"a short prefix reads every segment that starts with it", "a", 10, []string{"Al", "alice", "ALICIA", "amy"}},
+		{"the limit stops the search", "a", 2, []string{"Al", "alice"}},
+		{"a name shorter than a key", "ö", 10, []string{"Ö"}},
+		{"a segment that does not exist", "zz", 10, []string{}},
+		{"no user has the prefix", "alx", 10, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			suggestions, err := idx.suggest(manifest, test.prefix, test.limit)
+			names := make([]string, len(suggestions))
+			for i, entry := range suggestions {
+				names[i] = entry.Username
+			}
+			if err != nil || !reflect.DeepEqual(names, test.want) {
+				t.Errorf("suggest(%q, %d) = %v, %v, want %v", test.prefix, test.limit, names, err, test.want)
+			}
+		})
+	}
+}
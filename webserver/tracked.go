@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+type (
+	// Tracked is the entity in the datastore marking a user whose analysis is
+	// kept up to date by the scheduler. The user is refreshed every
+	// RefreshMinutes minutes. Owner is the account or key that tracked the
+	// user, it is empty if they were tracked anonymously.
+	Tracked struct {
+		Username       string
+		UserID         int64
+		RefreshMinutes int64
+		LastRefreshed  time.Time
+		Owner          string
+	}
+)
+
+const (
+	trackedKind = "Tracked"
+
+	// defaultRefreshMinutes is the refresh interval used when none is given.
+	defaultRefreshMinutes = 24 * 60
+	// minRefreshMinutes stops users from being refreshed so often that it
+	// eats up the Twitter API quota.
+	minRefreshMinutes = 15
+)
+
+// trackedKey returns the key of the Tracked entity for the user with userID.
+func trackedKey(userID int64) *datastore.Key {
+	return datastore.IDKey(trackedKind, userID, nil)
+}
+
+// unmarshalInterval gets the refresh interval in minutes from the query
+// parameters, or the default if it was not given.
+func unmarshalInterval(values url.Values) (int64, error) {
+	interval := values.Get("interval")
+	if interval == "" {
+		return defaultRefreshMinutes, nil
+	}
+	minutes, err := strconv.ParseInt(interval, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if minutes < minRefreshMinutes {
+		return 0, invalid("interval must be at least %d minutes", minRefreshMinutes)
+	}
+	return minutes, nil
+}
+
+// listTracked gets all of the tracked users ordered by their username, or only
+// the ones tracked by owner if it is not empty.
+func listTracked(ds *datastore.Client, owner string) ([]Tracked, error) {
+	tracked := make([]Tracked, 0)
+	if _, err := ds.GetAll(context.Background(), datastore.NewQuery(trackedKind).Order("Username"), &tracked); err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return tracked, nil
+	}
+	owned := make([]Tracked, 0, len(tracked))
+	for _, t := range tracked {
+		if t.Owner == owner {
+			owned = append(owned, t)
+		}
+	}
+	return owned, nil
+}
+
+// track marks the user as tracked by the account that made the request and
+// makes sure that they have been submitted to be analysed, so the scheduler has
+// something to refresh. It fails with a 403 if another account tracks them.
+func track(ctx context.Context, user *twitter.User, minutes int64, ds *datastore.Client, topic *pubsub.Topic) (*Tracked, error) {
+	tracked := &Tracked{
+		Username:       user.ScreenName,
+		UserID:         user.ID,
+		RefreshMinutes: minutes,
+		LastRefreshed:  time.Now(),
+		Owner:          ownerFrom(ctx),
+	}
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		old := &Tracked{}
+		if err := tx.Get(trackedKey(user.ID), old); err == nil {
+			if err := checkOwner(ctx, old.Owner); err != nil {
+				return err
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := tx.Put(trackedKey(user.ID), tracked)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getData(ctx, user.ScreenName, user.ID, ds, topic); err != nil {
+		return nil, err
+	}
+	return tracked, nil
+}
+
+// untrack stops tracking the user, it fails with a 403 if another account
+// tracks them.
+func untrack(ctx context.Context, userID int64, ds *datastore.Client) error {
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		tracked := &Tracked{}
+		if err := tx.Get(trackedKey(userID), tracked); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := checkOwner(ctx, tracked.Owner); err != nil {
+			return err
+		}
+		return tx.Delete(trackedKey(userID))
+	})
+	return err
+}
+
+// TrackedHO returns a handler for the tracked users. GET lists all of the
+// tracked users, or only the ones tracked by the account that is signed in with
+// mine=true, POST starts tracking the user with the name parameter, and DELETE
+// stops tracking them. Users can be given by id instead of name.
+func TrackedHO(users *UserCache, ds *datastore.Client, topic *pubsub.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			owner, err := mineOnly(r)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			tracked, err := listTracked(ds, owner)
+			if err != nil {
+				writeError("List", err, w)
+				return
+			}
+			data = tracked
+		case http.MethodPost:
+			minutes, err := unmarshalInterval(r.URL.Query())
+			if err != nil {
+				writeError("Interval", err, w)
+				return
+			}
+			user, err := lookupUser(users, r.URL.Query())
+			if err != nil {
+				writeUserError(err, w)
+				return
+			}
+			logUserID(r.Context(), user.ID)
+			tracked, err := track(r.Context(), user, minutes, ds, topic)
+			if err != nil {
+				writeError("Track", err, w)
+				return
+			}
+			data = tracked
+		case http.MethodDelete:
+			user, err := lookupUser(users, r.URL.Query())
+			if err != nil {
+				writeUserError(err, w)
+				return
+			}
+			logUserID(r.Context(), user.ID)
+			if err := untrack(r.Context(), user.ID, ds); err != nil {
+				writeError("Untrack", err, w)
+				return
+			}
+			data = struct{ Message string }{Message: "This user is no longer being tracked."}
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+			return
+		}
+		writeJSON(data, w)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+type (
+	// UserSummary is a single analysed user in a page of users.
+	UserSummary struct {
+		Username                       string
+		UserID                         int64
+		PositiveTweets, NegativeTweets int
+		AverageScore                   float64
+		LastAnalysed                   time.Time
+	}
+
+	// UsersPage is a page of analysed users. Cursor is passed back to get the
+	// next page, it is empty when there are no more users.
+	UsersPage struct {
+		Users  []UserSummary
+		Cursor string
+	}
+
+	// UsersQuery is what a page of users is searched for with. MinScore and
+	// MaxScore are nil when the score is not bounded.
+	UsersQuery struct {
+		Prefix             string
+		Sort               string
+		Descending         bool
+		MinScore, MaxScore *float64
+		Cursor             string
+		Limit              int
+	}
+)
+
+const (
+	userKind = "User"
+
+	sortName     = "name"
+	sortScore    = "score"
+	sortAnalysed = "analysed"
+
+	// defaultUsersLimit is how many users are in a page when no limit is given.
+	defaultUsersLimit = 50
+	// maxUsersLimit is the most users that can be in a page.
+	maxUsersLimit = 1000
+	// maxUsersScan is the most users looked at for a single page. Filters the
+	// datastore cannot apply are applied while scanning, so a page can come
+	// back short with a cursor to carry on from.
+	maxUsersScan = 5000
+)
+
+// sortFields are the datastore properties that each sort orders by.
+var sortFields = map[string]string{
+	sortName:     "SearchName",
+	sortScore:    "AverageScore",
+	sortAnalysed: "LastAnalysed",
+}
+
+// unmarshalScore gets the score query parameter with the key, nil if it was not
+// given.
+func unmarshalScore(values url.Values, key string) (*float64, error) {
+	value := values.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+	score, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if score < -1 || score > 1 {
+		return nil, invalid("%s must be between -1 and 1", key)
+	}
+	return &score, nil
+}
+
+// unmarshalUsersQuery gets the search for a page of users from the query
+// parameters. Users are sorted by name ascending and by score and last analysed
+// time descending unless order says otherwise.
+func unmarshalUsersQuery(values url.Values) (*UsersQuery, error) {
+	query := &UsersQuery{
+		Prefix: strings.ToLower(strings.TrimPrefix(strings.TrimSpace(values.Get("prefix")), "@")),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	if query.Sort == "" {
+		query.Sort = sortName
+	} else if _, ok := sortFields[query.Sort]; !ok {
+		return nil, invalid("sort must be %s, %s or %s", sortName, sortScore, sortAnalysed)
+	}
+	switch values.Get("order") {
+	case "":
+		query.Descending = query.Sort != sortName
+	case "asc":
+		query.Descending = false
+	case "desc":
+		query.Descending = true
+	default:
+		return nil, invalid("order must be asc or desc")
+	}
+	var err error
+	if query.MinScore, err = unmarshalScore(values, "min_score"); err != nil {
+		return nil, err
+	}
+	if query.MaxScore, err = unmarshalScore(values, "max_score"); err != nil {
+		return nil, err
+	}
+	if query.MinScore != nil && query.MaxScore != nil && *query.MinScore > *query.MaxScore {
+		return nil, invalid("min_score cannot be greater than max_score")
+	}
+	if query.Limit, err = unmarshalLimit(values, defaultUsersLimit); err != nil {
+		return nil, err
+	}
+	if query.Limit > maxUsersLimit {
+		return nil, invalid("limit can be at most %d", maxUsersLimit)
+	}
+	return query, nil
+}
+
+// Matches returns true if the document passes all of the filters.
+func (query *UsersQuery) Matches(doc *AnalysedDocument) bool {
+	if !strings.HasPrefix(doc.SearchName, query.Prefix) {
+		return false
+	}
+	if query.MinScore != nil && doc.AverageScore < *query.MinScore {
+		return false
+	}
+	if query.MaxScore != nil && doc.AverageScore > *query.MaxScore {
+		return false
+	}
+	return true
+}
+
+// datastoreQuery builds the datastore query for the search. The datastore only
+// allows an inequality filter on the property that is sorted by, so only the
+// filter on that property is applied here and the rest are applied by Matches.
+// This also means that no composite index is needed.
+func (query *UsersQuery) datastoreQuery() (*datastore.Query, error) {
+	field := sortFields[query.Sort]
+	q := datastore.NewQuery(userKind)
+	switch query.Sort {
+	case sortName:
+		if query.Prefix != "" {
+			q = q.Filter(field+" >=", query.Prefix).Filter(field+" <", query.Prefix+"\uffff")
+		}
+	case sortScore:
+		if query.MinScore != nil {
+			q = q.Filter(field+" >=", *query.MinScore)
+		}
+		if query.MaxScore != nil {
+			q = q.Filter(field+" <=", *query.MaxScore)
+		}
+	}
+	if query.Descending {
+		field = "-" + field
+	}
+	q = q.Order(field)
+	if query.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(query.Cursor)
+		if err != nil {
+			return nil, invalid("cursor is not valid")
+		}
+		q = q.Start(cursor)
+	}
+	return q, nil
+}
+
+// listDocuments gets the analysed documents of a page of the users that match
+// the query, and the cursor of the next page.
+func listDocuments(ds *datastore.Client, query *UsersQuery) ([]AnalysedDocument, string, error) {
+	q, err := query.datastoreQuery()
+	if err != nil {
+		return nil, "", err
+	}
+	docs := make([]AnalysedDocument, 0, query.Limit)
+	it := ds.Run(context.Background(), q)
+	for scanned := 0; len(docs) < query.Limit && scanned < maxUsersScan; scanned++ {
+		doc := AnalysedDocument{}
+		if _, err := it.Next(&doc); err == iterator.Done {
+			return docs, "", nil
+		} else if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
+			return nil, "", err
+		}
+		if query.Matches(&doc) {
+			docs = append(docs, doc)
+		}
+	}
+	cursor, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return docs, cursor.String(), nil
+}
+
+// listUsers gets a page of the analysed users that match the search.
+func listUsers(ds *datastore.Client, query *UsersQuery) (*UsersPage, error) {
+	docs, cursor, err := listDocuments(ds, query)
+	if err != nil {
+		return nil, err
+	}
+	page := &UsersPage{Users: make([]UserSummary, 0, len(docs)), Cursor: cursor}
+	for _, doc := range docs {
+		page.Users = append(page.Users, UserSummary{
+			Username:       doc.Username,
+			UserID:         doc.UserID,
+			PositiveTweets: doc.PositiveTweets,
+			NegativeTweets: doc.NegativeTweets,
+			AverageScore:   doc.AverageScore,
+			LastAnalysed:   doc.LastAnalysed,
+		})
+	}
+	return page, nil
+}
+
+// UsersHO returns a handler that pages through the users that have been
+// analysed. prefix searches by the start of the username, sort orders by name,
+// score or analysed (the last time the user was analysed), order is asc or
+// desc, min_score and max_score filter by score, and cursor continues from the
+// end of a previous page of at most limit users.
+func UsersHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			notAllowed(w, r, http.MethodGet)
+			return
+		}
+		query, err := unmarshalUsersQuery(r.URL.Query())
+		if err != nil {
+			writeError("Unmarshal", err, w)
+			return
+		}
+		page, err := listUsers(ds, query)
+		if err != nil {
+			writeError("List", err, w)
+			return
+		}
+		writeJSON(page, w)
+	}
+}
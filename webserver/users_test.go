@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalUsersQuery(t *testing.T) {
+	score := func(s float64) *float64 { return &s }
+	tests := []struct {
+		name  string
+		query string
+		want  *UsersQuery
+	}{
+		{"the defaults", "", &UsersQuery{Sort: sortName, Limit: defaultUsersLimit}},
+		{"the prefix is trimmed and lower cased", "prefix=%20@Alice", &UsersQuery{Prefix: "alice", Sort: sortName, Limit: defaultUsersLimit}},
+		{"scores sort descending by default", "sort=score", &UsersQuery{Sort: sortScore, Descending: true, Limit: defaultUsersLimit}},
+		{"analysed sorts descending by default", "sort=analysed", &UsersQuery{Sort: sortAnalysed, Descending: true, Limit: defaultUsersLimit}},
+		{"order overrides the default", "sort=score&order=asc", &UsersQuery{Sort: sortScore, Limit: defaultUsersLimit}},
+		{"names can sort descending", "order=desc", &UsersQuery{Sort: sortName, Descending: true, Limit: defaultUsersLimit}},
+		{"score bounds", "min_score=-0.5&max_score=0.5", &UsersQuery{Sort: sortName, MinScore: score(-0.5), MaxScore: score(0.5), Limit: defaultUsersLimit}},
+		{"equal score bounds", "min_score=0&max_score=0", &UsersQuery{Sort: sortName, MinScore: score(0), MaxScore: score(0), Limit: defaultUsersLimit}},
+		{"the cursor and limit", "cursor=abc&limit=1000", &UsersQuery{Sort: sortName, Cursor: "abc", Limit: maxUsersLimit}},
+		{"an unknown sort", "sort=followers", nil},
+		{"an unknown order", "order=up", nil},
+		{"a score that is not a number", "min_score=high", nil},
+		{"a score out of range", "max_score=1.5", nil},
+		{"a min_score over max_score", "min_score=0.5&max_score=-0.5", nil},
+		{"a limit that is not a number", "limit=ten", nil},
+		{"a limit that is not positive", "limit=0", nil},
+		{"a limit over the maximum", "limit=1001", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, err := unmarshalUsersQuery(values)
+			if test.want == nil {
+				if status, _ := classify(err); err == nil || status != http.StatusBadRequest {
+					t.Errorf("unmarshalUsersQuery(%q) = %v, want a 400", test.query, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(query, test.want) {
+				t.Errorf("unmarshalUsersQuery(%q) = %+v, %v, want %+v", test.query, query, err, test.want)
+			}
+		})
+	}
+}
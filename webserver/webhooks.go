@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type (
+	// Webhook is a subscription to events about analysed users. The analyser
+	// sends the events and signs them with Secret. If UserIDs is empty then
+	// events for every user are sent. Threshold is how far a user's
+	// AverageScore has to move for a sentiment shift event. Owner is the
+	// account or key that registered the webhook.
+	Webhook struct {
+		ID        int64 `datastore:"-"`
+		URL       string
+		Secret    string `json:"-"`
+		Events    []string
+		UserIDs   []int64
+		Threshold float64
+		Created   time.Time
+		Owner     string
+	}
+
+	// WebhookRequest is the body of a request to create a webhook.
+	WebhookRequest struct {
+		URL, Secret string
+		Events      []string
+		UserIDs     []int64
+		Threshold   float64
+	}
+)
+
+const (
+	webhookKind = "Webhook"
+
+	eventAnalysisCompleted = "analysis.completed"
+	eventSentimentShifted  = "sentiment.shifted"
+	eventAlertTriggered    = "alert.triggered"
+)
+
+// webhookEvents are all of the events that a webhook can subscribe to.
+var webhookEvents = map[string]bool{
+	eventAnalysisCompleted: true,
+	eventSentimentShifted:  true,
+	eventAlertTriggered:    true,
+}
+
+// privateNetworks are the address ranges that are only reachable inside a
+// network, webhooks cannot point at them.
+var privateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// parseNetworks parses the CIDR ranges, they are constants so it panics if
+// one cannot be parsed.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// internalIP reports whether ip is loopback, private, link-local or otherwise
+// not on the internet.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookHost resolves the host and fails if any of its addresses are
+// internal, so that webhooks cannot be used to reach the services behind the
+// analyser. The analyser checks the address again when it connects, in case
+// the host resolves differently by then.
+func checkWebhookHost(host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return invalid("webhook host %s could not be resolved: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return invalid("webhook host %s is not on the internet", host)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the request would not make a usable webhook.
+func (req *WebhookRequest) Validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return &ValidationError{Err: err}
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalid("webhook URL must be an absolute http or https URL")
+	}
+	if err := checkWebhookHost(u.Hostname()); err != nil {
+		return err
+	}
+	if req.Secret == "" {
+		return invalid("webhook secret was empty, but should not have been")
+	}
+	if len(req.Events) == 0 {
+		return invalid("webhook must subscribe to at least one event")
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			return invalid("unknown webhook event: %s", event)
+		}
+		if event == eventSentimentShifted && req.Threshold <= 0 {
+			return invalid("webhook threshold must be positive to subscribe to sentiment shifts")
+		}
+	}
+	return nil
+}
+
+// listWebhooks gets the webhooks the caller in ctx registered, admins get all
+// of them.
+func listWebhooks(ctx context.Context, ds *datastore.Client) ([]Webhook, error) {
+	query := datastore.NewQuery(webhookKind)
+	if err := requireRole(ctx, roleAdmin); err != nil {
+		owner, err := requireOwner(ctx)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Filter("Owner =", owner)
+	}
+	hooks := make([]Webhook, 0)
+	keys, err := ds.GetAll(context.Background(), query.Order("Created"), &hooks)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		hooks[i].ID = key.ID
+	}
+	return hooks, nil
+}
+
+// createWebhook validates the request and stores it as a new webhook owned by
+// the caller in ctx.
+func createWebhook(ctx context.Context, req *WebhookRequest, ds *datastore.Client) (*Webhook, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	hook := &Webhook{
+		URL:       req.URL,
+		Secret:    req.Secret,
+		Events:    req.Events,
+		UserIDs:   req.UserIDs,
+		Threshold: req.Threshold,
+		Created:   time.Now(),
+		Owner:     ownerFrom(ctx),
+	}
+	key, err := ds.Put(context.Background(), datastore.IncompleteKey(webhookKind, nil), hook)
+	if err != nil {
+		return nil, err
+	}
+	hook.ID = key.ID
+	return hook, nil
+}
+
+// deleteWebhook removes the webhook with the id, it fails with a 403 unless
+// the caller in ctx owns it.
+func deleteWebhook(ctx context.Context, id int64, ds *datastore.Client) error {
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		key := datastore.IDKey(webhookKind, id, nil)
+		hook := &Webhook{}
+		if err := tx.Get(key, hook); err == datastore.ErrNoSuchEntity {
+			return &APIError{Status: http.StatusNotFound, Code: codeNotFound, Err: fmt.Errorf("there is no webhook with the id %d", id)}
+		} else if err != nil {
+			return err
+		}
+		if err := checkOwner(ctx, hook.Owner); err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return err
+}
+
+// WebhooksHO returns a handler for webhook subscriptions. GET lists the
+// caller's webhooks, or every webhook for admins, POST creates one from a JSON
+// WebhookRequest body, and DELETE removes the caller's webhook with the id
+// parameter.
+func WebhooksHO(ds *datastore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := listWebhooks(r.Context(), ds)
+			if err != nil {
+				writeError("List", err, w)
+				return
+			}
+			data = hooks
+		case http.MethodPost:
+			req := &WebhookRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			hook, err := createWebhook(r.Context(), req, ds)
+			if err != nil {
+				writeError("Create", err, w)
+				return
+			}
+			data = hook
+		case http.MethodDelete:
+			id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeError("Unmarshal", err, w)
+				return
+			}
+			if err := deleteWebhook(r.Context(), id, ds); err != nil {
+				writeError("Delete", err, w)
+				return
+			}
+			data = struct{ Message string }{Message: "The webhook has been deleted."}
+		default:
+			notAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+			return
+		}
+		writeJSON(data, w)
+	}
+}